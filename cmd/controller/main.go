@@ -1,42 +1,98 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/junsooki/AirMac/internal/config"
 	"github.com/junsooki/AirMac/internal/decoder"
 	"github.com/junsooki/AirMac/internal/display"
 	"github.com/junsooki/AirMac/internal/peer"
 	"github.com/junsooki/AirMac/internal/signaling"
+	"github.com/junsooki/AirMac/internal/transport"
 )
 
 func main() {
 	cfg := config.ParseControllerFlags()
 
-	if cfg.HostID == "" {
-		log.Fatal("Usage: airmac-controller -signaling <url> -host <host-id>")
+	if cfg.HostID == "" && cfg.DirectAddr == "" {
+		log.Fatal("Usage: airmac-controller -signaling <url> -host <host-id> | -direct <host:port> -pin <fingerprint>")
 	}
 
 	log.Printf("AirMac Controller starting")
 	log.Printf("  Controller ID: %s", cfg.ControllerID)
-	log.Printf("  Signaling:     %s", cfg.SignalingURL)
-	log.Printf("  Target host:   %s", cfg.HostID)
+	if cfg.DirectAddr != "" {
+		log.Printf("  Direct:        %s", cfg.DirectAddr)
+	} else {
+		log.Printf("  Signaling:     %s", cfg.SignalingURL)
+		log.Printf("  Relay:         %s", cfg.RelayURL)
+		log.Printf("  Target host:   %s", cfg.HostID)
+	}
 
-	// Decoder.
-	dec := decoder.NewJPEGDecoder()
+	if cfg.Codec != 0 {
+		log.Printf("  Codec:         %s", cfg.Codec)
+	}
 
-	// Peer manager.
-	var ctrlPeer *peer.Controller
+	// The current session and its transport (WebRTC, relay or direct
+	// QUIC). attach replaces them on the signaling goroutine while the
+	// display sends input from its own loop.
+	var (
+		mu      sync.Mutex
+		current *session
+		conn    transport.Transport
+	)
 
 	// Display — sends input back to host.
-	disp := display.NewEbitenDisplay(func(eventJSON []byte) {
-		if ctrlPeer != nil {
-			ctrlPeer.Transport().SendInput(eventJSON)
+	disp := display.NewEbitenDisplay(func(data []byte, reliable bool) {
+		mu.Lock()
+		t := conn
+		mu.Unlock()
+		if t == nil {
+			return
+		}
+		if reliable {
+			t.SendInput(data)
+		} else {
+			t.SendMove(data)
 		}
 	})
 
+	// attach wires a session transport to the display, replacing any
+	// previous session.
+	attach := func(t transport.Transport) {
+		mu.Lock()
+		defer mu.Unlock()
+		if current != nil {
+			current.close()
+		}
+		current = newSession(t, cfg.Codec, disp)
+		conn = t
+	}
+
+	var shutdown func()
+	if cfg.DirectAddr != "" {
+		shutdown = dialDirect(cfg, attach)
+	} else {
+		shutdown = connectSignaling(cfg, attach)
+	}
+	defer shutdown()
+
+	// Ebitengine RunGame must be on the main goroutine (macOS requirement).
+	if err := disp.Run(); err != nil {
+		log.Fatalf("display: %v", err)
+	}
+}
+
+// connectSignaling registers with the signaling server and connects to the
+// target host over WebRTC, falling back to the relay if ICE fails.
+func connectSignaling(cfg *config.ControllerConfig, attach func(transport.Transport)) (shutdown func()) {
+	// Peer manager.
+	var ctrlPeer *peer.Controller
+
 	// Signaling.
 	var sig *signaling.Client
 	sig = signaling.NewClient(cfg.SignalingURL, cfg.ControllerID, signaling.ClientTypeController, signaling.Handler{
@@ -45,20 +101,20 @@ func main() {
 
 			// Create peer and send offer.
 			var err error
-			ctrlPeer, err = peer.NewController(sig, cfg.HostID)
+			ctrlPeer, err = peer.NewController(sig, cfg.HostID, cfg.RelayURL)
 			if err != nil {
 				log.Printf("create controller peer: %v", err)
 				os.Exit(1)
 			}
 
-			// Wire frame receiving.
-			ctrlPeer.Transport().OnFrame(func(data []byte) {
-				img, err := dec.Decode(data)
-				if err != nil {
-					return
+			if cfg.Video && decoder.VP8Available {
+				if err := ctrlPeer.EnableVideo(); err != nil {
+					log.Printf("enable video: %v", err)
 				}
-				disp.SetFrame(img)
-			})
+			}
+
+			// Wire frame receiving.
+			attach(ctrlPeer.Transport())
 
 			if err := ctrlPeer.Connect(); err != nil {
 				log.Printf("controller connect: %v", err)
@@ -78,6 +134,13 @@ func main() {
 				}
 			}
 		},
+		OnRelayAnswer: func(from string, payload json.RawMessage) {
+			if ctrlPeer != nil {
+				if err := ctrlPeer.HandleRelayAnswer(payload); err != nil {
+					log.Printf("handle relay answer: %v", err)
+				}
+			}
+		},
 		OnError: func(msg string) {
 			log.Printf("signaling error: %s", msg)
 		},
@@ -86,14 +149,37 @@ func main() {
 	if err := sig.Connect(); err != nil {
 		log.Fatalf("signaling connect: %v", err)
 	}
-	defer sig.Close()
 
-	// Ebitengine RunGame must be on the main goroutine (macOS requirement).
-	if err := disp.Run(); err != nil {
-		log.Fatalf("display: %v", err)
+	return func() {
+		sig.Close()
+		if ctrlPeer != nil {
+			ctrlPeer.Close()
+		}
+	}
+}
+
+// dialDirect connects to a host in direct mode over QUIC.
+func dialDirect(cfg *config.ControllerConfig, attach func(transport.Transport)) (shutdown func()) {
+	cert, err := transport.LoadOrCreateCertificate(cfg.DirectCert)
+	if err != nil {
+		log.Fatalf("direct certificate: %v", err)
+	}
+	log.Printf("Certificate fingerprint (host -allow): %s", transport.CertificateFingerprint(cert))
+	if cfg.DirectPin == "" {
+		log.Fatal("-pin is required with -direct (printed by the host on startup)")
 	}
 
-	if ctrlPeer != nil {
-		ctrlPeer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	t, err := transport.DialQUIC(ctx, cfg.DirectAddr, cfg.DirectPin, cert)
+	if err != nil {
+		log.Fatalf("direct connect: %v", err)
+	}
+	log.Printf("Connected directly to %s", t.RemoteAddr())
+
+	attach(t)
+
+	return func() {
+		t.Close()
 	}
 }
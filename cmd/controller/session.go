@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/decoder"
+	"github.com/junsooki/AirMac/internal/display"
+	"github.com/junsooki/AirMac/internal/input"
+	"github.com/junsooki/AirMac/internal/latency"
+	"github.com/junsooki/AirMac/internal/protocol"
+	"github.com/junsooki/AirMac/internal/transport"
+)
+
+const (
+	// pingInterval is how often the host clock offset is re-measured.
+	pingInterval = 2 * time.Second
+	// statsInterval is how often latency percentiles are logged.
+	statsInterval = 10 * time.Second
+	// statsWindow is how many recent frames the percentiles cover.
+	statsWindow = 300
+	// refreshRetry is how long to wait for a keyframe before asking again.
+	refreshRetry = time.Second
+)
+
+// session handles the frames and control messages of one host connection.
+type session struct {
+	t transport.Transport
+	// codec is the image codec to ask the host for (0 = host's choice).
+	codec protocol.Codec
+	// decoders holds whole-frame image decoders, created on first use.
+	decoders map[protocol.Codec]decoder.Decoder
+	// vp8 decodes frames from the video track, which carries the first
+	// stream, created on the first one.
+	vp8  *decoder.VP8Decoder
+	disp *display.EbitenDisplay
+	done chan struct{}
+
+	helloDone chan struct{}
+	helloOnce sync.Once
+
+	// streams holds the decoding state of each of the host's frame
+	// streams, created on their first frame.
+	frameMu sync.Mutex
+	streams map[uint8]*remoteStream
+
+	// Cursor messages may be reordered; only the newest position and
+	// shape are applied.
+	cursorMu    sync.Mutex
+	cursorSeq   uint32
+	cursorShape uint32
+	cursorSeen  bool
+
+	// displays are the host's displays and streamDisplays the ID of the
+	// one each stream captures; empty if the host can't switch.
+	displayMu      sync.Mutex
+	displays       []protocol.DisplayInfo
+	streamDisplays []uint32
+
+	clock latency.Clock
+	stats *latency.Stats
+	// pending is the sample of the frame last set on the display, completed
+	// when the display presents it.
+	pendingMu  sync.Mutex
+	pending    latency.Sample
+	pendingSet time.Time
+	hasPending bool
+}
+
+// remoteStream is the decoding state of one frame stream.
+type remoteStream struct {
+	id      uint8
+	tileDec *decoder.TileDecoder
+	// frames holds the decoded frames the display gives back, and release
+	// gives one back.
+	frames  *decoder.FramePool
+	release func(*image.RGBA)
+	// Frames arrive unordered; only display frames newer than the last one.
+	lastShown uint32
+	shown     bool
+	// refreshAsked is when a keyframe was last requested, zero once one
+	// arrives.
+	refreshAsked time.Time
+}
+
+// newSession wires t to the display and starts the session's background
+// loops.
+func newSession(t transport.Transport, codec protocol.Codec, disp *display.EbitenDisplay) *session {
+	s := &session{
+		t:         t,
+		codec:     codec,
+		decoders:  map[protocol.Codec]decoder.Decoder{},
+		streams:   map[uint8]*remoteStream{},
+		disp:      disp,
+		done:      make(chan struct{}),
+		helloDone: make(chan struct{}),
+		stats:     latency.NewStats(statsWindow),
+	}
+	t.OnFrame(s.handleFrame)
+	t.OnControl(s.handleControl)
+	t.OnCursor(s.handleCursor)
+	if v, ok := t.(transport.Video); ok {
+		v.OnVideo(s.handleVideo)
+	}
+	disp.OnPresent(s.presented)
+	disp.OnSwitchDisplay(s.switchDisplay)
+
+	go s.sendHello()
+	go s.monitorLatency()
+	return s
+}
+
+// close stops the session's background loops.
+func (s *session) close() {
+	close(s.done)
+	s.frameMu.Lock()
+	if s.vp8 != nil {
+		s.vp8.Close()
+		s.vp8 = nil
+	}
+	s.frameMu.Unlock()
+}
+
+func (s *session) handleFrame(data []byte) {
+	arrived := time.Now()
+	hdr, payload, err := protocol.ParseFrame(data)
+	if err != nil {
+		log.Printf("parse frame: %v", err)
+		return
+	}
+
+	s.frameMu.Lock()
+	defer s.frameMu.Unlock()
+	st := s.stream(hdr.Stream)
+	if st.shown && !protocol.SeqNewer(hdr.Seq, st.lastShown) {
+		return
+	}
+	if hdr.Flags&protocol.FlagIdle != 0 {
+		s.idle(st, hdr)
+		return
+	}
+	img, err := s.decode(st, hdr, payload)
+	if err != nil {
+		log.Printf("decode frame %d of stream %d: %v", hdr.Seq, hdr.Stream, err)
+		return
+	}
+	decoded := time.Now()
+	s.disp.SetFrame(hdr.Stream, img, st.release)
+	st.lastShown, st.shown = hdr.Seq, true
+
+	// Network latency needs the host clock offset; until the first pong,
+	// frames are shown but not measured.
+	if !s.clock.Synced() {
+		return
+	}
+	sent := s.clock.ToLocal(hdr.Timestamp.Add(hdr.Encode))
+	s.pendingMu.Lock()
+	s.pending = latency.Sample{
+		Capture: hdr.Capture,
+		Encode:  hdr.Encode,
+		Network: arrived.Sub(sent),
+		Decode:  decoded.Sub(arrived),
+	}
+	s.pendingSet = decoded
+	s.hasPending = true
+	s.pendingMu.Unlock()
+}
+
+// handleCursor applies a pointer update from the host to the display.
+func (s *session) handleCursor(data []byte) {
+	msg, err := protocol.ParseCursor(data)
+	if err != nil {
+		log.Printf("parse cursor: %v", err)
+		return
+	}
+
+	s.cursorMu.Lock()
+	defer s.cursorMu.Unlock()
+	switch msg.Kind {
+	case protocol.CursorKindPosition:
+		if s.cursorSeen && !protocol.SeqNewer(msg.Seq, s.cursorSeq) {
+			return
+		}
+		s.cursorSeq, s.cursorSeen = msg.Seq, true
+		s.disp.SetCursor(msg.Stream, int(msg.X), int(msg.Y), int(msg.ScreenWidth), int(msg.ScreenHeight), msg.Visible)
+
+	case protocol.CursorKindShape:
+		if s.cursorShape != 0 && !protocol.SeqNewer(msg.Serial, s.cursorShape) {
+			return
+		}
+		img, err := png.Decode(bytes.NewReader(msg.Image))
+		if err != nil {
+			log.Printf("decode cursor shape: %v", err)
+			return
+		}
+		s.cursorShape = msg.Serial
+		s.disp.SetCursorShape(img, image.Pt(int(msg.HotspotX), int(msg.HotspotY)))
+	}
+}
+
+// stream returns the state of the stream numbered id, creating it if this
+// is its first frame. s.frameMu must be held.
+func (s *session) stream(id uint8) *remoteStream {
+	st, ok := s.streams[id]
+	if !ok {
+		frames := &decoder.FramePool{}
+		st = &remoteStream{
+			id:      id,
+			tileDec: decoder.NewTileDecoder(frames),
+			frames:  frames,
+			release: frames.Put,
+		}
+		s.streams[id] = st
+	}
+	return st
+}
+
+// idle handles a heartbeat from a host whose screen is unchanged. The
+// picture stays as it is, unless a frame before the heartbeat was lost or
+// none arrived yet, in which case a keyframe is requested. Heartbeats also
+// repeat a request whose keyframe hasn't arrived, as there may be no other
+// frame to prompt it.
+func (s *session) idle(st *remoteStream, hdr protocol.FrameHeader) {
+	if !st.shown || hdr.Seq != st.lastShown+1 || !st.refreshAsked.IsZero() {
+		s.requestRefresh(st)
+	}
+	if st.shown {
+		st.lastShown = hdr.Seq
+	}
+}
+
+// handleVideo decodes a frame from the video track. The track delivers
+// frames in order (pion reorders and retransmits RTP), so there is no
+// sequence check; if decoding fails the host is asked for a keyframe.
+// Video frames carry no envelope, so they are not included in latency stats.
+func (s *session) handleVideo(frame []byte) {
+	s.frameMu.Lock()
+	defer s.frameMu.Unlock()
+	if s.vp8 == nil {
+		dec, err := decoder.NewVP8Decoder()
+		if err != nil {
+			log.Printf("vp8 decoder: %v", err)
+			return
+		}
+		s.vp8 = dec
+	}
+	img, err := s.vp8.Decode(frame)
+	if err != nil {
+		log.Printf("decode video: %v", err)
+		s.requestKeyframe()
+		return
+	}
+	if img != nil {
+		s.disp.SetFrame(0, img, nil)
+	}
+}
+
+// requestKeyframe sends a PLI on the video track, unless one was sent
+// recently.
+func (s *session) requestKeyframe() {
+	st := s.stream(0)
+	if !st.refreshAsked.IsZero() && time.Since(st.refreshAsked) < refreshRetry {
+		return
+	}
+	st.refreshAsked = time.Now()
+	if v, ok := s.t.(transport.Video); ok {
+		v.RequestKeyframe()
+	}
+}
+
+// decode decodes a frame. Delta frames only update part of the picture, so
+// a gap in the sequence means the composite is missing something until the
+// next keyframe, which is requested.
+func (s *session) decode(st *remoteStream, hdr protocol.FrameHeader, payload []byte) (*image.RGBA, error) {
+	switch hdr.Codec {
+	case protocol.CodecTiles:
+		keyframe := hdr.Flags&protocol.FlagKeyframe != 0
+		if keyframe {
+			st.refreshAsked = time.Time{}
+		} else if st.shown && hdr.Seq != st.lastShown+1 {
+			s.requestRefresh(st)
+		}
+		img, err := st.tileDec.Decode(int(hdr.Width), int(hdr.Height), keyframe, payload)
+		if err != nil {
+			s.requestRefresh(st)
+		}
+		return img, err
+	}
+
+	// Anything else is a whole frame in an image codec.
+	dec, ok := s.decoders[hdr.Codec]
+	if !ok {
+		var err error
+		if dec, err = decoder.New(hdr.Codec); err != nil {
+			return nil, err
+		}
+		s.decoders[hdr.Codec] = dec
+	}
+	img := st.frames.Get(image.Rect(0, 0, int(hdr.Width), int(hdr.Height)))
+	if err := decoder.DecodeInto(dec, img, payload); err != nil {
+		st.frames.Put(img)
+		return nil, err
+	}
+	return img, nil
+}
+
+// requestRefresh asks the host for a keyframe of st, unless one was asked
+// for recently.
+func (s *session) requestRefresh(st *remoteStream) {
+	if !st.refreshAsked.IsZero() && time.Since(st.refreshAsked) < refreshRetry {
+		return
+	}
+	st.refreshAsked = time.Now()
+	msg, err := json.Marshal(protocol.ControlMessage{Type: protocol.ControlRefresh, Stream: st.id})
+	if err != nil {
+		return
+	}
+	s.t.SendControl(msg)
+}
+
+// presented completes the pending sample once the display draws its frame.
+func (s *session) presented() {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if !s.hasPending {
+		return
+	}
+	s.pending.Present = time.Since(s.pendingSet)
+	s.stats.Add(s.pending)
+	s.hasPending = false
+}
+
+func (s *session) handleControl(data []byte) {
+	received := time.Now()
+	var msg protocol.ControlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("unmarshal control: %v", err)
+		return
+	}
+	switch msg.Type {
+	case protocol.ControlHello:
+		format := input.ChooseFormat(msg.InputFormats)
+		log.Printf("Input format: %s", format)
+		s.disp.SetInputFormat(format)
+		if msg.Codec != "" {
+			log.Printf("Image codec: %s", msg.Codec)
+		}
+		if !msg.Cursor {
+			log.Println("Host doesn't send the pointer; it is not drawn")
+		}
+		s.disp.SetStreams(max(len(msg.Streams), 1))
+		s.setDisplays(msg)
+		s.helloOnce.Do(func() { close(s.helloDone) })
+
+	case protocol.ControlCodec:
+		log.Printf("Host switched image codec to %s", msg.Codec)
+
+	case protocol.ControlDisplay:
+		s.setDisplays(msg)
+
+	case protocol.ControlPong:
+		s.clock.AddExchange(time.Unix(0, msg.Origin), time.Unix(0, msg.Receive),
+			time.Unix(0, msg.Transmit), received)
+	}
+}
+
+// setDisplays records the host's displays and the ones its streams
+// capture from a hello or display message, and logs the display of the
+// message's stream.
+func (s *session) setDisplays(msg protocol.ControlMessage) {
+	streams := msg.Streams
+	if len(streams) == 0 && msg.Display != 0 {
+		// A host that streams a single display may not list it.
+		streams = []uint32{msg.Display}
+	}
+	s.displayMu.Lock()
+	first := s.displays == nil
+	s.displays, s.streamDisplays = msg.Displays, streams
+	s.displayMu.Unlock()
+
+	for i, d := range msg.Displays {
+		if d.ID == msg.Display {
+			log.Printf("Stream %d: host display %d of %d: %s (%dx%d)", msg.Stream, i+1, len(msg.Displays), d.Name, d.Width, d.Height)
+		}
+	}
+	if msg.Type == protocol.ControlHello && len(streams) > 1 {
+		log.Printf("Host streams %d displays; Ctrl+Alt+Enter shows the one under the pointer on its own", len(streams))
+	}
+	if first && len(msg.Displays) > 1 {
+		log.Println("Ctrl+Alt+Left/Right switches host displays")
+	}
+}
+
+// switchDisplay asks the host to capture, on the given stream, the display
+// step places after the one it captures now, wrapping around.
+func (s *session) switchDisplay(stream uint8, step int) {
+	s.displayMu.Lock()
+	n := len(s.displays)
+	var current uint32
+	if int(stream) < len(s.streamDisplays) {
+		current = s.streamDisplays[stream]
+	}
+	i := slices.IndexFunc(s.displays, func(d protocol.DisplayInfo) bool { return d.ID == current })
+	var id uint32
+	if n > 1 {
+		id = s.displays[((i+step)%n+n)%n].ID
+	}
+	s.displayMu.Unlock()
+	if n < 2 {
+		return
+	}
+
+	msg, err := json.Marshal(protocol.ControlMessage{Type: protocol.ControlDisplay, Stream: stream, Display: id})
+	if err != nil {
+		return
+	}
+	s.t.SendControl(msg)
+}
+
+// sendHello offers the supported input formats and image codecs until the
+// host answers. Input stays JSON if it never does (e.g. an older host).
+func (s *session) sendHello() {
+	formats := make([]string, len(input.Formats))
+	for i, f := range input.Formats {
+		formats[i] = string(f)
+	}
+	var codecs []string
+	for _, c := range decoder.Codecs() {
+		codecs = append(codecs, c.String())
+	}
+	hello := protocol.ControlMessage{
+		Type:         protocol.ControlHello,
+		InputFormats: formats,
+		Codecs:       codecs,
+		Cursor:       true,
+	}
+	if s.codec != 0 {
+		hello.Codec = s.codec.String()
+	}
+	msg, err := json.Marshal(hello)
+	if err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range 30 {
+		s.t.SendControl(msg)
+		select {
+		case <-s.helloDone:
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+	log.Println("Host did not answer hello; sending input as JSON")
+}
+
+// monitorLatency pings the host to keep the clock offset current and
+// periodically logs latency percentiles.
+func (s *session) monitorLatency() {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	report := time.NewTicker(statsInterval)
+	defer report.Stop()
+
+	s.sendPing()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ping.C:
+			s.sendPing()
+		case <-report.C:
+			if s.stats.Len() > 0 {
+				offset, rtt := s.clock.Offset()
+				log.Printf("clock offset %v (rtt %v); %s", offset, rtt, s.stats)
+			}
+		}
+	}
+}
+
+func (s *session) sendPing() {
+	msg, err := json.Marshal(protocol.ControlMessage{
+		Type:   protocol.ControlPing,
+		Origin: time.Now().UnixNano(),
+	})
+	if err != nil {
+		return
+	}
+	s.t.SendControl(msg)
+}
@@ -1,56 +1,301 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/junsooki/AirMac/internal/capture"
 	"github.com/junsooki/AirMac/internal/config"
 	"github.com/junsooki/AirMac/internal/encoder"
+	"github.com/junsooki/AirMac/internal/fec"
 	"github.com/junsooki/AirMac/internal/input"
 	"github.com/junsooki/AirMac/internal/peer"
 	"github.com/junsooki/AirMac/internal/permissions"
+	"github.com/junsooki/AirMac/internal/privacy"
 	"github.com/junsooki/AirMac/internal/signaling"
 	"github.com/junsooki/AirMac/internal/transport"
 )
 
 func main() {
 	cfg := config.ParseHostFlags()
+	if cfg.ListDisplays {
+		listDisplays()
+		return
+	}
+	if cfg.ListWindows {
+		listWindows()
+		return
+	}
 
 	log.Printf("AirMac Host starting")
-	log.Printf("  Host ID:    %s", cfg.HostID)
-	log.Printf("  Signaling:  %s", cfg.SignalingURL)
-	log.Printf("  Display:    %d", cfg.DisplayIndex)
-	log.Printf("  FPS:        %d", cfg.FPS)
+	if cfg.DirectAddr != "" {
+		log.Printf("  Direct:     %s", cfg.DirectAddr)
+	} else {
+		log.Printf("  Host ID:    %s", cfg.HostID)
+		log.Printf("  Signaling:  %s", cfg.SignalingURL)
+		log.Printf("  Relay:      %s", cfg.RelayURL)
+	}
+	log.Printf("  Source:     %s", cfg.Source)
+	if cfg.AllDisplays {
+		log.Printf("  Display:    all")
+	} else {
+		log.Printf("  Display:    %s", strings.Trim(fmt.Sprint(cfg.Displays), "[]"))
+	}
+	if cfg.Pull {
+		log.Printf("  FPS:        %d, pull", cfg.FPS)
+	} else {
+		log.Printf("  FPS:        %d", cfg.FPS)
+	}
 	log.Printf("  Quality:    %d", cfg.Quality)
-
-	// Check permissions.
-	if !permissions.HasScreenRecording() {
-		log.Println("Screen Recording permission not granted. Requesting...")
-		permissions.RequestScreenRecording()
-		log.Fatal("Please grant Screen Recording permission in System Settings and restart.")
+	switch {
+	case cfg.MaxWidth > 0:
+		log.Printf("  Scale:      %.0f%%, max width %d, %s", 100*cfg.Scale, cfg.MaxWidth, cfg.ScaleFilter)
+	case cfg.Scale < 1:
+		log.Printf("  Scale:      %.0f%%, %s", 100*cfg.Scale, cfg.ScaleFilter)
+	}
+	log.Printf("  Codec:      %s (available: %v)", cfg.Codec, encoder.Codecs())
+	if cfg.RefineAfter > 0 {
+		lossless := "off"
+		if cfg.RefineCodec != 0 {
+			lossless = cfg.RefineCodec.String()
+		}
+		log.Printf("  Refine:     after %d frames, quality %d, lossless %s", cfg.RefineAfter, cfg.RefineQuality, lossless)
+	} else {
+		log.Printf("  Refine:     off")
+	}
+	if cfg.EncodeWorkers > 0 {
+		log.Printf("  Workers:    %d", cfg.EncodeWorkers)
+	} else {
+		log.Printf("  Workers:    %d (one per CPU)", runtime.NumCPU())
+	}
+	log.Printf("  Refresh:    %v", cfg.Refresh)
+	switch {
+	case cfg.Video != "vp8":
+		log.Printf("  Video:      off")
+	case !encoder.VP8Available:
+		log.Printf("  Video:      unavailable (build with -tags vpx)")
+	default:
+		log.Printf("  Video:      vp8, %d kbit/s", cfg.Bitrate)
+	}
+	if cfg.Adaptive {
+		log.Printf("  Adaptive:   %d kbit/s, %v budget, quality >= %d, fps >= %d, scale >= %.0f%%",
+			cfg.Bitrate, cfg.LatencyBudget, cfg.MinQuality, cfg.MinFPS, 100*cfg.MinScale)
+	} else {
+		log.Printf("  Adaptive:   off")
+	}
+	if len(cfg.Mask) > 0 {
+		input := ""
+		if cfg.MaskInput {
+			input = ", clicks dropped"
+		}
+		log.Printf("  Mask:       %s (%s%s)", strings.Trim(fmt.Sprint(cfg.Mask), "[]"), cfg.MaskStyle, input)
 	}
-	if !permissions.HasAccessibility() {
-		log.Println("Accessibility permission not granted. Requesting...")
-		permissions.RequestAccessibility()
-		log.Fatal("Please grant Accessibility permission in System Settings and restart.")
+	switch {
+	case cfg.FECAdaptive:
+		log.Printf("  FEC:        auto")
+	case cfg.FECRedundancy > 0:
+		log.Printf("  FEC:        %.0f%%", 100*cfg.FECRedundancy)
+	default:
+		log.Printf("  FEC:        off")
 	}
 
-	// Screen capture.
-	cap, err := capture.NewCGCapturer(cfg.DisplayIndex, cfg.FPS)
-	if err != nil {
-		log.Fatalf("capture init: %v", err)
+	// Frame source. Only the screen and its windows need permissions and
+	// take input; synthetic and recorded sources are view-only.
+	screen := capture.Live(cfg.Source)
+	if screen {
+		if !permissions.HasScreenRecording() {
+			log.Println("Screen Recording permission not granted. Requesting...")
+			permissions.RequestScreenRecording()
+			log.Fatal("Please grant Screen Recording permission in System Settings and restart.")
+		}
+		if !permissions.HasAccessibility() {
+			log.Println("Accessibility permission not granted. Requesting...")
+			permissions.RequestAccessibility()
+			log.Fatal("Please grant Accessibility permission in System Settings and restart.")
+		}
 	}
 
-	// Encoder.
-	enc := encoder.NewJPEGEncoder(cfg.Quality)
+	// Privacy masks are applied as frames leave the sources.
+	var mask *privacy.Masker
+	if len(cfg.Mask) > 0 {
+		var err error
+		if mask, err = privacy.NewMasker(cfg.Mask, cfg.MaskStyle); err != nil {
+			log.Fatalf("privacy mask: %v", err)
+		}
+		defer mask.Close()
+	}
+	sources := openSources(cfg, screen, mask)
+	if !cfg.MaskInput {
+		mask = nil
+	}
 
 	// Input injector.
-	injector := input.NewCGEventInjector()
+	var injector input.Injector = input.NopInjector{}
+	if screen {
+		if inj, err := input.NewInjector(); err != nil {
+			log.Printf("input init: %v; the session is view-only", err)
+		} else {
+			injector = inj
+		}
+	}
+
+	// A new session stops the previous one's frame stream so they don't
+	// compete for frames.
+	var (
+		currentMu sync.Mutex
+		current   *session
+	)
+	serve := func(t transport.Transport) {
+		currentMu.Lock()
+		defer currentMu.Unlock()
+		if current != nil {
+			current.close()
+		}
+		current = newSession(t, cfg, injector, sources, mask)
+		current.start()
+	}
+
+	var shutdown func()
+	if cfg.DirectAddr != "" {
+		shutdown = listenDirect(cfg, serve)
+	} else {
+		shutdown = connectSignaling(cfg, serve)
+	}
+	defer shutdown()
+
+	for _, src := range sources {
+		if p, ok := capture.As[capture.Puller](src); ok && cfg.Pull {
+			p.SetPull(true)
+		}
+		if err := src.Start(); err != nil {
+			log.Fatalf("capture start: %v", err)
+		}
+		defer src.Stop()
+	}
+	go logCaptureStats(sources)
+
+	// Wait for interrupt.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	log.Println("Shutting down...")
+}
+
+// openSources opens a frame source for each display -display selects,
+// masked by mask if set, and recording the first if -record is set.
+func openSources(cfg *config.Config, screen bool, mask *privacy.Masker) []capture.Source {
+	indexes := cfg.Displays
+	if cfg.AllDisplays {
+		if !screen {
+			log.Fatalf("-display all needs -source screen")
+		}
+		var err error
+		if indexes, err = capture.AllDisplays(); err != nil {
+			log.Fatalf("list displays: %v", err)
+		}
+	}
+	if len(indexes) > 1 {
+		switch {
+		case cfg.Record != "":
+			log.Fatalf("-record needs a single display")
+		case screen && cfg.Source != "screen":
+			log.Fatalf("-source %s captures a single output or window; leave it out to capture several displays", cfg.Source)
+		}
+	}
+
+	var sources []capture.Source
+	for i, index := range indexes {
+		src, err := capture.Open(cfg.Source, index, cfg.FPS)
+		if err != nil {
+			log.Fatalf("capture init: %v", err)
+		}
+		if mask != nil {
+			src = mask.Wrap(src)
+		}
+		if cfg.Record != "" {
+			if src, err = capture.Record(src, cfg.Record); err != nil {
+				log.Fatalf("record: %v", err)
+			}
+			log.Printf("Recording frames to %s", cfg.Record)
+		}
+		info := src.Display()
+		if ws, ok := capture.As[capture.WindowSource](src); ok {
+			for _, w := range ws.Windows() {
+				log.Printf("Following window %d: %s %q", w.ID, w.App, w.Title)
+			}
+		}
+		if len(indexes) > 1 {
+			log.Printf("Stream %d capturing %s (%dx%d)", i, info.Name, info.Width, info.Height)
+		} else {
+			log.Printf("Capturing %s (%dx%d)", info.Name, info.Width, info.Height)
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// logCaptureStats logs how each source's capture keeps up, every
+// captureStatsInterval.
+func logCaptureStats(sources []capture.Source) {
+	for range time.Tick(captureStatsInterval) {
+		for i, src := range sources {
+			ss, ok := capture.As[capture.StatsSource](src)
+			if !ok {
+				continue
+			}
+			st := ss.CaptureStats()
+			log.Printf("Stream %d capture: %.1f fps, %v avg, %v max, %d dropped, %d skipped, %d overran",
+				i, st.FPS, st.CaptureAvg.Round(time.Microsecond), st.CaptureMax.Round(time.Microsecond),
+				st.Dropped, st.Skipped, st.Overrun)
+		}
+	}
+}
+
+// listDisplays prints the displays -display can select.
+func listDisplays() {
+	displays, err := capture.ListDisplays()
+	if err != nil {
+		log.Fatalf("list displays: %v", err)
+	}
+	for i, d := range displays {
+		primary := ""
+		if d.Primary {
+			primary = ", primary"
+		}
+		fmt.Printf("%d: %s (id %d) %dx%d @%gx at %d,%d%s\n",
+			i, d.Name, d.ID, d.Width, d.Height, d.Scale, d.Bounds.Min.X, d.Bounds.Min.Y, primary)
+	}
+}
+
+// listWindows prints the windows -window and -app can select.
+func listWindows() {
+	windows, err := capture.ListWindows()
+	if err != nil {
+		log.Fatalf("list windows: %v", err)
+	}
+	for _, w := range windows {
+		app := w.App
+		if w.Bundle != "" {
+			app += " (" + w.Bundle + ")"
+		}
+		fmt.Printf("%d: %s %q %dx%d at %d,%d (pid %d)\n",
+			w.ID, app, w.Title, w.Bounds.Dx(), w.Bounds.Dy(), w.Bounds.Min.X, w.Bounds.Min.Y, w.PID)
+	}
+}
 
+// connectSignaling registers with the signaling server and serves each
+// controller that sends an offer over WebRTC.
+func connectSignaling(cfg *config.Config, serve func(transport.Transport)) (shutdown func()) {
 	// Peer manager (created on first offer).
 	var hostPeer *peer.Host
 	var sig *signaling.Client
@@ -66,28 +311,24 @@ func main() {
 			if hostPeer != nil {
 				hostPeer.Close()
 			}
-			hostPeer, err = peer.NewHost(sig)
+			hostPeer, err = peer.NewHost(sig, cfg.RelayURL)
 			if err != nil {
 				log.Printf("create host peer: %v", err)
 				return
 			}
-
-			// Wire input receiving.
-			hostPeer.Transport().OnInput(func(data []byte) {
-				var evt input.InputEvent
-				if err := json.Unmarshal(data, &evt); err != nil {
-					log.Printf("unmarshal input: %v", err)
-					return
-				}
-				injector.Inject(&evt)
-			})
+			if cfg.FECAdaptive || cfg.FECRedundancy > 0 {
+				hostPeer.SetFEC(fec.NewEncoder(cfg.FECRedundancy, cfg.FECAdaptive))
+			}
+			if cfg.Video == "vp8" && encoder.VP8Available {
+				hostPeer.EnableVideo()
+			}
 
 			if err := hostPeer.HandleOffer(from, payload); err != nil {
 				log.Printf("handle offer: %v", err)
 				return
 			}
 
-			go streamFrames(cap.Frames(), enc, hostPeer.Transport())
+			serve(hostPeer.Transport())
 		},
 		OnICECandidate: func(from string, payload json.RawMessage) {
 			if hostPeer != nil {
@@ -96,6 +337,14 @@ func main() {
 				}
 			}
 		},
+		OnRelayOffer: func(from string, payload json.RawMessage) {
+			log.Printf("Received relay offer from %s", from)
+			if hostPeer != nil {
+				if err := hostPeer.HandleRelayOffer(from, payload); err != nil {
+					log.Printf("handle relay offer: %v", err)
+				}
+			}
+		},
 		OnError: func(msg string) {
 			log.Printf("signaling error: %s", msg)
 		},
@@ -104,35 +353,73 @@ func main() {
 	if err := sig.Connect(); err != nil {
 		log.Fatalf("signaling connect: %v", err)
 	}
-	defer sig.Close()
-
-	if err := cap.Start(); err != nil {
-		log.Fatalf("capture start: %v", err)
-	}
-	defer cap.Stop()
 
 	log.Printf("Host ready. Share this ID with controllers: %s", cfg.HostID)
 
-	// Wait for interrupt.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-
-	log.Println("Shutting down...")
-	if hostPeer != nil {
-		hostPeer.Close()
+	return func() {
+		sig.Close()
+		if hostPeer != nil {
+			hostPeer.Close()
+		}
 	}
 }
 
-func streamFrames(frames <-chan *capture.Frame, enc *encoder.JPEGEncoder, t *transport.DataChannelTransport) {
-	for frame := range frames {
-		data, err := enc.Encode(frame.Image)
-		if err != nil {
-			log.Printf("encode frame: %v", err)
-			continue
+// listenDirect accepts direct QUIC sessions, one controller at a time.
+func listenDirect(cfg *config.Config, serve func(transport.Transport)) (shutdown func()) {
+	cert, err := transport.LoadOrCreateCertificate(cfg.DirectCert)
+	if err != nil {
+		log.Fatalf("direct certificate: %v", err)
+	}
+	log.Printf("Certificate fingerprint (controller -pin): %s", transport.CertificateFingerprint(cert))
+	if len(cfg.DirectAllow) == 0 {
+		log.Fatal("-allow is required with -direct (printed by the controller on startup)")
+	}
+	ln, err := transport.ListenQUIC(cfg.DirectAddr, cert, cfg.DirectAllow)
+	if err != nil {
+		log.Fatalf("direct listen: %v", err)
+	}
+
+	log.Printf("Host ready for direct sessions on %s", cfg.DirectAddr)
+
+	// current is the connection of the session being served, closed when
+	// a new one arrives or on shutdown.
+	var (
+		mu      sync.Mutex
+		current *transport.QUICTransport
+		closed  bool
+	)
+	go func() {
+		for {
+			t, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if closed {
+				mu.Unlock()
+				t.Close()
+				return
+			}
+			prev := current
+			current = t
+			mu.Unlock()
+			log.Printf("Direct session from %s", t.RemoteAddr())
+			if prev != nil {
+				prev.Close()
+			}
+			serve(t)
 		}
-		if err := t.SendFrame(data); err != nil {
-			continue
+	}()
+
+	return func() {
+		ln.Close()
+		mu.Lock()
+		closed = true
+		t := current
+		current = nil
+		mu.Unlock()
+		if t != nil {
+			t.Close()
 		}
 	}
 }
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/capture"
+	"github.com/junsooki/AirMac/internal/config"
+	"github.com/junsooki/AirMac/internal/encoder"
+	"github.com/junsooki/AirMac/internal/input"
+	"github.com/junsooki/AirMac/internal/privacy"
+	"github.com/junsooki/AirMac/internal/protocol"
+	"github.com/junsooki/AirMac/internal/ratecontrol"
+	"github.com/junsooki/AirMac/internal/scale"
+	"github.com/junsooki/AirMac/internal/transport"
+)
+
+const (
+	// rateInterval is how often the rate controller reviews the network.
+	rateInterval = time.Second
+	// cursorInterval is how often the pointer position is sampled, and
+	// cursorShapeEvery how many samples pass between checks of its image.
+	cursorInterval   = 8 * time.Millisecond
+	cursorShapeEvery = 6
+	// heartbeatInterval is how often an idle frame is sent while the
+	// screen is unchanged.
+	heartbeatInterval = time.Second
+	// captureStatsInterval is how often capture timing is logged.
+	captureStatsInterval = 10 * time.Second
+	// videoSettle is how long unchanged frames are still fed to the VP8
+	// encoder, which sharpens static content over several frames.
+	videoSettle = time.Second
+)
+
+// session serves one controller: it injects its input, answers its control
+// messages and streams frames of each captured display to it.
+type session struct {
+	t        transport.Transport
+	injector input.Injector
+	moves    input.MoveFilter
+	// mask, if set, drops clicks in masked areas.
+	mask *privacy.Masker
+	done chan struct{}
+	// cursorOnce starts the pointer stream for a controller that draws it.
+	cursorOnce sync.Once
+
+	// streams holds one stream per captured display, indexed by stream
+	// number. quality is the JPEG quality when rate control is off.
+	streams []*stream
+	quality int
+	// The refinement passes; the lossless one is dropped if the controller
+	// can't decode it.
+	refineAfter    int
+	refineQuality  int
+	refineLossless encoder.Encoder
+	// vp8 is set when the transport negotiated a video track, which the
+	// first stream is sent on.
+	vp8       *encoder.VP8Encoder
+	video     transport.Video
+	interval  time.Duration
+	lastVideo time.Time
+
+	// rate adapts quality, capture rate and scale of every stream to the
+	// network; nil if disabled.
+	rate *ratecontrol.Controller
+}
+
+func newSession(t transport.Transport, cfg *config.Config, injector input.Injector, sources []capture.Source, mask *privacy.Masker) *session {
+	s := &session{
+		t:        t,
+		injector: injector,
+		mask:     mask,
+		done:     make(chan struct{}),
+		quality:  cfg.Quality,
+		interval: time.Second / time.Duration(cfg.FPS),
+	}
+	for i, src := range sources {
+		enc, err := encoder.New(cfg.Codec, cfg.Quality)
+		if err != nil {
+			log.Printf("%v; using jpeg", err)
+			enc = encoder.NewJPEGEncoder(cfg.Quality)
+		}
+		scaler := scale.NewScaler(cfg.ScaleFilter, cfg.Scale, cfg.MaxWidth)
+		s.streams = append(s.streams, newStream(s, uint8(i), src, enc, scaler, cfg.Refresh, cfg.EncodeWorkers))
+	}
+
+	if cfg.RefineAfter > 0 {
+		s.refineAfter, s.refineQuality = cfg.RefineAfter, cfg.RefineQuality
+		if cfg.RefineCodec != 0 {
+			var err error
+			if s.refineLossless, err = encoder.New(cfg.RefineCodec, 0); err != nil {
+				log.Printf("%v; refining without a lossless pass", err)
+			}
+		}
+		s.updateRefinement()
+	}
+
+	// A previous session may have lowered the capture rate.
+	s.setFPS(cfg.FPS)
+	if cfg.Adaptive {
+		s.rate = ratecontrol.New(ratecontrol.Config{
+			TargetKbps:    cfg.Bitrate,
+			LatencyBudget: cfg.LatencyBudget,
+			Max:           ratecontrol.Settings{Quality: cfg.Quality, FPS: cfg.FPS, Scale: 1},
+			MinQuality:    cfg.MinQuality,
+			MinFPS:        cfg.MinFPS,
+			MinScale:      cfg.MinScale,
+		})
+	}
+
+	if v, ok := t.(transport.Video); ok && v.VideoActive() {
+		vp8, err := encoder.NewVP8Encoder(cfg.FPS, cfg.Bitrate)
+		if err != nil {
+			log.Printf("vp8 encoder: %v; sending frames over the data channel", err)
+		} else {
+			log.Printf("Streaming VP8 at %d kbit/s over the video track", cfg.Bitrate)
+			if len(s.streams) > 1 {
+				log.Printf("Only the first display is sent as video; the others go over the data channel")
+			}
+			s.vp8, s.video = vp8, v
+			v.OnKeyframeRequest(vp8.RequestKeyframe)
+		}
+	}
+
+	t.OnInput(s.handleInput)
+	t.OnControl(s.handleControl)
+	return s
+}
+
+// start streams each display's frames until the session is closed.
+func (s *session) start() {
+	for _, st := range s.streams {
+		go st.run(st.source.Frames())
+	}
+	if s.rate != nil {
+		go s.adaptLoop()
+	}
+}
+
+// close stops the session's frame stream.
+func (s *session) close() {
+	close(s.done)
+}
+
+func (s *session) handleInput(data []byte) {
+	evt, err := input.DecodeEvent(data)
+	if err != nil {
+		log.Printf("decode input: %v", err)
+		return
+	}
+	st := s.stream(evt.Stream)
+	if st == nil {
+		log.Printf("input for unknown stream %d", evt.Stream)
+		return
+	}
+	if !s.moves.Allow(evt) {
+		return
+	}
+	if st.mapInput(evt) {
+		s.injector.Inject(evt)
+	}
+}
+
+// handleControl answers control messages from the controller.
+func (s *session) handleControl(data []byte) {
+	received := time.Now()
+	var msg protocol.ControlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("unmarshal control: %v", err)
+		return
+	}
+
+	switch msg.Type {
+	case protocol.ControlHello:
+		format := input.ChooseFormat(msg.InputFormats)
+		log.Printf("Input format: %s", format)
+		s.setCodec(s.chooseCodec(msg.Codec, msg.Codecs))
+		if s.refineLossless != nil && !canDecode(msg.Codecs, s.refineLossless.Codec()) {
+			log.Printf("Controller can't decode %s; refining without a lossless pass", s.refineLossless.Codec())
+			s.refineLossless = nil
+			s.updateRefinement()
+		}
+		cursors, canCursor := s.cursorSources()
+		if msg.Cursor && canCursor {
+			s.cursorOnce.Do(func() { go s.streamCursor(cursors) })
+		}
+		reply := protocol.ControlMessage{
+			Type:         protocol.ControlHello,
+			InputFormats: []string{string(format)},
+			Codec:        s.codec().String(),
+			Cursor:       msg.Cursor && canCursor,
+			Streams:      s.streamDisplays(),
+		}
+		reply.Display, reply.Displays = s.streams[0].displays()
+		s.sendControl(reply)
+
+	case protocol.ControlCodec:
+		c, err := protocol.ParseCodec(msg.Codec)
+		if err == nil && slices.Contains(encoder.Codecs(), c) {
+			s.setCodec(c)
+		} else {
+			log.Printf("Controller asked for unavailable codec %q", msg.Codec)
+		}
+		s.sendControl(protocol.ControlMessage{
+			Type:  protocol.ControlCodec,
+			Codec: s.codec().String(),
+		})
+
+	case protocol.ControlDisplay:
+		st := s.stream(msg.Stream)
+		if st == nil {
+			log.Printf("Controller asked to switch unknown stream %d", msg.Stream)
+			return
+		}
+		sw, ok := capture.As[capture.DisplaySwitcher](st.source)
+		if !ok {
+			log.Printf("Controller asked for display %d, but the source can't switch", msg.Display)
+			return
+		}
+		if err := sw.SetDisplay(msg.Display); err != nil {
+			log.Printf("switch display: %v", err)
+		} else {
+			st.tiles.RequestRefresh()
+		}
+		info := st.source.Display()
+		log.Printf("Stream %d capturing %s (%dx%d)", st.id, info.Name, info.Width, info.Height)
+		st.setDisplay(info)
+		reply := protocol.ControlMessage{
+			Type:    protocol.ControlDisplay,
+			Stream:  st.id,
+			Streams: s.streamDisplays(),
+		}
+		reply.Display, reply.Displays = st.displays()
+		s.sendControl(reply)
+
+	case protocol.ControlPing:
+		s.sendControl(protocol.ControlMessage{
+			Type:     protocol.ControlPong,
+			Origin:   msg.Origin,
+			Receive:  received.UnixNano(),
+			Transmit: time.Now().UnixNano(),
+		})
+
+	case protocol.ControlRefresh:
+		if st := s.stream(msg.Stream); st != nil {
+			st.tiles.RequestRefresh()
+		}
+	}
+}
+
+// stream returns the stream numbered id, or nil if there is none.
+func (s *session) stream(id uint8) *stream {
+	if int(id) >= len(s.streams) {
+		return nil
+	}
+	return s.streams[id]
+}
+
+// streamDisplays lists the ID of the display each stream captures.
+func (s *session) streamDisplays() []uint32 {
+	ids := make([]uint32, len(s.streams))
+	for i, st := range s.streams {
+		ids[i] = st.source.Display().ID
+	}
+	return ids
+}
+
+// chooseCodec picks the image codec for the session: the one the
+// controller wants if the host can encode it, else the current one if the
+// controller can decode it, else the first both support. A controller that
+// lists no codecs only decodes JPEG.
+func (s *session) chooseCodec(want string, decodable []string) protocol.Codec {
+	if c, err := protocol.ParseCodec(want); err == nil && slices.Contains(encoder.Codecs(), c) {
+		return c
+	}
+	if c := s.codec(); canDecode(decodable, c) {
+		return c
+	}
+	for _, c := range encoder.Codecs() {
+		if canDecode(decodable, c) {
+			return c
+		}
+	}
+	return protocol.CodecJPEG
+}
+
+// canDecode reports whether a controller that listed the codecs decodable
+// in its hello can decode c.
+func canDecode(decodable []string, c protocol.Codec) bool {
+	if len(decodable) == 0 {
+		return c == protocol.CodecJPEG
+	}
+	return slices.Contains(decodable, c.String())
+}
+
+// codec returns the image codec the streams encode tiles in.
+func (s *session) codec() protocol.Codec {
+	return s.streams[0].tiles.Codec()
+}
+
+// setCodec switches the tile encoders to codec c. The switch takes effect
+// with the next frame, which is a keyframe; the controller follows the
+// codec of each tile, so no renegotiation is needed.
+func (s *session) setCodec(c protocol.Codec) {
+	if c == s.codec() {
+		return
+	}
+	quality := s.quality
+	if s.rate != nil {
+		quality = s.rate.Settings().Quality
+	}
+	log.Printf("Image codec: %s (was %s)", c, s.codec())
+	for _, st := range s.streams {
+		enc, err := encoder.New(c, quality)
+		if err != nil {
+			log.Printf("switch codec: %v", err)
+			return
+		}
+		st.tiles.SetCodec(enc)
+	}
+	s.updateRefinement()
+}
+
+// updateRefinement sets the tile encoders' refinement passes for the
+// current codec: the first re-encodes in it at -refine-quality, the second
+// in -refine-codec.
+func (s *session) updateRefinement() {
+	if s.refineAfter == 0 {
+		return
+	}
+	var hq encoder.Encoder
+	if s.refineQuality > 0 {
+		if enc, err := encoder.New(s.codec(), s.refineQuality); err == nil {
+			hq = enc
+		}
+	}
+	for _, st := range s.streams {
+		st.tiles.SetRefinement(s.refineAfter, hq, s.refineLossless)
+	}
+}
+
+func (s *session) sendControl(msg protocol.ControlMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	s.t.SendControl(data)
+}
+
+// streamCursor sends the pointer's position and image on the cursor
+// channel whenever they change, until the session is closed. Frames don't
+// include the pointer, so it moves at this rate rather than the frame rate.
+// The position is sent on the first stream whose display the pointer is
+// over; cursors holds the source of each stream.
+func (s *session) streamCursor(cursors []capture.CursorSource) {
+	ticker := time.NewTicker(cursorInterval)
+	defer ticker.Stop()
+	var (
+		last   capture.Cursor
+		lastOn uint8
+		sent   bool
+		seq    uint32
+		shape  *capture.CursorShape
+		serial uint32
+	)
+	for n := 0; ; n++ {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if n%cursorShapeEvery == 0 {
+			if sh, err := cursors[0].CursorShape(); err == nil && !sameCursorShape(sh, shape) {
+				shape = sh
+				serial++
+				if err := s.sendCursorShape(serial, sh); err != nil {
+					log.Printf("send cursor shape: %v", err)
+				}
+			}
+		}
+
+		c, on, ok := locateCursor(cursors)
+		if !ok || sent && c == last && on == lastOn {
+			continue
+		}
+		last, lastOn, sent = c, on, true
+		seq++
+		msg := protocol.CursorMessage{
+			Kind:         protocol.CursorKindPosition,
+			Seq:          seq,
+			ScreenWidth:  uint16(c.Width),
+			ScreenHeight: uint16(c.Height),
+			Visible:      c.OnScreen,
+			Stream:       on,
+		}
+		if c.OnScreen {
+			msg.X, msg.Y = uint16(max(c.X, 0)), uint16(max(c.Y, 0))
+		}
+		s.t.SendCursor(protocol.AppendCursor(nil, msg))
+	}
+}
+
+// locateCursor returns the pointer as seen by the first stream whose
+// display it is over, or by the first stream if it is over none.
+func locateCursor(cursors []capture.CursorSource) (capture.Cursor, uint8, bool) {
+	first, ok := cursors[0].Cursor()
+	if first.OnScreen {
+		return first, 0, ok
+	}
+	for i, src := range cursors[1:] {
+		if c, ok := src.Cursor(); ok && c.OnScreen {
+			return c, uint8(i + 1), true
+		}
+	}
+	return first, 0, ok
+}
+
+// cursorSources returns the pointer source of each stream, if they all
+// have one.
+func (s *session) cursorSources() ([]capture.CursorSource, bool) {
+	cursors := make([]capture.CursorSource, len(s.streams))
+	for i, st := range s.streams {
+		c, ok := capture.As[capture.CursorSource](st.source)
+		if !ok {
+			return nil, false
+		}
+		cursors[i] = c
+	}
+	return cursors, true
+}
+
+// sendCursorShape sends the pointer image as PNG.
+func (s *session) sendCursorShape(serial uint32, sh *capture.CursorShape) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, sh.Image); err != nil {
+		return err
+	}
+	return s.t.SendCursor(protocol.AppendCursor(nil, protocol.CursorMessage{
+		Kind:     protocol.CursorKindShape,
+		Serial:   serial,
+		HotspotX: uint16(sh.Hotspot.X),
+		HotspotY: uint16(sh.Hotspot.Y),
+		Image:    buf.Bytes(),
+	}))
+}
+
+// sameCursorShape reports whether a and b are the same pointer image.
+func sameCursorShape(a, b *capture.CursorShape) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Hotspot == b.Hotspot && a.Image.Rect == b.Image.Rect && bytes.Equal(a.Image.Pix, b.Image.Pix)
+}
+
+// setFPS changes the frame rate of every stream's source.
+func (s *session) setFPS(fps int) {
+	for _, st := range s.streams {
+		st.setFPS(fps)
+	}
+}
+
+// adaptLoop reviews the network every rateInterval until the session is
+// closed.
+func (s *session) adaptLoop() {
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.adapt(now)
+		}
+	}
+}
+
+// adapt applies the rate controller's decision for the last interval. The
+// streams share the bitrate, so they all get the same settings.
+func (s *session) adapt(now time.Time) {
+	var net ratecontrol.Network
+	if r, ok := s.t.(transport.StatsReporter); ok {
+		st := r.NetworkStats()
+		net = ratecontrol.Network{RTT: st.RTT, Loss: st.Loss, Buffered: st.Buffered}
+	}
+	prev := s.rate.Settings()
+	settings, changed := s.rate.Update(now, net)
+	if !changed {
+		return
+	}
+	for _, st := range s.streams {
+		st.tiles.SetQuality(settings.Quality)
+		if settings.Quality > prev.Quality {
+			// Replace tiles that were sent at the lower quality.
+			st.tiles.RequestRefresh()
+		}
+	}
+	s.setFPS(settings.FPS)
+}
+
+// sendVideo encodes frame as VP8 and writes it to the video track. The
+// sample duration, which advances the RTP timestamp, is the time since the
+// previous frame.
+func (s *session) sendVideo(frame *capture.Frame) error {
+	data, _, err := s.vp8.Encode(frame.Image)
+	if err != nil {
+		return err
+	}
+	duration := s.interval
+	if !s.lastVideo.IsZero() {
+		duration = frame.Timestamp.Sub(s.lastVideo)
+	}
+	s.lastVideo = frame.Timestamp
+	if s.rate != nil {
+		s.rate.AddFrame(len(data))
+	}
+	s.video.WriteVideo(data, duration)
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"image"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/capture"
+	"github.com/junsooki/AirMac/internal/encoder"
+	"github.com/junsooki/AirMac/internal/input"
+	"github.com/junsooki/AirMac/internal/protocol"
+	"github.com/junsooki/AirMac/internal/scale"
+)
+
+// stream encodes the frames of one captured display and sends them with
+// its stream number. The first stream also drives the video track, which
+// carries a single picture.
+type stream struct {
+	s      *session
+	id     uint8
+	source capture.Source
+
+	// Each stream has its own encoders, so it starts with a keyframe.
+	tiles *encoder.TileEncoder
+	seq   uint32
+
+	// changes spots unchanged frames, which are skipped. lastChange is
+	// when the screen last changed; lastSent and lastHeader describe the
+	// last tiles frame or heartbeat sent.
+	changes    *encoder.ChangeDetector
+	lastChange time.Time
+	lastSent   time.Time
+	lastHeader protocol.FrameHeader
+
+	// scaler resizes frames before encoding. captureSize is the size of
+	// the last frame, to notice when the display changes.
+	scaler      *scale.Scaler
+	captureSize image.Point
+
+	// inputX and inputY map coordinates on a downscaled frame back to
+	// screen pixels, and display places those on the screen.
+	inputMu sync.Mutex
+	inputX  float64
+	inputY  float64
+	display capture.DisplayInfo
+
+	// windows is set when the source captures windows rather than a
+	// display. Pointer events outside their bounds, are dropped,
+	// except for the rest of a drag that started in them: held has a bit
+	// per button pressed inside.
+	windows capture.WindowSource
+	inside  []image.Rectangle
+	held    uint8
+	// blocked has a bit per button whose press was dropped because it was
+	// in a masked area, so its release is dropped too.
+	blocked uint8
+
+	// puller is set when the source supports pull mode; it is told when
+	// each frame has been sent or skipped.
+	puller capture.Puller
+}
+
+func newStream(s *session, id uint8, source capture.Source, enc encoder.Encoder, scaler *scale.Scaler, refresh time.Duration, workers int) *stream {
+	st := &stream{
+		s:       s,
+		id:      id,
+		source:  source,
+		tiles:   encoder.NewTileEncoder(enc, workers, refresh),
+		changes: encoder.NewChangeDetector(),
+		scaler:  scaler,
+		inputX:  1,
+		inputY:  1,
+		display: source.Display(),
+	}
+	if p, ok := capture.As[capture.Puller](source); ok {
+		st.puller = p
+	}
+	if ws, ok := capture.As[capture.WindowSource](source); ok {
+		st.windows = ws
+		st.inside = windowBounds(ws.Windows())
+	}
+	return st
+}
+
+// video reports whether the stream's frames go on the video track.
+func (st *stream) video() bool {
+	return st.id == 0 && st.s.vp8 != nil && st.s.video.VideoActive()
+}
+
+// run encodes and sends frames until the session is closed. Frames go on
+// the video track while it is active, otherwise (or after a fallback to
+// the relay) as tiles on the frames channel.
+func (st *stream) run(frames <-chan *capture.Frame) {
+	if st.id == 0 && st.s.vp8 != nil {
+		defer st.s.vp8.Close()
+	}
+	// The previous session may have stopped without passing on its last
+	// frame.
+	st.next()
+	for {
+		var frame *capture.Frame
+		select {
+		case <-st.s.done:
+			return
+		case f, ok := <-frames:
+			if !ok {
+				return
+			}
+			frame = f
+		}
+		if st.skip(frame) {
+			frame.Release()
+			st.next()
+			continue
+		}
+		scaled := st.downscale(frame)
+
+		var err error
+		if st.video() {
+			err = st.s.sendVideo(scaled)
+		} else {
+			err = st.sendTiles(scaled)
+		}
+		if err != nil {
+			log.Printf("encode frame: %v", err)
+		}
+		// The encoders keep nothing that points into the capture buffer.
+		frame.Release()
+		st.next()
+	}
+}
+
+// next lets the source capture the next frame in pull mode.
+func (st *stream) next() {
+	if st.puller != nil {
+		st.puller.Next()
+	}
+}
+
+// mapInput moves the coordinates of evt from the stream's frame onto the
+// screen, and reports whether it should be injected.
+func (st *stream) mapInput(evt *input.InputEvent) bool {
+	st.inputMu.Lock()
+	defer st.inputMu.Unlock()
+	evt.X, evt.Y = st.display.ToScreen(evt.X*st.inputX, evt.Y*st.inputY)
+	bit := uint8(1) << (evt.Button & 7)
+	if st.s.mask != nil {
+		switch {
+		case evt.Type == input.EventMouseDown && st.s.mask.Covers(evt.X, evt.Y):
+			st.blocked |= bit
+			return false
+		case evt.Type == input.EventMouseUp && st.blocked&bit != 0:
+			st.blocked &^= bit
+			return false
+		}
+	}
+	if st.windows == nil {
+		return true
+	}
+	in := slices.ContainsFunc(st.inside, func(r image.Rectangle) bool {
+		return evt.X >= float64(r.Min.X) && evt.X < float64(r.Max.X) &&
+			evt.Y >= float64(r.Min.Y) && evt.Y < float64(r.Max.Y)
+	})
+	switch evt.Type {
+	case input.EventMouseMove, input.EventMouseScroll:
+		return in || evt.Type == input.EventMouseMove && st.held != 0
+	case input.EventMouseDown:
+		if in {
+			st.held |= bit
+		}
+		return in
+	case input.EventMouseUp:
+		if st.held&bit == 0 {
+			return false
+		}
+		st.held &^= bit
+		return true
+	}
+	// Keys go to whichever window has focus.
+	return true
+}
+
+// windowBounds returns the screen areas of windows.
+func windowBounds(windows []capture.WindowInfo) []image.Rectangle {
+	out := make([]image.Rectangle, len(windows))
+	for i, w := range windows {
+		out[i] = w.Bounds
+	}
+	return out
+}
+
+// setDisplay updates the input mapping for the display the source now
+// captures.
+func (st *stream) setDisplay(info capture.DisplayInfo) {
+	st.inputMu.Lock()
+	st.display = info
+	st.inputMu.Unlock()
+}
+
+// displays returns the captured display's ID and the displays the source
+// can switch between, or nothing if it can't.
+func (st *stream) displays() (uint32, []protocol.DisplayInfo) {
+	sw, ok := capture.As[capture.DisplaySwitcher](st.source)
+	if !ok {
+		return 0, nil
+	}
+	list, err := sw.Displays()
+	if err != nil {
+		log.Printf("list displays: %v", err)
+		return 0, nil
+	}
+	out := make([]protocol.DisplayInfo, len(list))
+	for i, d := range list {
+		out[i] = protocol.DisplayInfo{ID: d.ID, Name: d.Name, Width: d.Width, Height: d.Height, Scale: d.Scale, Primary: d.Primary}
+	}
+	return st.source.Display().ID, out
+}
+
+// setFPS changes the source's frame rate, if it can be changed.
+func (st *stream) setFPS(fps int) {
+	if rs, ok := capture.As[capture.RateSetter](st.source); ok {
+		rs.SetFPS(fps)
+	}
+}
+
+// skip reports whether frame can be dropped before it is scaled and
+// encoded because the screen hasn't changed, and sends a heartbeat instead
+// if one is due.
+func (st *stream) skip(frame *capture.Frame) bool {
+	if st.changes.Changed(frame.Image) {
+		st.lastChange = frame.Timestamp
+		return false
+	}
+	if st.video() {
+		// The video track needs no heartbeat: RTP has its own sequence
+		// numbers, and the receiver asks for keyframes with PLIs.
+		return frame.Timestamp.Sub(st.lastChange) >= videoSettle && !st.s.vp8.KeyframePending()
+	}
+	if !st.tiles.SkipUnchanged() {
+		return false
+	}
+	st.sendHeartbeat(frame)
+	return true
+}
+
+// sendHeartbeat sends an idle frame if none was sent for heartbeatInterval.
+func (st *stream) sendHeartbeat(frame *capture.Frame) {
+	if st.lastSent.IsZero() || frame.Timestamp.Sub(st.lastSent) < heartbeatInterval {
+		return
+	}
+	st.seq++
+	hdr := st.lastHeader
+	hdr.Flags = protocol.FlagIdle
+	hdr.Seq = st.seq
+	hdr.Timestamp = frame.Timestamp
+	hdr.Capture = frame.CaptureDuration
+	hdr.Encode = time.Since(frame.Timestamp)
+	st.send(hdr, protocol.AppendTiles(nil, nil))
+}
+
+// downscale resizes frame for -scale, -max-width and rate control, and
+// updates the input mapping to match.
+func (st *stream) downscale(frame *capture.Frame) *capture.Frame {
+	rateScale := 1.0
+	if st.s.rate != nil {
+		rateScale = st.s.rate.Settings().Scale
+	}
+	img := st.scaler.Scale(frame.Image, rateScale)
+	sb, db := frame.Image.Bounds(), img.Bounds()
+	// A new capture size means the display's mode or arrangement may have
+	// changed too.
+	if sb.Size() != st.captureSize {
+		st.captureSize = sb.Size()
+		st.setDisplay(st.source.Display())
+	}
+	st.inputMu.Lock()
+	if st.windows != nil {
+		// Windows move without changing size, so follow them every frame.
+		st.display = st.source.Display()
+		st.inside = windowBounds(st.windows.Windows())
+	}
+	st.inputX = float64(sb.Dx()) / float64(db.Dx())
+	st.inputY = float64(sb.Dy()) / float64(db.Dy())
+	st.inputMu.Unlock()
+	if img == frame.Image {
+		return frame
+	}
+	// The scaled frame doesn't own a capture buffer, so it is not copied
+	// from frame, which is released on its own.
+	return &capture.Frame{
+		Image:           img,
+		Timestamp:       frame.Timestamp,
+		CaptureDuration: frame.CaptureDuration,
+	}
+}
+
+func (st *stream) sendTiles(frame *capture.Frame) error {
+	data, keyframe, err := st.tiles.Encode(frame.Image)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		st.sendHeartbeat(frame)
+		return nil
+	}
+	var flags protocol.FrameFlags
+	if keyframe {
+		flags |= protocol.FlagKeyframe
+	}
+	st.seq++
+	b := frame.Image.Bounds()
+	st.send(protocol.FrameHeader{
+		Version:   protocol.FrameVersion,
+		Codec:     protocol.CodecTiles,
+		Flags:     flags,
+		Stream:    st.id,
+		Seq:       st.seq,
+		Timestamp: frame.Timestamp,
+		Width:     uint16(b.Dx()),
+		Height:    uint16(b.Dy()),
+		Capture:   frame.CaptureDuration,
+		Encode:    time.Since(frame.Timestamp),
+	}, data)
+	return nil
+}
+
+// send sends a tiles frame or heartbeat.
+func (st *stream) send(hdr protocol.FrameHeader, payload []byte) {
+	msg := protocol.AppendFrame(nil, hdr, payload)
+	if st.s.rate != nil {
+		st.s.rate.AddFrame(len(msg))
+	}
+	st.s.t.SendFrame(msg)
+	st.lastSent, st.lastHeader = hdr.Timestamp, hdr
+}
@@ -5,8 +5,167 @@ import (
 	"time"
 )
 
+// Source produces frames, from a screen or a synthetic or recorded
+// picture. Frames are delivered at the source's frame rate until it is
+// stopped, when the channel is closed.
+type Source interface {
+	Start() error
+	Stop()
+	Frames() <-chan *Frame
+	// Display describes what is captured.
+	Display() DisplayInfo
+}
+
+// DisplayInfo describes the picture a Source captures, or a display that
+// can be captured.
+type DisplayInfo struct {
+	// ID identifies a display for DisplaySwitcher; zero for synthetic
+	// sources.
+	ID   uint32
+	Name string
+	// Width and Height are in pixels; zero if not known yet.
+	Width, Height int
+	// Bounds is where the display is in the coordinates input is injected
+	// in: points of the global display space on macOS, root window pixels
+	// on X11. Scale is pixels per unit of Bounds (0 = 1).
+	Bounds  image.Rectangle
+	Scale   float64
+	Primary bool
+}
+
+// ToScreen maps a point in pixels of the display to the coordinates input
+// is injected in.
+func (d DisplayInfo) ToScreen(x, y float64) (float64, float64) {
+	scale := d.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return float64(d.Bounds.Min.X) + x/scale, float64(d.Bounds.Min.Y) + y/scale
+}
+
+// RateSetter is implemented by sources whose frame rate can be changed
+// while running.
+type RateSetter interface {
+	SetFPS(fps int)
+}
+
+// Stats describes how a source's capture loop kept up over an interval.
+type Stats struct {
+	// FPS is the rate frames were delivered at.
+	FPS float64
+	// Delivered frames were passed on; Dropped ones were captured but
+	// discarded because earlier frames hadn't been taken yet. Skipped ticks
+	// produced no frame, e.g. while a window was off screen.
+	Delivered, Dropped, Skipped int
+	// Overrun counts captures that took longer than a frame interval.
+	Overrun int
+	// CaptureAvg and CaptureMax are how long capturing a frame took.
+	CaptureAvg, CaptureMax time.Duration
+}
+
+// StatsSource is implemented by sources that report capture Stats. Each
+// call covers the time since the previous one.
+type StatsSource interface {
+	CaptureStats() Stats
+}
+
+// Puller is implemented by sources that support pull mode, in which a
+// frame is only captured once the previous one has been passed on: the
+// consumer calls Next when it is done with each frame, and once when it
+// starts. Captures are still no more frequent than the frame rate.
+type Puller interface {
+	SetPull(pull bool)
+	Next()
+}
+
+// DisplaySwitcher is implemented by sources that can switch between
+// displays while running. Frames of the new display follow within a tick.
+type DisplaySwitcher interface {
+	Displays() ([]DisplayInfo, error)
+	SetDisplay(id uint32) error
+}
+
+// WindowInfo describes an on-screen window that can be captured.
+type WindowInfo struct {
+	ID uint32
+	// PID, App and, on macOS, Bundle identify the application that owns
+	// the window; PID is 0 if unknown.
+	PID    int
+	App    string
+	Bundle string
+	Title  string
+	// Bounds is where the window is, in the coordinates of
+	// DisplayInfo.Bounds.
+	Bounds image.Rectangle
+}
+
+// WindowSource is implemented by sources that capture windows rather than
+// a display. The captured area follows the windows as they move and
+// resize, so Display changes between frames; it is cheap to call.
+type WindowSource interface {
+	// Windows lists the windows in the last frame.
+	Windows() []WindowInfo
+}
+
+// CursorSource is implemented by sources that can report the pointer.
+type CursorSource interface {
+	Cursor() (Cursor, bool)
+	CursorShape() (*CursorShape, error)
+}
+
+// As finds the first source in src's chain of wrappers, such as Recorder,
+// that implements T, the way errors.As does for errors.
+func As[T any](src Source) (T, bool) {
+	for src != nil {
+		if t, ok := src.(T); ok {
+			return t, true
+		}
+		w, ok := src.(interface{ Unwrap() Source })
+		if !ok {
+			break
+		}
+		src = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
 // Frame represents a captured screen frame.
 type Frame struct {
-	Image     *image.RGBA
+	Image *image.RGBA
+	// Timestamp is when the capture completed.
 	Timestamp time.Time
+	// CaptureDuration is how long grabbing the screen took.
+	CaptureDuration time.Duration
+
+	pool *framePool
+}
+
+// Release returns the frame's pixel buffer to the capturer for reuse. The
+// frame, and anything sharing its pixels, must not be used afterwards.
+// Calling Release is optional (unreleased buffers are garbage collected)
+// and later calls are no-ops.
+func (f *Frame) Release() {
+	if f.pool != nil {
+		f.pool.put(f.Image.Pix)
+		f.pool = nil
+	}
+}
+
+// Cursor is the pointer's position on a captured display. Frames are
+// captured without the pointer, which is sent to the controller on its own.
+type Cursor struct {
+	// X and Y are in pixels of the display.
+	X, Y int
+	// Width and Height are the display's size in pixels.
+	Width, Height int
+	// OnScreen is false while the pointer is on another display.
+	OnScreen bool
+}
+
+// CursorShape is the pointer's image, at the display's pixel density.
+type CursorShape struct {
+	Image *image.RGBA
+	// Hotspot is the point of the image placed at the cursor position.
+	Hotspot image.Point
 }
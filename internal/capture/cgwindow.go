@@ -0,0 +1,245 @@
+//go:build darwin
+
+package capture
+
+/*
+#cgo LDFLAGS: -framework CoreGraphics -framework CoreFoundation
+#include <CoreGraphics/CoreGraphics.h>
+#include <dlfcn.h>
+#include <string.h>
+
+typedef struct {
+    uint32_t id;
+    int pid;
+    double x, y, width, height; // bounds, in points
+    char app[128];
+    char title[256];
+} windowDesc;
+
+// drawImage is defined in coregraphics.go.
+void drawImage(void* img, void* dst, int width, int height);
+
+static void copyString(CFStringRef s, char* dst, size_t n) {
+    dst[0] = 0;
+    if (s) {
+        CFStringGetCString(s, dst, n, kCFStringEncodingUTF8);
+    }
+}
+
+// listWindows describes up to max on-screen application windows, front to
+// back, into out and returns how many there are, or -1 on error. Windows
+// above the normal layer, such as the menu bar and the Dock, are left out.
+int listWindows(windowDesc* out, int max) {
+    CFArrayRef list = CGWindowListCopyWindowInfo(
+        kCGWindowListOptionOnScreenOnly | kCGWindowListExcludeDesktopElements, kCGNullWindowID);
+    if (!list) {
+        return -1;
+    }
+    int n = 0;
+    for (CFIndex i = 0; i < CFArrayGetCount(list) && n < max; i++) {
+        CFDictionaryRef w = CFArrayGetValueAtIndex(list, i);
+        int layer = 0;
+        CFNumberRef num = CFDictionaryGetValue(w, kCGWindowLayer);
+        if (num) {
+            CFNumberGetValue(num, kCFNumberIntType, &layer);
+        }
+        CGRect b;
+        CFDictionaryRef bounds = CFDictionaryGetValue(w, kCGWindowBounds);
+        if (layer != 0 || !bounds || !CGRectMakeWithDictionaryRepresentation(bounds, &b) ||
+            b.size.width < 1 || b.size.height < 1) {
+            continue;
+        }
+        windowDesc* d = &out[n++];
+        memset(d, 0, sizeof(*d));
+        if ((num = CFDictionaryGetValue(w, kCGWindowNumber))) {
+            CFNumberGetValue(num, kCFNumberSInt32Type, &d->id);
+        }
+        if ((num = CFDictionaryGetValue(w, kCGWindowOwnerPID))) {
+            CFNumberGetValue(num, kCFNumberIntType, &d->pid);
+        }
+        d->x = b.origin.x;
+        d->y = b.origin.y;
+        d->width = b.size.width;
+        d->height = b.size.height;
+        copyString(CFDictionaryGetValue(w, kCGWindowOwnerName), d->app, sizeof(d->app));
+        // Titles of other apps' windows need Screen Recording permission.
+        copyString(CFDictionaryGetValue(w, kCGWindowName), d->title, sizeof(d->title));
+    }
+    CFRelease(list);
+    return n;
+}
+
+// CGWindowListCreateImageFromArray is unavailable in the macOS 15 SDK
+// headers, like CGWindowListCreateImage.
+typedef CGImageRef (*CGWindowListCreateImageFromArrayFunc)(
+    CGRect screenBounds,
+    CFArrayRef windowArray,
+    uint32_t imageOption
+);
+
+// createWindowsImage captures the n windows in ids, front first, over the
+// area in points given, and reports the image size. Nothing but the
+// windows is drawn. The image is returned as an opaque pointer for
+// drawImage, which releases it.
+void* createWindowsImage(uint32_t* ids, int n, double x, double y, double w, double h, int* width, int* height) {
+    static CGWindowListCreateImageFromArrayFunc fn = NULL;
+    if (!fn) {
+        fn = (CGWindowListCreateImageFromArrayFunc)dlsym(RTLD_DEFAULT, "CGWindowListCreateImageFromArray");
+        if (!fn) {
+            return NULL;
+        }
+    }
+    const void* values[n];
+    for (int i = 0; i < n; i++) {
+        values[i] = (const void*)(uintptr_t)ids[i];
+    }
+    CFArrayRef windows = CFArrayCreate(NULL, values, n, NULL);
+    if (!windows) {
+        return NULL;
+    }
+    // kCGWindowImageDefault = 0
+    CGImageRef image = fn(CGRectMake(x, y, w, h), windows, 0);
+    CFRelease(windows);
+    if (!image) {
+        return NULL;
+    }
+    *width  = (int)CGImageGetWidth(image);
+    *height = (int)CGImageGetHeight(image);
+    if (*width == 0 || *height == 0) {
+        CGImageRelease(image);
+        return NULL;
+    }
+    return (void*)image;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"log"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// CGWindowCapturer captures a window, or every window of an application,
+// using CoreGraphics. Only the windows are drawn, not what overlaps them,
+// and the captured area follows them as they move and resize.
+type CGWindowCapturer struct {
+	*ticker
+	sel  windowSelector
+	pool *framePool
+	// lost is set while the windows are off screen, e.g. minimized.
+	lost bool
+
+	mu      sync.Mutex
+	info    DisplayInfo
+	windows []WindowInfo
+}
+
+// ListWindows lists the on-screen application windows, front to back.
+func ListWindows() ([]WindowInfo, error) {
+	var descs [256]C.windowDesc
+	n := int(C.listWindows(&descs[0], C.int(len(descs))))
+	if n < 0 {
+		return nil, errors.New("list windows: CGWindowListCopyWindowInfo failed")
+	}
+	list := make([]WindowInfo, n)
+	for i, d := range descs[:n] {
+		list[i] = WindowInfo{
+			ID:     uint32(d.id),
+			PID:    int(d.pid),
+			App:    C.GoString(&d.app[0]),
+			Bundle: bundleID(int(d.pid)),
+			Title:  C.GoString(&d.title[0]),
+			Bounds: image.Rect(int(d.x), int(d.y), int(d.x+d.width), int(d.y+d.height)),
+		}
+	}
+	return list, nil
+}
+
+// newWindowSource opens a capturer for "window:ID|TITLE" or "app:NAME|PID".
+func newWindowSource(kind, arg string, fps int) (Source, error) {
+	list, err := ListWindows()
+	if err != nil {
+		return nil, err
+	}
+	sel, err := selectWindows(kind, arg, list)
+	if err != nil {
+		return nil, err
+	}
+	c := &CGWindowCapturer{sel: sel, pool: newFramePool(4)}
+	c.windows = sel.match(list)
+	b := windowBounds(c.windows)
+	c.info = windowsInfo(c.windows, b, b.Dx(), b.Dy())
+	// Capture once so Display reports the size in pixels from the start.
+	if f := c.capture(); f != nil {
+		f.Release()
+	}
+	t, err := newTicker(fps, c.capture)
+	if err != nil {
+		return nil, err
+	}
+	c.ticker = t
+	return c, nil
+}
+
+func (c *CGWindowCapturer) Display() DisplayInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+func (c *CGWindowCapturer) Windows() []WindowInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]WindowInfo(nil), c.windows...)
+}
+
+// capture finds the windows where they are now and draws them into a
+// pooled buffer.
+func (c *CGWindowCapturer) capture() *Frame {
+	start := time.Now()
+	list, err := ListWindows()
+	windows := c.sel.match(list)
+	if err != nil || len(windows) == 0 {
+		if !c.lost {
+			log.Printf("window capture: %s is not on screen", c.Display().Name)
+		}
+		c.lost = true
+		return nil
+	}
+	c.lost = false
+
+	bounds := windowBounds(windows)
+	ids := make([]C.uint32_t, len(windows))
+	for i, w := range windows {
+		ids[i] = C.uint32_t(w.ID)
+	}
+	var w, h C.int
+	img := C.createWindowsImage(&ids[0], C.int(len(ids)), C.double(bounds.Min.X), C.double(bounds.Min.Y),
+		C.double(bounds.Dx()), C.double(bounds.Dy()), &w, &h)
+	if img == nil {
+		return nil
+	}
+	pix := c.pool.get(int(w) * int(h) * 4)
+	C.drawImage(img, unsafe.Pointer(&pix[0]), w, h)
+
+	c.mu.Lock()
+	c.windows = windows
+	c.info = windowsInfo(windows, bounds, int(w), int(h))
+	c.mu.Unlock()
+
+	now := time.Now()
+	return &Frame{
+		Image: &image.RGBA{
+			Pix:    pix,
+			Stride: int(w) * 4,
+			Rect:   image.Rect(0, 0, int(w), int(h)),
+		},
+		Timestamp:       now,
+		CaptureDuration: now.Sub(start),
+		pool:            c.pool,
+	}
+}
@@ -1,18 +1,11 @@
+//go:build darwin
+
 package capture
 
 /*
 #cgo LDFLAGS: -framework CoreGraphics -framework CoreFoundation
 #include <CoreGraphics/CoreGraphics.h>
 #include <dlfcn.h>
-#include <stdlib.h>
-
-typedef struct {
-    void*  data;
-    size_t size;
-    int    width;
-    int    height;
-    size_t bytesPerRow;
-} FrameData;
 
 // CGWindowListCreateImage is unavailable in the macOS 15 SDK headers but still
 // present in the CoreGraphics dylib. Load it dynamically.
@@ -31,53 +24,50 @@ static CGWindowListCreateImageFunc getCGWindowListCreateImage(void) {
     return fn;
 }
 
-FrameData captureDisplay(CGDirectDisplayID displayID) {
-    FrameData result = {0};
-
+// createDisplayImage captures the display and reports its size. The image
+// is returned as an opaque pointer for drawImage, which releases it.
+void* createDisplayImage(CGDirectDisplayID displayID, int* width, int* height) {
     CGWindowListCreateImageFunc fn = getCGWindowListCreateImage();
     if (!fn) {
-        return result;
+        return NULL;
     }
 
     CGRect bounds = CGDisplayBounds(displayID);
     // kCGWindowListOptionOnScreenOnly = 1, kCGNullWindowID = 0, kCGWindowImageDefault = 0
     CGImageRef image = fn(bounds, 1, 0, 0);
     if (!image) {
-        return result;
+        return NULL;
     }
-
-    result.width  = (int)CGImageGetWidth(image);
-    result.height = (int)CGImageGetHeight(image);
-
-    result.bytesPerRow = result.width * 4;
-    result.size        = result.bytesPerRow * result.height;
-    result.data        = malloc(result.size);
-    if (!result.data) {
+    *width  = (int)CGImageGetWidth(image);
+    *height = (int)CGImageGetHeight(image);
+    if (*width == 0 || *height == 0) {
         CGImageRelease(image);
-        result.size = 0;
-        return result;
+        return NULL;
     }
+    return (void*)image;
+}
 
+// drawImage renders an image from createDisplayImage as RGBA into dst,
+// which holds width*height*4 bytes, and releases the image. dst is not
+// referenced after it returns.
+void drawImage(void* img, void* dst, int width, int height) {
+    CGImageRef image = (CGImageRef)img;
     CGColorSpaceRef cs = CGColorSpaceCreateDeviceRGB();
     CGContextRef ctx = CGBitmapContextCreate(
-        result.data,
-        result.width,
-        result.height,
+        dst,
+        width,
+        height,
         8,
-        result.bytesPerRow,
+        width * 4,
         cs,
         kCGImageAlphaPremultipliedLast
     );
-    CGContextDrawImage(ctx, CGRectMake(0, 0, result.width, result.height), image);
-    CGContextRelease(ctx);
+    if (ctx) {
+        CGContextDrawImage(ctx, CGRectMake(0, 0, width, height), image);
+        CGContextRelease(ctx);
+    }
     CGColorSpaceRelease(cs);
     CGImageRelease(image);
-
-    return result;
-}
-
-void freeFrameData(void* data) {
-    free(data);
 }
 */
 import "C"
@@ -85,112 +75,112 @@ import "C"
 import (
 	"fmt"
 	"image"
-	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
-// CGCapturer captures the screen using CoreGraphics.
+// CGCapturer captures a display using CoreGraphics.
 type CGCapturer struct {
-	displayID C.CGDirectDisplayID
-	fps       int
-	frameCh   chan *Frame
-	stopCh    chan struct{}
-	stopOnce  sync.Once
-	running   bool
+	*ticker
+	// displayID is the captured CGDirectDisplayID. SetDisplay changes it
+	// while the capture and cursor loops read it.
+	displayID atomic.Uint32
+	pool      *framePool
 }
 
-// NewCGCapturer creates a screen capturer for the given display at the given FPS.
+// NewCGCapturer creates a screen capturer for the display at the given
+// index of ListDisplays, at the given FPS.
 func NewCGCapturer(displayIndex int, fps int) (*CGCapturer, error) {
-	if fps <= 0 || fps > 60 {
-		return nil, fmt.Errorf("fps must be 1-60, got %d", fps)
+	displays, err := ListDisplays()
+	if err != nil {
+		return nil, err
 	}
-
-	var displayID C.CGDirectDisplayID
-	if displayIndex == 0 {
-		displayID = C.CGMainDisplayID()
-	} else {
-		var displays [16]C.CGDirectDisplayID
-		var count C.uint32_t
-		C.CGGetActiveDisplayList(16, &displays[0], &count)
-		if displayIndex >= int(count) {
-			return nil, fmt.Errorf("display index %d out of range (have %d displays)", displayIndex, count)
-		}
-		displayID = displays[displayIndex]
+	if displayIndex < 0 || displayIndex >= len(displays) {
+		return nil, fmt.Errorf("display index %d out of range (have %d displays)", displayIndex, len(displays))
 	}
 
-	return &CGCapturer{
-		displayID: displayID,
-		fps:       fps,
-		frameCh:   make(chan *Frame, 2),
-		stopCh:    make(chan struct{}),
-	}, nil
+	c := &CGCapturer{
+		// Enough for the frames queued on the channel plus the ones being
+		// captured and encoded.
+		pool: newFramePool(4),
+	}
+	c.displayID.Store(displays[displayIndex].ID)
+	t, err := newTicker(fps, c.capture)
+	if err != nil {
+		return nil, err
+	}
+	c.ticker = t
+	return c, nil
 }
 
-func (c *CGCapturer) Start() error {
-	if c.running {
-		return fmt.Errorf("already running")
+// newScreenSource opens the platform's screen capturer.
+func newScreenSource(output string, displayIndex, fps int) (Source, error) {
+	if output != "" {
+		return nil, fmt.Errorf("displays are selected with -display on macOS, not by name")
 	}
-	c.running = true
-	go c.loop()
-	return nil
+	return NewCGCapturer(displayIndex, fps)
 }
 
-func (c *CGCapturer) Stop() {
-	c.stopOnce.Do(func() {
-		c.running = false
-		close(c.stopCh)
-	})
+// display returns the captured display.
+func (c *CGCapturer) display() C.CGDirectDisplayID {
+	return C.CGDirectDisplayID(c.displayID.Load())
 }
 
-func (c *CGCapturer) Frames() <-chan *Frame {
-	return c.frameCh
+// Display describes the captured display, at its current mode.
+func (c *CGCapturer) Display() DisplayInfo {
+	id := c.displayID.Load()
+	displays, _ := ListDisplays()
+	for _, d := range displays {
+		if d.ID == id {
+			return d
+		}
+	}
+	// Disconnected; captures fail until another display is selected.
+	return DisplayInfo{ID: id, Name: fmt.Sprintf("display %d", id)}
 }
 
-func (c *CGCapturer) loop() {
-	ticker := time.NewTicker(time.Second / time.Duration(c.fps))
-	defer ticker.Stop()
-	defer close(c.frameCh)
-
-	for {
-		select {
-		case <-c.stopCh:
-			return
-		case <-ticker.C:
-			f := c.capture()
-			if f == nil {
-				continue
-			}
-			select {
-			case c.frameCh <- f:
-			default:
-			}
+func (c *CGCapturer) Displays() ([]DisplayInfo, error) {
+	return ListDisplays()
+}
+
+// SetDisplay switches capture to the active display with the given ID.
+func (c *CGCapturer) SetDisplay(id uint32) error {
+	displays, err := ListDisplays()
+	if err != nil {
+		return err
+	}
+	for _, d := range displays {
+		if d.ID == id {
+			c.displayID.Store(id)
+			return nil
 		}
 	}
+	return fmt.Errorf("no active display %d", id)
 }
 
+// capture grabs the screen into a pooled buffer, which CoreGraphics
+// renders into directly.
 func (c *CGCapturer) capture() *Frame {
-	fd := C.captureDisplay(c.displayID)
-	if fd.data == nil {
+	start := time.Now()
+	var w, h C.int
+	img := C.createDisplayImage(c.display(), &w, &h)
+	if img == nil {
 		return nil
 	}
-	defer C.freeFrameData(fd.data)
-
-	w := int(fd.width)
-	h := int(fd.height)
-	byteLen := int(fd.size)
 
-	pix := make([]byte, byteLen)
-	copy(pix, unsafe.Slice((*byte)(fd.data), byteLen))
-
-	img := &image.RGBA{
-		Pix:    pix,
-		Stride: w * 4,
-		Rect:   image.Rect(0, 0, w, h),
-	}
+	pix := c.pool.get(int(w) * int(h) * 4)
+	C.drawImage(img, unsafe.Pointer(&pix[0]), w, h)
 
+	now := time.Now()
 	return &Frame{
-		Image:     img,
-		Timestamp: time.Now(),
+		Image: &image.RGBA{
+			Pix:    pix,
+			Stride: int(w) * 4,
+			Rect:   image.Rect(0, 0, int(w), int(h)),
+		},
+		Timestamp:       now,
+		CaptureDuration: now.Sub(start),
+		pool:            c.pool,
 	}
 }
@@ -0,0 +1,182 @@
+//go:build darwin
+
+package capture
+
+/*
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -framework AppKit -framework CoreGraphics
+#import <AppKit/AppKit.h>
+#include <stdlib.h>
+
+// cursorPosition reports the pointer position on the display and the
+// display's size, in pixels. It returns whether the pointer is on the
+// display, or -1 if the position is unavailable.
+int cursorPosition(CGDirectDisplayID displayID, int* x, int* y, int* width, int* height) {
+    CGEventRef event = CGEventCreate(NULL);
+    if (!event) {
+        return -1;
+    }
+    CGPoint p = CGEventGetLocation(event);
+    CFRelease(event);
+
+    CGDisplayModeRef mode = CGDisplayCopyDisplayMode(displayID);
+    if (!mode) {
+        return -1;
+    }
+    *width  = (int)CGDisplayModeGetPixelWidth(mode);
+    *height = (int)CGDisplayModeGetPixelHeight(mode);
+    CGDisplayModeRelease(mode);
+
+    // Event locations are in points of the global display space.
+    CGRect bounds = CGDisplayBounds(displayID);
+    if (bounds.size.width == 0) {
+        return -1;
+    }
+    double scale = *width / bounds.size.width;
+    *x = (int)((p.x - bounds.origin.x) * scale);
+    *y = (int)((p.y - bounds.origin.y) * scale);
+    return CGRectContainsPoint(bounds, p);
+}
+
+// cursorLocation reports the pointer position in points of the global
+// display space. It returns 0 if the position is unavailable.
+int cursorLocation(double* x, double* y) {
+    CGEventRef event = CGEventCreate(NULL);
+    if (!event) {
+        return 0;
+    }
+    CGPoint p = CGEventGetLocation(event);
+    CFRelease(event);
+    *x = p.x;
+    *y = p.y;
+    return 1;
+}
+
+// displayAt returns the display containing the point, in points, or the
+// main display if none does.
+CGDirectDisplayID displayAt(double x, double y) {
+    CGDirectDisplayID id;
+    uint32_t n = 0;
+    if (CGGetDisplaysWithPoint(CGPointMake(x, y), 1, &id, &n) != kCGErrorSuccess || n == 0) {
+        return CGMainDisplayID();
+    }
+    return id;
+}
+
+// cursorImage renders the current system cursor as RGBA into a malloc'd
+// buffer that the caller frees, at the display's pixel density, and
+// reports its size and hotspot in pixels.
+void* cursorImage(CGDirectDisplayID displayID, int* width, int* height, int* hotX, int* hotY) {
+    @autoreleasepool {
+        NSCursor* cursor = [NSCursor currentSystemCursor];
+        if (!cursor) {
+            return NULL;
+        }
+        CGDisplayModeRef mode = CGDisplayCopyDisplayMode(displayID);
+        if (!mode) {
+            return NULL;
+        }
+        double scale = (double)CGDisplayModeGetPixelWidth(mode) / CGDisplayModeGetWidth(mode);
+        CGDisplayModeRelease(mode);
+
+        NSImage* image = [cursor image];
+        NSPoint hot = [cursor hotSpot];
+        int w = (int)ceil(image.size.width * scale);
+        int h = (int)ceil(image.size.height * scale);
+        if (w <= 0 || h <= 0) {
+            return NULL;
+        }
+        NSRect rect = NSMakeRect(0, 0, w, h);
+        CGImageRef cg = [image CGImageForProposedRect:&rect context:nil hints:nil];
+        if (!cg) {
+            return NULL;
+        }
+
+        void* pix = calloc((size_t)w * h, 4);
+        if (!pix) {
+            return NULL;
+        }
+        CGColorSpaceRef cs = CGColorSpaceCreateDeviceRGB();
+        CGContextRef ctx = CGBitmapContextCreate(pix, w, h, 8, w * 4, cs, kCGImageAlphaPremultipliedLast);
+        CGColorSpaceRelease(cs);
+        if (!ctx) {
+            free(pix);
+            return NULL;
+        }
+        CGContextDrawImage(ctx, CGRectMake(0, 0, w, h), cg);
+        CGContextRelease(ctx);
+
+        *width = w;
+        *height = h;
+        *hotX = (int)(hot.x * scale);
+        *hotY = (int)(hot.y * scale);
+        return pix;
+    }
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// Cursor returns the pointer position on the captured display, or false if
+// it can't be read.
+func (c *CGCapturer) Cursor() (Cursor, bool) {
+	var x, y, w, h C.int
+	on := C.cursorPosition(c.display(), &x, &y, &w, &h)
+	if on < 0 {
+		return Cursor{}, false
+	}
+	return Cursor{X: int(x), Y: int(y), Width: int(w), Height: int(h), OnScreen: on == 1}, true
+}
+
+// CursorShape returns the current system cursor image. CGWindowListCreateImage
+// never includes the pointer in frames, so this is the only way it reaches
+// the controller.
+func (c *CGCapturer) CursorShape() (*CursorShape, error) {
+	return cursorShape(c.display())
+}
+
+// cursorShape returns the current system cursor image at the pixel
+// density of display.
+func cursorShape(display C.CGDirectDisplayID) (*CursorShape, error) {
+	var w, h, hx, hy C.int
+	pix := C.cursorImage(display, &w, &h, &hx, &hy)
+	if pix == nil {
+		return nil, errors.New("cursor image unavailable")
+	}
+	defer C.free(pix)
+
+	img := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	copy(img.Pix, unsafe.Slice((*byte)(pix), len(img.Pix)))
+	return &CursorShape{Image: img, Hotspot: image.Pt(int(hx), int(hy))}, nil
+}
+
+// Cursor returns the pointer position in the captured windows' area, or
+// false if it can't be read.
+func (c *CGWindowCapturer) Cursor() (Cursor, bool) {
+	var x, y C.double
+	info := c.Display()
+	if C.cursorLocation(&x, &y) == 0 || info.Width == 0 {
+		return Cursor{}, false
+	}
+	px := (float64(x) - float64(info.Bounds.Min.X)) * info.Scale
+	py := (float64(y) - float64(info.Bounds.Min.Y)) * info.Scale
+	return Cursor{
+		X:        int(px),
+		Y:        int(py),
+		Width:    info.Width,
+		Height:   info.Height,
+		OnScreen: px >= 0 && py >= 0 && px < float64(info.Width) && py < float64(info.Height),
+	}, true
+}
+
+// CursorShape returns the current system cursor image, at the pixel
+// density of the display the windows are on.
+func (c *CGWindowCapturer) CursorShape() (*CursorShape, error) {
+	b := c.Display().Bounds
+	return cursorShape(C.displayAt(C.double(b.Min.X+b.Dx()/2), C.double(b.Min.Y+b.Dy()/2)))
+}
@@ -0,0 +1,175 @@
+//go:build darwin
+
+package capture
+
+/*
+#cgo CFLAGS: -x objective-c
+#cgo LDFLAGS: -framework AppKit -framework CoreGraphics
+#import <AppKit/AppKit.h>
+#include <string.h>
+
+typedef struct {
+    uint32_t id;
+    double x, y, width, height; // bounds, in points
+    int pixelWidth, pixelHeight;
+    int main;
+    char name[128];
+} displayDesc;
+
+// listDisplays describes up to max active displays into out and returns
+// how many there are, or -1 on error.
+int listDisplays(displayDesc* out, int max) {
+    CGDirectDisplayID ids[16];
+    uint32_t n = 0;
+    if (CGGetActiveDisplayList(16, ids, &n) != kCGErrorSuccess) {
+        return -1;
+    }
+    if ((int)n > max) {
+        n = max;
+    }
+    @autoreleasepool {
+        NSArray<NSScreen*>* screens = [NSScreen screens];
+        for (uint32_t i = 0; i < n; i++) {
+            displayDesc* d = &out[i];
+            memset(d, 0, sizeof(*d));
+            d->id = ids[i];
+            CGRect b = CGDisplayBounds(ids[i]);
+            d->x = b.origin.x;
+            d->y = b.origin.y;
+            d->width = b.size.width;
+            d->height = b.size.height;
+            CGDisplayModeRef mode = CGDisplayCopyDisplayMode(ids[i]);
+            if (mode) {
+                d->pixelWidth = (int)CGDisplayModeGetPixelWidth(mode);
+                d->pixelHeight = (int)CGDisplayModeGetPixelHeight(mode);
+                CGDisplayModeRelease(mode);
+            }
+            d->main = CGDisplayIsMain(ids[i]) ? 1 : 0;
+            for (NSScreen* s in screens) {
+                NSNumber* num = s.deviceDescription[@"NSScreenNumber"];
+                if (num.unsignedIntValue == ids[i]) {
+                    if (@available(macOS 10.15, *)) {
+                        strlcpy(d->name, s.localizedName.UTF8String, sizeof(d->name));
+                    }
+                    break;
+                }
+            }
+        }
+    }
+    return (int)n;
+}
+// bundleID copies the bundle identifier of the application with process
+// ID pid into out, or an empty string if it has none.
+void bundleID(int pid, char* out, int n) {
+    out[0] = 0;
+    @autoreleasepool {
+        NSRunningApplication* app = [NSRunningApplication runningApplicationWithProcessIdentifier:pid];
+        NSString* bundle = app.bundleIdentifier;
+        if (bundle) {
+            strlcpy(out, bundle.UTF8String, n);
+        }
+    }
+}
+
+// screenLocked returns 1 if the login session's screen is locked, 0 if
+// not, or -1 if there is no session to ask.
+int screenLocked(void) {
+    CFDictionaryRef session = CGSessionCopyCurrentDictionary();
+    if (!session) {
+        return -1;
+    }
+    CFBooleanRef locked = CFDictionaryGetValue(session, CFSTR("CGSSessionScreenIsLocked"));
+    int result = locked && CFBooleanGetValue(locked);
+    CFRelease(session);
+    return result;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+	"sync"
+)
+
+// ListDisplays lists the active displays, the main display first. Indexes
+// into the list are what -display selects.
+func ListDisplays() ([]DisplayInfo, error) {
+	var descs [16]C.displayDesc
+	n := int(C.listDisplays(&descs[0], C.int(len(descs))))
+	if n < 0 {
+		return nil, errors.New("list displays: CGGetActiveDisplayList failed")
+	}
+	list := make([]DisplayInfo, 0, n)
+	for _, d := range descs[:n] {
+		info := DisplayInfo{
+			ID:      uint32(d.id),
+			Name:    C.GoString(&d.name[0]),
+			Width:   int(d.pixelWidth),
+			Height:  int(d.pixelHeight),
+			Bounds:  image.Rect(int(d.x), int(d.y), int(d.x+d.width), int(d.y+d.height)),
+			Primary: d.main != 0,
+		}
+		if info.Name == "" {
+			info.Name = fmt.Sprintf("display %d", info.ID)
+		}
+		if d.width > 0 {
+			info.Scale = float64(d.pixelWidth) / float64(d.width)
+		}
+		list = append(list, info)
+	}
+	// CGGetActiveDisplayList usually lists the main display first, but
+	// doesn't promise to.
+	slices.SortStableFunc(list, func(a, b DisplayInfo) int {
+		switch {
+		case a.Primary == b.Primary:
+			return 0
+		case a.Primary:
+			return -1
+		}
+		return 1
+	})
+	return list, nil
+}
+
+// AllDisplays returns the indexes into ListDisplays that -display all
+// captures: every display.
+func AllDisplays() ([]int, error) {
+	list, err := ListDisplays()
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int, len(list))
+	for i := range list {
+		indexes[i] = i
+	}
+	return indexes, nil
+}
+
+// bundleIDs caches the bundle ID of each process ID looked up.
+var bundleIDs sync.Map
+
+// bundleID returns the bundle ID of the application with process ID pid.
+func bundleID(pid int) string {
+	if id, ok := bundleIDs.Load(pid); ok {
+		return id.(string)
+	}
+	var buf [256]C.char
+	C.bundleID(C.int(pid), &buf[0], C.int(len(buf)))
+	id := C.GoString(&buf[0])
+	bundleIDs.Store(pid, id)
+	return id
+}
+
+// ScreenLocked reports whether the screen is locked.
+func ScreenLocked() (bool, error) {
+	switch C.screenLocked() {
+	case -1:
+		return false, errors.New("no login session")
+	case 0:
+		return false, nil
+	}
+	return true, nil
+}
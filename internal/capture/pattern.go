@@ -0,0 +1,116 @@
+package capture
+
+import (
+	"fmt"
+	"image"
+	"time"
+)
+
+// patternBars are the colors of the test pattern's bars, at 75% like SMPTE
+// bars: white, yellow, cyan, green, magenta, red, blue.
+var patternBars = [][4]byte{
+	{191, 191, 191, 255},
+	{191, 191, 0, 255},
+	{0, 191, 191, 255},
+	{0, 191, 0, 255},
+	{191, 0, 191, 255},
+	{191, 0, 0, 255},
+	{0, 0, 191, 255},
+}
+
+// patternPeriod is how long the pattern's square takes to cross the frame
+// and back.
+const patternPeriod = 4 * time.Second
+
+// PatternSource renders an animated test pattern: color bars over a gray
+// ramp that stay still, a white square that bounces across them, and the
+// frame number in binary as a row of blocks. It exercises both static and
+// moving content without a screen to capture.
+type PatternSource struct {
+	*ticker
+	bg    *image.RGBA
+	start time.Time
+	n     uint32
+	pool  *framePool
+}
+
+// NewPatternSource creates a w by h test pattern source.
+func NewPatternSource(w, h, fps int) (*PatternSource, error) {
+	if w < 64 || h < 64 {
+		return nil, fmt.Errorf("pattern must be at least 64x64, got %dx%d", w, h)
+	}
+	p := &PatternSource{bg: patternBackground(w, h), pool: newFramePool(4)}
+	t, err := newTicker(fps, p.render)
+	if err != nil {
+		return nil, err
+	}
+	p.ticker = t
+	return p, nil
+}
+
+func (p *PatternSource) Display() DisplayInfo {
+	b := p.bg.Bounds()
+	return DisplayInfo{Name: "test pattern", Width: b.Dx(), Height: b.Dy()}
+}
+
+// render draws the next frame into a pooled buffer.
+func (p *PatternSource) render() *Frame {
+	now := time.Now()
+	if p.start.IsZero() {
+		p.start = now
+	}
+	b := p.bg.Bounds()
+	w, h := b.Dx(), b.Dy()
+	img := &image.RGBA{Pix: p.pool.get(len(p.bg.Pix)), Stride: p.bg.Stride, Rect: b}
+	copy(img.Pix, p.bg.Pix)
+
+	// The square moves along a triangle wave, so it bounces.
+	size := h / 8
+	phase := float64(now.Sub(p.start)%patternPeriod) / float64(patternPeriod)
+	if phase > 0.5 {
+		phase = 1 - phase
+	}
+	x := int(2 * phase * float64(w-size))
+	fillRect(img, image.Rect(x, h/3-size/2, x+size, h/3+size/2), [4]byte{255, 255, 255, 255})
+
+	// Frame counter, most significant bit first.
+	p.n++
+	block := max(h/48, 4)
+	for i := range 16 {
+		c := [4]byte{16, 16, 16, 255}
+		if p.n>>(15-i)&1 != 0 {
+			c = [4]byte{255, 255, 255, 255}
+		}
+		x := block + i*block*3/2
+		fillRect(img, image.Rect(x, h-2*block, x+block, h-block), c)
+	}
+
+	return &Frame{Image: img, Timestamp: now, CaptureDuration: time.Since(now), pool: p.pool}
+}
+
+// patternBackground draws the still part of the test pattern: bars over
+// the top two thirds and a gray ramp below.
+func patternBackground(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	barsH := h * 2 / 3
+	for i, c := range patternBars {
+		x0, x1 := i*w/len(patternBars), (i+1)*w/len(patternBars)
+		fillRect(img, image.Rect(x0, 0, x1, barsH), c)
+	}
+	for x := range w {
+		v := byte(x * 255 / max(w-1, 1))
+		fillRect(img, image.Rect(x, barsH, x+1, h), [4]byte{v, v, v, 255})
+	}
+	return img
+}
+
+// fillRect fills r, clipped to img, with c.
+func fillRect(img *image.RGBA, r image.Rectangle, c [4]byte) {
+	r = r.Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			copy(row[i:i+4], c[:])
+		}
+	}
+}
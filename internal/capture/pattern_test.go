@@ -0,0 +1,35 @@
+package capture
+
+import (
+	"testing"
+
+	"github.com/junsooki/AirMac/internal/encoder"
+)
+
+// BenchmarkCaptureEncode captures test pattern frames and encodes them the
+// way the host does, with a tile encoder sending only what changed.
+func BenchmarkCaptureEncode(b *testing.B) {
+	for _, size := range []struct {
+		name string
+		w, h int
+	}{
+		{"1080p", 1920, 1080},
+		{"4K", 3840, 2160},
+	} {
+		b.Run(size.name, func(b *testing.B) {
+			p, err := NewPatternSource(size.w, size.h, 60)
+			if err != nil {
+				b.Fatal(err)
+			}
+			enc := encoder.NewTileEncoder(encoder.NewJPEGEncoder(80), 0, 0)
+			b.ReportAllocs()
+			for b.Loop() {
+				f := p.render()
+				if _, _, err := enc.Encode(f.Image); err != nil {
+					b.Fatal(err)
+				}
+				f.Release()
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package capture
+
+// framePool recycles frame pixel buffers, so a capturer running at 60 fps
+// doesn't allocate a screen-sized buffer per frame. It holds at most a few
+// buffers; extra ones are left to the garbage collector.
+type framePool struct {
+	free chan []byte
+}
+
+func newFramePool(size int) *framePool {
+	return &framePool{free: make(chan []byte, size)}
+}
+
+// get returns a buffer of n bytes, reused if one large enough is free.
+// Its contents are undefined.
+func (p *framePool) get(n int) []byte {
+	select {
+	case b := <-p.free:
+		if cap(b) >= n {
+			return b[:n]
+		}
+	default:
+	}
+	return make([]byte, n)
+}
+
+// put makes b available to get.
+func (p *framePool) put(b []byte) {
+	select {
+	case p.free <- b:
+	default:
+	}
+}
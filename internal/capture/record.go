@@ -0,0 +1,186 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/encoder"
+)
+
+// recordMagic starts a recording, followed by recordVersion.
+//
+// A recording is a sequence of frames, each, big-endian:
+//
+//	0-7    nanoseconds since the first frame
+//	8-11   image length
+//	12     QOI image
+//
+// Only frames that differ from the one before are recorded; a frame is
+// shown until the next one is due.
+const (
+	recordMagic      = "AIRMACREC"
+	recordVersion    = 1
+	recordHeaderSize = 12
+)
+
+// recordQueue is how many frames may wait to be encoded and written before
+// the recorder skips frames.
+const recordQueue = 2
+
+// Recorder passes on the frames of a source while writing the ones that
+// changed to a file for ReplaySource.
+type Recorder struct {
+	src     Source
+	path    string
+	file    *os.File
+	changes *encoder.ChangeDetector
+	queue   chan *Frame
+	frameCh chan *Frame
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Record wraps src in a Recorder writing to path. Use As to reach the
+// capabilities of src through it.
+func Record(src Source, path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append([]byte(recordMagic), recordVersion)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &Recorder{
+		src:     src,
+		path:    path,
+		file:    f,
+		changes: encoder.NewChangeDetector(),
+		queue:   make(chan *Frame, recordQueue),
+		frameCh: make(chan *Frame, 2),
+		done:    make(chan struct{}),
+	}
+	return r, nil
+}
+
+func (r *Recorder) Start() error {
+	if err := r.src.Start(); err != nil {
+		return err
+	}
+	r.wg.Add(2)
+	go r.forward()
+	go r.write()
+	return nil
+}
+
+// Stop stops the source and waits for the recording to be written.
+func (r *Recorder) Stop() {
+	r.src.Stop()
+	r.wg.Wait()
+}
+
+func (r *Recorder) Frames() <-chan *Frame {
+	return r.frameCh
+}
+
+func (r *Recorder) Display() DisplayInfo {
+	return r.src.Display()
+}
+
+// Unwrap returns the recorded source.
+func (r *Recorder) Unwrap() Source {
+	return r.src
+}
+
+// forward passes frames on, queueing a copy of each changed one to be
+// written. If the writer falls behind, the next frame is queued whether it
+// changed or not, so the recording doesn't end on a stale picture.
+func (r *Recorder) forward() {
+	defer r.wg.Done()
+	defer close(r.frameCh)
+	defer close(r.queue)
+
+	missed := false
+	for f := range r.src.Frames() {
+		if r.changes.Changed(f.Image) || missed {
+			b := f.Image.Bounds()
+			img := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+			for y := range b.Dy() {
+				copy(img.Pix[y*img.Stride:(y+1)*img.Stride], f.Image.Pix[f.Image.PixOffset(b.Min.X, b.Min.Y+y):])
+			}
+			select {
+			case r.queue <- &Frame{Image: img, Timestamp: f.Timestamp}:
+				missed = false
+			default:
+				missed = true
+			}
+		}
+		select {
+		case r.frameCh <- f:
+		default:
+			f.Release()
+		}
+	}
+}
+
+// write encodes and writes queued frames until the queue is closed.
+func (r *Recorder) write() {
+	defer r.wg.Done()
+	defer func() {
+		if err := r.file.Close(); err != nil {
+			log.Printf("record %s: %v", r.path, err)
+		}
+	}()
+
+	enc := encoder.NewQOIEncoder()
+	var first time.Time
+	var prev []byte
+	var n int
+	failed := false
+	for f := range r.queue {
+		if failed {
+			continue
+		}
+		if first.IsZero() {
+			first = f.Timestamp
+		}
+		data, err := enc.Encode(f.Image)
+		if err == nil && bytes.Equal(data, prev) {
+			// The change detector reports a change for a few frames.
+			continue
+		}
+		if err == nil {
+			hdr := make([]byte, 0, recordHeaderSize+len(data))
+			hdr = binary.BigEndian.AppendUint64(hdr, uint64(f.Timestamp.Sub(first)))
+			hdr = binary.BigEndian.AppendUint32(hdr, uint32(len(data)))
+			_, err = r.file.Write(append(hdr, data...))
+		}
+		if err != nil {
+			// Keep draining the queue so the stream isn't held up.
+			log.Printf("record %s: %v; recording stopped", r.path, err)
+			failed = true
+			continue
+		}
+		prev = data
+		n++
+	}
+	log.Printf("Recorded %d frames to %s", n, r.path)
+}
+
+// checkRecording reads the header of a recording.
+func checkRecording(f *os.File) error {
+	hdr := make([]byte, len(recordMagic)+1)
+	if _, err := f.ReadAt(hdr, 0); err != nil || string(hdr[:len(recordMagic)]) != recordMagic {
+		return fmt.Errorf("%s is not a recording", f.Name())
+	}
+	if v := hdr[len(recordMagic)]; v != recordVersion {
+		return fmt.Errorf("%s: unsupported recording version %d", f.Name(), v)
+	}
+	return nil
+}
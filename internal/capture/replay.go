@@ -0,0 +1,166 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/decoder"
+)
+
+// replayPause is how long the last frame of a recording is shown before it
+// starts over.
+const replayPause = time.Second
+
+// replayRecord is a recorded frame that hasn't been shown yet.
+type replayRecord struct {
+	at   time.Duration
+	data []byte
+}
+
+// ReplaySource plays back a recording made by Recorder, at the pace it was
+// recorded, in a loop. Each tick emits the frame due at that time, so the
+// recording's frame rate and the source's are independent.
+type ReplaySource struct {
+	*ticker
+	file  *os.File
+	r     *bufio.Reader
+	dec   *decoder.QOIDecoder
+	info  DisplayInfo
+	cur   *image.RGBA
+	next  *replayRecord
+	start time.Time
+	// end is when the last frame has been held long enough to start over.
+	end  time.Duration
+	pool *framePool
+}
+
+// NewReplaySource opens the recording at path.
+func NewReplaySource(path string, fps int) (*ReplaySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &ReplaySource{file: f, dec: decoder.NewQOIDecoder(), pool: newFramePool(4)}
+	if err := s.rewind(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s.next == nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: recording is empty", path)
+	}
+	// Decode the first frame now, for its size and to catch a bad file
+	// before streaming.
+	if s.cur, err = s.dec.Decode(s.next.data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s.info = DisplayInfo{Name: "replay " + filepath.Base(path), Width: s.cur.Rect.Dx(), Height: s.cur.Rect.Dy()}
+
+	t, err := newTicker(fps, s.render)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.ticker = t
+	return s, nil
+}
+
+func (s *ReplaySource) Display() DisplayInfo {
+	return s.info
+}
+
+// render decodes the frames due by now, and copies the latest into a pooled
+// buffer.
+func (s *ReplaySource) render() *Frame {
+	now := time.Now()
+	if s.start.IsZero() {
+		s.start = now
+	}
+	at := now.Sub(s.start)
+	for s.next != nil && s.next.at <= at {
+		if err := s.show(s.next.data); err != nil {
+			log.Printf("replay %s: %v", s.file.Name(), err)
+		}
+		var err error
+		if s.next, err = s.read(); err != nil {
+			log.Printf("replay %s: %v", s.file.Name(), err)
+		}
+		if s.next == nil {
+			// Hold the last frame a little, then start over.
+			s.end = at + replayPause
+		}
+	}
+	if s.next == nil && at >= s.end {
+		if err := s.rewind(); err != nil {
+			log.Printf("replay %s: %v", s.file.Name(), err)
+		}
+		s.start = now
+	}
+
+	img := &image.RGBA{Pix: s.pool.get(len(s.cur.Pix)), Stride: s.cur.Stride, Rect: s.cur.Rect}
+	copy(img.Pix, s.cur.Pix)
+	return &Frame{Image: img, Timestamp: now, CaptureDuration: time.Since(now), pool: s.pool}
+}
+
+// show decodes a recorded frame as the current one.
+func (s *ReplaySource) show(data []byte) error {
+	if len(data) >= 12 {
+		w := int(binary.BigEndian.Uint32(data[4:]))
+		h := int(binary.BigEndian.Uint32(data[8:]))
+		if w == s.cur.Rect.Dx() && h == s.cur.Rect.Dy() {
+			return s.dec.DecodeInto(s.cur, data)
+		}
+	}
+	img, err := s.dec.Decode(data)
+	if err != nil {
+		return err
+	}
+	s.cur = img
+	return nil
+}
+
+// rewind goes back to the first frame of the recording.
+func (s *ReplaySource) rewind() error {
+	if err := checkRecording(s.file); err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(int64(len(recordMagic)+1), io.SeekStart); err != nil {
+		return err
+	}
+	if s.r == nil {
+		s.r = bufio.NewReaderSize(s.file, 1<<20)
+	} else {
+		s.r.Reset(s.file)
+	}
+	var err error
+	s.next, err = s.read()
+	return err
+}
+
+// read reads the next recorded frame, or returns nil at the end.
+func (s *ReplaySource) read() (*replayRecord, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(s.r, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("truncated recording: %w", err)
+	}
+	rec := &replayRecord{
+		at:   time.Duration(binary.BigEndian.Uint64(hdr[:])),
+		data: make([]byte, binary.BigEndian.Uint32(hdr[8:])),
+	}
+	if _, err := io.ReadFull(s.r, rec.data); err != nil {
+		return nil, fmt.Errorf("truncated recording: %w", err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,39 @@
+//go:build !darwin && !linux
+
+package capture
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// newScreenSource reports that this platform has no screen capturer.
+func newScreenSource(output string, displayIndex, fps int) (Source, error) {
+	return nil, fmt.Errorf("screen capture is not supported on %s; use -source pattern, script or replay", runtime.GOOS)
+}
+
+// ListDisplays reports that this platform has no displays to capture.
+func ListDisplays() ([]DisplayInfo, error) {
+	return nil, fmt.Errorf("screen capture is not supported on %s", runtime.GOOS)
+}
+
+// AllDisplays reports that this platform has no displays to capture.
+func AllDisplays() ([]int, error) {
+	return nil, fmt.Errorf("screen capture is not supported on %s", runtime.GOOS)
+}
+
+// ListWindows reports that this platform has no windows to capture.
+func ListWindows() ([]WindowInfo, error) {
+	return nil, fmt.Errorf("window capture is not supported on %s", runtime.GOOS)
+}
+
+// newWindowSource reports that this platform has no window capturer.
+func newWindowSource(kind, arg string, fps int) (Source, error) {
+	return nil, fmt.Errorf("window capture is not supported on %s; use -source pattern, script or replay", runtime.GOOS)
+}
+
+// ScreenLocked reports that this platform can't tell whether the screen
+// is locked.
+func ScreenLocked() (bool, error) {
+	return false, fmt.Errorf("lock state is not supported on %s", runtime.GOOS)
+}
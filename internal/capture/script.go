@@ -0,0 +1,177 @@
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// scriptHold is how long a script image is shown when the script gives no
+// duration.
+const scriptHold = time.Second
+
+// scriptStep is one image of a script and how long it is shown.
+type scriptStep struct {
+	img  *image.RGBA
+	hold time.Duration
+}
+
+// ScriptSource shows a sequence of PNG images in a loop, each for a set
+// time, for reproducing a session's content without its screen.
+//
+// The path is either a directory, whose PNGs are shown in name order for a
+// second each, or a script file listing one image per line with an
+// optional duration:
+//
+//	# comments and blank lines are ignored
+//	login.png 2s
+//	desktop.png
+//
+// Image paths are relative to the script. All images must be the same size.
+type ScriptSource struct {
+	*ticker
+	name  string
+	steps []scriptStep
+	start time.Time
+	pool  *framePool
+}
+
+// NewScriptSource loads the images of the script or directory at path.
+func NewScriptSource(path string, fps int) (*ScriptSource, error) {
+	files, holds, err := readScript(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("script %s: no images", path)
+	}
+
+	s := &ScriptSource{name: filepath.Base(path), pool: newFramePool(4)}
+	for i, file := range files {
+		img, err := loadPNG(file)
+		if err != nil {
+			return nil, fmt.Errorf("script %s: %w", path, err)
+		}
+		if i > 0 && img.Rect != s.steps[0].img.Rect {
+			return nil, fmt.Errorf("script %s: %s is %dx%d, want %dx%d", path, file,
+				img.Rect.Dx(), img.Rect.Dy(), s.steps[0].img.Rect.Dx(), s.steps[0].img.Rect.Dy())
+		}
+		s.steps = append(s.steps, scriptStep{img: img, hold: holds[i]})
+	}
+
+	t, err := newTicker(fps, s.render)
+	if err != nil {
+		return nil, err
+	}
+	s.ticker = t
+	return s, nil
+}
+
+func (s *ScriptSource) Display() DisplayInfo {
+	r := s.steps[0].img.Rect
+	return DisplayInfo{Name: "script " + s.name, Width: r.Dx(), Height: r.Dy()}
+}
+
+// render copies the image due now into a pooled buffer.
+func (s *ScriptSource) render() *Frame {
+	now := time.Now()
+	if s.start.IsZero() {
+		s.start = now
+	}
+	var total time.Duration
+	for _, st := range s.steps {
+		total += st.hold
+	}
+	at := now.Sub(s.start) % total
+	cur := s.steps[len(s.steps)-1].img
+	for _, st := range s.steps {
+		if at < st.hold {
+			cur = st.img
+			break
+		}
+		at -= st.hold
+	}
+
+	img := &image.RGBA{Pix: s.pool.get(len(cur.Pix)), Stride: cur.Stride, Rect: cur.Rect}
+	copy(img.Pix, cur.Pix)
+	return &Frame{Image: img, Timestamp: now, CaptureDuration: time.Since(now), pool: s.pool}
+}
+
+// readScript lists the images of the script or directory at path and how
+// long each is shown.
+func readScript(path string) (files []string, holds []time.Duration, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".png") {
+				files = append(files, filepath.Join(path, e.Name()))
+				holds = append(holds, scriptHold)
+			}
+		}
+		slices.Sort(files)
+		return files, holds, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	dir := filepath.Dir(path)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		hold := scriptHold
+		switch len(fields) {
+		case 1:
+		case 2:
+			hold, err = time.ParseDuration(fields[1])
+			if err != nil || hold <= 0 {
+				return nil, nil, fmt.Errorf("%s:%d: invalid duration %q", path, n, fields[1])
+			}
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: want an image and an optional duration", path, n)
+		}
+		file := fields[0]
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		files = append(files, file)
+		holds = append(holds, hold)
+	}
+	return files, holds, sc.Err()
+}
+
+// loadPNG decodes the PNG at path as RGBA at the origin.
+func loadPNG(path string) (*image.RGBA, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Rect, src, src.Bounds().Min, draw.Src)
+	return img, nil
+}
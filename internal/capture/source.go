@@ -0,0 +1,54 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Open opens the source described by spec, delivering frames at fps:
+//
+//	screen[:OUTPUT] the display with the given index, or the named X11
+//	                RandR output
+//	window:ID|TITLE a single window, by ID or part of its title
+//	app:NAME|PID    every window of an application
+//	pattern[:WxH]   an animated test pattern, 1280x720 by default
+//	script:PATH     PNG images listed in a script file, or a directory
+//	replay:PATH     frames recorded with Recorder
+func Open(spec string, displayIndex, fps int) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "screen":
+		return newScreenSource(arg, displayIndex, fps)
+	case "window", "app":
+		if arg == "" {
+			return nil, fmt.Errorf("%s source needs a window (window:ID|TITLE or app:NAME|PID)", kind)
+		}
+		return newWindowSource(kind, arg, fps)
+	case "pattern":
+		w, h := 1280, 720
+		if arg != "" {
+			if _, err := fmt.Sscanf(arg, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+				return nil, fmt.Errorf("invalid pattern size %q: want WxH", arg)
+			}
+		}
+		return NewPatternSource(w, h, fps)
+	case "script":
+		if arg == "" {
+			return nil, fmt.Errorf("script source needs a path (script:PATH)")
+		}
+		return NewScriptSource(arg, fps)
+	case "replay":
+		if arg == "" {
+			return nil, fmt.Errorf("replay source needs a path (replay:PATH)")
+		}
+		return NewReplaySource(arg, fps)
+	}
+	return nil, fmt.Errorf("unknown source %q: want screen, window, app, pattern, script or replay", kind)
+}
+
+// Live reports whether spec captures the real screen, as opposed to a
+// synthetic or recorded source that input can't reach.
+func Live(spec string) bool {
+	kind, _, _ := strings.Cut(spec, ":")
+	return kind == "screen" || kind == "window" || kind == "app"
+}
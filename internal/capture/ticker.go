@@ -0,0 +1,242 @@
+package capture
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ticker runs a source's capture loop at an adjustable frame rate. Sources
+// embed it and supply grab, which returns the next frame, or nil to skip
+// the tick.
+//
+// Captures are paced against deadlines a frame interval apart, so the time
+// grab takes counts towards the interval rather than adding to it. A
+// capture that overruns its deadline is followed by the next one straight
+// away, without trying to catch up on the ticks it missed.
+type ticker struct {
+	fps      int
+	grab     func() *Frame
+	frameCh  chan *Frame
+	fpsCh    chan int
+	pullCh   chan bool
+	nextCh   chan struct{}
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	running  bool
+	// pull is the mode last set, so Next can ignore calls outside pull
+	// mode.
+	pull atomic.Bool
+
+	mu    sync.Mutex
+	stats tickerStats
+}
+
+// tickerStats accumulates Stats between calls to CaptureStats.
+type tickerStats struct {
+	since                               time.Time
+	captured, dropped, skipped, overrun int
+	captureTotal, captureMax            time.Duration
+}
+
+func newTicker(fps int, grab func() *Frame) (*ticker, error) {
+	if fps <= 0 || fps > 60 {
+		return nil, fmt.Errorf("fps must be 1-60, got %d", fps)
+	}
+	return &ticker{
+		fps:     fps,
+		grab:    grab,
+		frameCh: make(chan *Frame, 2),
+		fpsCh:   make(chan int, 1),
+		pullCh:  make(chan bool, 1),
+		nextCh:  make(chan struct{}, 1),
+		stopCh:  make(chan struct{}),
+		stats:   tickerStats{since: time.Now()},
+	}, nil
+}
+
+func (t *ticker) Start() error {
+	if t.running {
+		return fmt.Errorf("already running")
+	}
+	t.running = true
+	go t.loop()
+	return nil
+}
+
+func (t *ticker) Stop() {
+	t.stopOnce.Do(func() {
+		t.running = false
+		close(t.stopCh)
+	})
+}
+
+func (t *ticker) Frames() <-chan *Frame {
+	return t.frameCh
+}
+
+// SetFPS changes the capture rate (clamped to 1-60) while running.
+func (t *ticker) SetFPS(fps int) {
+	replace(t.fpsCh, min(max(fps, 1), 60))
+}
+
+// SetPull turns pull mode on or off while running.
+func (t *ticker) SetPull(pull bool) {
+	t.pull.Store(pull)
+	replace(t.pullCh, pull)
+}
+
+// Next lets the next capture start in pull mode. It does nothing in the
+// other mode.
+func (t *ticker) Next() {
+	if !t.pull.Load() {
+		return
+	}
+	select {
+	case t.nextCh <- struct{}{}:
+	default:
+	}
+}
+
+// replace sends v on ch, which has room for one value, replacing a pending
+// value that the loop hasn't picked up yet.
+func replace[T any](ch chan T, v T) {
+	for {
+		select {
+		case ch <- v:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// CaptureStats reports how the capture loop kept up since the previous
+// call.
+func (t *ticker) CaptureStats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	ts := t.stats
+	t.stats = tickerStats{since: now}
+
+	st := Stats{
+		Delivered:  ts.captured - ts.dropped,
+		Dropped:    ts.dropped,
+		Skipped:    ts.skipped,
+		Overrun:    ts.overrun,
+		CaptureMax: ts.captureMax,
+	}
+	if ts.captured > 0 {
+		st.CaptureAvg = ts.captureTotal / time.Duration(ts.captured)
+	}
+	if d := now.Sub(ts.since); d > 0 {
+		st.FPS = float64(st.Delivered) / d.Seconds()
+	}
+	return st
+}
+
+func (t *ticker) loop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	defer close(t.frameCh)
+
+	deadline := time.Now()
+	// pull is set in pull mode, and waiting while the last frame delivered
+	// hasn't been passed on yet.
+	pull, waiting := t.pull.Load(), false
+	// A change of mode starts afresh: calls to Next before it don't count,
+	// and the first capture after it needs none.
+	setPull := func(p bool) {
+		if p == pull {
+			return
+		}
+		pull, waiting = p, false
+		select {
+		case <-t.nextCh:
+		default:
+		}
+	}
+	for {
+		select {
+		case <-t.stopCh:
+			return
+		case fps := <-t.fpsCh:
+			if fps != t.fps {
+				// Keep the time since the last capture, at the new rate.
+				deadline = deadline.Add(time.Second/time.Duration(fps) - time.Second/time.Duration(t.fps))
+				t.fps = fps
+				timer.Reset(time.Until(deadline))
+			}
+			continue
+		case p := <-t.pullCh:
+			setPull(p)
+			continue
+		case <-t.nextCh:
+			waiting = false
+			continue
+		case <-timer.C:
+		}
+		// A tick that comes while waiting is taken up by the next call to
+		// Next.
+		for pull && waiting {
+			select {
+			case <-t.stopCh:
+				return
+			case p := <-t.pullCh:
+				setPull(p)
+			case <-t.nextCh:
+				waiting = false
+			case fps := <-t.fpsCh:
+				t.fps = fps
+			}
+		}
+
+		start := time.Now()
+		f := t.grab()
+		took := time.Since(start)
+		interval := time.Second / time.Duration(t.fps)
+
+		delivered := false
+		if f != nil {
+			select {
+			case t.frameCh <- f:
+				delivered = true
+			default:
+				f.Release()
+			}
+		}
+		waiting = delivered
+
+		t.mu.Lock()
+		switch {
+		case f == nil:
+			t.stats.skipped++
+		case !delivered:
+			t.stats.dropped++
+		}
+		if f != nil {
+			t.stats.captured++
+			t.stats.captureTotal += took
+			t.stats.captureMax = max(t.stats.captureMax, took)
+		}
+		if took > interval {
+			t.stats.overrun++
+		}
+		t.mu.Unlock()
+
+		// After a wait in pull mode, pace from this capture.
+		if start.Sub(deadline) > interval {
+			deadline = start
+		}
+		deadline = deadline.Add(interval)
+		if now := time.Now(); deadline.Before(now) {
+			deadline = now
+		}
+		timer.Reset(time.Until(deadline))
+	}
+}
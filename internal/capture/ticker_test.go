@@ -0,0 +1,65 @@
+package capture
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+// newTestTicker returns a 60 fps ticker whose frames are counted.
+func newTestTicker(t *testing.T) *ticker {
+	t.Helper()
+	tk, err := newTicker(60, func() *Frame {
+		return &Frame{Image: image.NewRGBA(image.Rect(0, 0, 1, 1)), Timestamp: time.Now()}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tk
+}
+
+// frames returns how many frames tk delivers within d.
+func frames(tk *ticker, d time.Duration) int {
+	n := 0
+	timeout := time.After(d)
+	for {
+		select {
+		case <-tk.Frames():
+			n++
+		case <-timeout:
+			return n
+		}
+	}
+}
+
+func TestTickerPull(t *testing.T) {
+	tk := newTestTicker(t)
+	tk.SetPull(true)
+	if err := tk.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer tk.Stop()
+
+	if n := frames(tk, 200*time.Millisecond); n != 1 {
+		t.Fatalf("pull mode delivered %d frames without Next, want 1", n)
+	}
+	tk.Next()
+	if n := frames(tk, 200*time.Millisecond); n != 1 {
+		t.Fatalf("pull mode delivered %d frames after one Next, want 1", n)
+	}
+
+	// Next outside pull mode isn't kept for later.
+	tk.SetPull(false)
+	if n := frames(tk, 200*time.Millisecond); n < 5 {
+		t.Fatalf("push mode delivered only %d frames", n)
+	}
+	tk.Next()
+	tk.Next()
+	tk.SetPull(true)
+	// Frames captured before the switch may still be queued, then the
+	// first capture in pull mode needs no Next, and the one after it does.
+	frames(tk, 200*time.Millisecond)
+	if n := frames(tk, 200*time.Millisecond); n != 0 {
+		t.Fatalf("pull mode delivered %d frames after a Next outside it", n)
+	}
+}
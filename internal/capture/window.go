@@ -0,0 +1,79 @@
+package capture
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// windowSelector picks the windows a window source captures: one window,
+// by ID, or every window of an application.
+type windowSelector struct {
+	id  uint32
+	app string
+	pid int
+}
+
+// selectWindows resolves "window:ID", "window:TITLE", "app:NAME" or
+// "app:PID" against list, which is in front-to-back order. A title picks
+// the frontmost window whose title contains it, ignoring case; like an ID,
+// it selects that window however its title changes later. An application
+// is matched by name, ignoring case, and its windows are looked up on
+// every frame, so new ones are captured too.
+func selectWindows(kind, arg string, list []WindowInfo) (windowSelector, error) {
+	if kind == "app" {
+		sel := windowSelector{app: arg}
+		if pid, err := strconv.Atoi(arg); err == nil {
+			sel = windowSelector{pid: pid}
+		}
+		if len(sel.match(list)) == 0 {
+			return windowSelector{}, fmt.Errorf("no windows of app %q (see -list-windows)", arg)
+		}
+		return sel, nil
+	}
+	id, err := strconv.ParseUint(arg, 10, 32)
+	for _, w := range list {
+		if err == nil && w.ID == uint32(id) || err != nil && strings.Contains(strings.ToLower(w.Title), strings.ToLower(arg)) {
+			return windowSelector{id: w.ID}, nil
+		}
+	}
+	return windowSelector{}, fmt.Errorf("no window matching %q (see -list-windows)", arg)
+}
+
+// match returns the windows sel picks from list, keeping their order.
+func (sel windowSelector) match(list []WindowInfo) []WindowInfo {
+	var out []WindowInfo
+	for _, w := range list {
+		switch {
+		case sel.id != 0 && w.ID == sel.id,
+			sel.pid != 0 && w.PID == sel.pid,
+			sel.app != "" && strings.EqualFold(w.App, sel.app):
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// windowBounds returns the area windows cover.
+func windowBounds(windows []WindowInfo) image.Rectangle {
+	var r image.Rectangle
+	for _, w := range windows {
+		r = r.Union(w.Bounds)
+	}
+	return r
+}
+
+// windowsInfo describes a capture of windows: the area bounds, captured as
+// width by height pixels.
+func windowsInfo(windows []WindowInfo, bounds image.Rectangle, width, height int) DisplayInfo {
+	name := windows[0].App
+	if len(windows) == 1 && windows[0].Title != "" {
+		name += ": " + windows[0].Title
+	}
+	info := DisplayInfo{ID: windows[0].ID, Name: name, Width: width, Height: height, Bounds: bounds}
+	if bounds.Dx() > 0 {
+		info.Scale = float64(width) / float64(bounds.Dx())
+	}
+	return info
+}
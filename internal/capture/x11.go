@@ -0,0 +1,437 @@
+//go:build linux
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/randr"
+	"github.com/jezek/xgb/screensaver"
+	"github.com/jezek/xgb/shm"
+	"github.com/jezek/xgb/xproto"
+	"golang.org/x/sys/unix"
+)
+
+// X11Capturer captures an X11 screen, or one RandR output of it. Frames are
+// read with MIT-SHM GetImage into a shared memory segment, or with plain
+// GetImage if the server can't share memory with the host, such as over a
+// forwarded connection.
+type X11Capturer struct {
+	*ticker
+	conn     *xgb.Conn
+	root     xproto.Window
+	display  string
+	hasRandR bool
+
+	// cur is the captured display: the whole screen, whose ID is the root
+	// window's, or an output. Its bounds are the captured area.
+	mu  sync.Mutex
+	cur DisplayInfo
+
+	seg    *x11Segment
+	noShm  bool
+	failed bool
+	pool   *framePool
+	// atoms caches interned atoms by name.
+	atoms map[string]xproto.Atom
+}
+
+// x11Segment is a shared memory segment attached by both the host and the
+// X server.
+type x11Segment struct {
+	seg  shm.Seg
+	data []byte
+}
+
+// NewX11Capturer captures the X display named display ("" = $DISPLAY). With
+// an output name, that RandR output is captured; otherwise index selects
+// from the list Displays returns, where 0 is the whole screen.
+func NewX11Capturer(display, output string, index, fps int) (*X11Capturer, error) {
+	c, err := openX11(display)
+	if err != nil {
+		return nil, err
+	}
+	if c.hasRandR {
+		// Follow resolution and layout changes.
+		randr.SelectInput(c.conn, c.root, randr.NotifyMaskScreenChange)
+	}
+	displays, err := c.Displays()
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	var names []string
+	for i, d := range displays {
+		if output == "" && i == index || output != "" && d.Name == output {
+			c.cur = d
+		}
+		if i > 0 {
+			names = append(names, d.Name)
+		}
+	}
+	if c.cur.ID == 0 {
+		c.conn.Close()
+		if output == "" {
+			return nil, fmt.Errorf("display index %d out of range (have %d displays)", index, len(displays))
+		}
+		return nil, fmt.Errorf("no active X output %q (have: %s)", output, strings.Join(names, ", "))
+	}
+
+	c.initShm()
+	t, err := newTicker(fps, c.capture)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	c.ticker = t
+	return c, nil
+}
+
+// openX11 connects to an X display whose pixel format capture supports.
+func openX11(display string) (*X11Capturer, error) {
+	conn, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		return nil, fmt.Errorf("connect to X display: %w", err)
+	}
+	if display == "" {
+		display = os.Getenv("DISPLAY")
+	}
+	setup := xproto.Setup(conn)
+	screen := setup.DefaultScreen(conn)
+	if err := checkX11Format(setup, screen); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &X11Capturer{
+		conn:     conn,
+		root:     screen.Root,
+		display:  display,
+		hasRandR: randr.Init(conn) == nil,
+		pool:     newFramePool(4),
+		atoms:    map[string]xproto.Atom{},
+	}, nil
+}
+
+// initShm sets up MIT-SHM, or falls back to GetImage without it.
+func (c *X11Capturer) initShm() {
+	if err := shm.Init(c.conn); err != nil {
+		log.Printf("X11: no MIT-SHM (%v); capturing with GetImage", err)
+		c.noShm = true
+	}
+}
+
+// query is a connection to the X display in $DISPLAY kept open for
+// ListWindows and ScreenLocked, which privacy masks call several times a
+// second.
+var query struct {
+	sync.Mutex
+	c *X11Capturer
+}
+
+// withQuery calls fn with the query connection, opening it if needed. The
+// connection is dropped, to be opened again next time, if fn fails.
+func withQuery(fn func(c *X11Capturer) error) error {
+	query.Lock()
+	defer query.Unlock()
+	if query.c == nil {
+		c, err := openX11("")
+		if err != nil {
+			return err
+		}
+		query.c = c
+	}
+	if err := fn(query.c); err != nil {
+		query.c.conn.Close()
+		query.c = nil
+		return err
+	}
+	return nil
+}
+
+// ScreenLocked reports whether the screen saver of the X display in
+// $DISPLAY is on. X11 has no standard lock state, but screen lockers such
+// as xscreensaver and light-locker run as the screen saver.
+func ScreenLocked() (bool, error) {
+	var locked bool
+	err := withQuery(func(c *X11Capturer) error {
+		if err := screensaver.Init(c.conn); err != nil {
+			return fmt.Errorf("no MIT-SCREEN-SAVER extension: %w", err)
+		}
+		info, err := screensaver.QueryInfo(c.conn, xproto.Drawable(c.root)).Reply()
+		if err != nil {
+			return err
+		}
+		locked = info.State == screensaver.StateOn
+		return nil
+	})
+	return locked, err
+}
+
+// newScreenSource opens the X11 display in $DISPLAY.
+func newScreenSource(output string, displayIndex, fps int) (Source, error) {
+	return NewX11Capturer("", output, displayIndex, fps)
+}
+
+// ListDisplays lists what can be captured on the X display in $DISPLAY:
+// the whole screen, then each active RandR output. Indexes into the list
+// are what -display selects.
+func ListDisplays() ([]DisplayInfo, error) {
+	c, err := openX11("")
+	if err != nil {
+		return nil, err
+	}
+	defer c.conn.Close()
+	return c.Displays()
+}
+
+// AllDisplays returns the indexes into ListDisplays that -display all
+// captures: each output, or the whole screen if RandR reports none.
+func AllDisplays() ([]int, error) {
+	list, err := ListDisplays()
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 1 {
+		return []int{0}, nil
+	}
+	indexes := make([]int, 0, len(list)-1)
+	for i := 1; i < len(list); i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+func (c *X11Capturer) Display() DisplayInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cur
+}
+
+// Displays lists the whole screen, then each active RandR output.
+func (c *X11Capturer) Displays() ([]DisplayInfo, error) {
+	g, err := xproto.GetGeometry(c.conn, xproto.Drawable(c.root)).Reply()
+	if err != nil {
+		return nil, err
+	}
+	displays := []DisplayInfo{{
+		ID:     uint32(c.root),
+		Name:   "screen " + c.display,
+		Width:  int(g.Width),
+		Height: int(g.Height),
+		Bounds: image.Rect(0, 0, int(g.Width), int(g.Height)),
+		Scale:  1,
+	}}
+	if !c.hasRandR {
+		return displays, nil
+	}
+
+	res, err := randr.GetScreenResourcesCurrent(c.conn, c.root).Reply()
+	if err != nil {
+		return nil, err
+	}
+	var primary randr.Output
+	if p, err := randr.GetOutputPrimary(c.conn, c.root).Reply(); err == nil {
+		primary = p.Output
+	}
+	for _, o := range res.Outputs {
+		info, err := randr.GetOutputInfo(c.conn, o, res.ConfigTimestamp).Reply()
+		if err != nil || info.Connection != randr.ConnectionConnected || info.Crtc == 0 {
+			continue
+		}
+		crtc, err := randr.GetCrtcInfo(c.conn, info.Crtc, res.ConfigTimestamp).Reply()
+		if err != nil || crtc.Width == 0 {
+			continue
+		}
+		displays = append(displays, DisplayInfo{
+			ID:      uint32(o),
+			Name:    string(info.Name),
+			Width:   int(crtc.Width),
+			Height:  int(crtc.Height),
+			Bounds:  image.Rect(int(crtc.X), int(crtc.Y), int(crtc.X)+int(crtc.Width), int(crtc.Y)+int(crtc.Height)),
+			Scale:   1,
+			Primary: o == primary,
+		})
+	}
+	return displays, nil
+}
+
+// SetDisplay switches capture to the whole screen or the output with the
+// given ID.
+func (c *X11Capturer) SetDisplay(id uint32) error {
+	displays, err := c.Displays()
+	if err != nil {
+		return err
+	}
+	for _, d := range displays {
+		if d.ID == id {
+			c.mu.Lock()
+			c.cur = d
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("no X screen or output %d", id)
+}
+
+// checkX11Format checks that the screen stores pixels the way capture
+// converts them: 32 bits, little-endian, 8 bits per channel.
+func checkX11Format(setup *xproto.SetupInfo, screen *xproto.ScreenInfo) error {
+	bpp := 0
+	for _, f := range setup.PixmapFormats {
+		if f.Depth == screen.RootDepth {
+			bpp = int(f.BitsPerPixel)
+		}
+	}
+	var visual *xproto.VisualInfo
+	for _, d := range screen.AllowedDepths {
+		for i, v := range d.Visuals {
+			if v.VisualId == screen.RootVisual {
+				visual = &d.Visuals[i]
+			}
+		}
+	}
+	if bpp != 32 || setup.ImageByteOrder != xproto.ImageOrderLSBFirst || visual == nil ||
+		visual.RedMask != 0xff0000 || visual.GreenMask != 0xff00 || visual.BlueMask != 0xff {
+		return fmt.Errorf("unsupported X11 pixel format: depth %d, %d bits per pixel", screen.RootDepth, bpp)
+	}
+	return nil
+}
+
+// locate updates the captured area after the screen layout changed.
+func (c *X11Capturer) locate() error {
+	c.mu.Lock()
+	id := c.cur.ID
+	c.mu.Unlock()
+	return c.SetDisplay(id)
+}
+
+// capture grabs the captured area into a pooled buffer.
+func (c *X11Capturer) capture() *Frame {
+	start := time.Now()
+	c.handleEvents()
+
+	c.mu.Lock()
+	r := c.cur.Bounds
+	c.mu.Unlock()
+	w, h := r.Dx(), r.Dy()
+
+	src, err := c.grab(r)
+	if err != nil {
+		if !c.failed {
+			log.Printf("X11 capture: %v", err)
+		}
+		// The screen may have shrunk under the captured area.
+		if err := c.locate(); err != nil && !c.failed {
+			log.Printf("X11 capture: %v", err)
+		}
+		c.failed = true
+		return nil
+	}
+	c.failed = false
+
+	img := &image.RGBA{Pix: c.pool.get(w * h * 4), Stride: w * 4, Rect: image.Rect(0, 0, w, h)}
+	bgrxToRGBA(img.Pix, src)
+	return &Frame{
+		Image:           img,
+		Timestamp:       time.Now(),
+		CaptureDuration: time.Since(start),
+		pool:            c.pool,
+	}
+}
+
+// grab reads the pixels of r, as 32-bit little-endian BGRX rows without
+// padding.
+func (c *X11Capturer) grab(r image.Rectangle) ([]byte, error) {
+	size := r.Dx() * r.Dy() * 4
+	if !c.noShm {
+		if c.seg == nil || len(c.seg.data) < size {
+			if err := c.attach(size); err != nil {
+				log.Printf("X11: shared memory unavailable (%v); capturing with GetImage", err)
+				c.noShm = true
+			}
+		}
+		if c.seg != nil {
+			_, err := shm.GetImage(c.conn, xproto.Drawable(c.root), int16(r.Min.X), int16(r.Min.Y),
+				uint16(r.Dx()), uint16(r.Dy()), 0xffffffff, xproto.ImageFormatZPixmap, c.seg.seg, 0).Reply()
+			if err != nil {
+				return nil, err
+			}
+			return c.seg.data[:size], nil
+		}
+	}
+	reply, err := xproto.GetImage(c.conn, xproto.ImageFormatZPixmap, xproto.Drawable(c.root), int16(r.Min.X), int16(r.Min.Y),
+		uint16(r.Dx()), uint16(r.Dy()), 0xffffffff).Reply()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Data) < size {
+		return nil, fmt.Errorf("GetImage returned %d bytes, want %d", len(reply.Data), size)
+	}
+	return reply.Data[:size], nil
+}
+
+// attach replaces the shared memory segment with one of size bytes.
+func (c *X11Capturer) attach(size int) error {
+	if c.seg != nil {
+		shm.Detach(c.conn, c.seg.seg)
+		unix.SysvShmDetach(c.seg.data)
+		c.seg = nil
+	}
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, size, unix.IPC_CREAT|0o600)
+	if err != nil {
+		return err
+	}
+	// Once both sides are attached, removing the segment frees it as soon
+	// as both detach, even if the host crashes.
+	defer unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	data, err := unix.SysvShmAttach(id, 0, 0)
+	if err != nil {
+		return err
+	}
+	seg, err := shm.NewSegId(c.conn)
+	if err == nil {
+		err = shm.AttachChecked(c.conn, seg, uint32(id), false).Check()
+	}
+	if err != nil {
+		unix.SysvShmDetach(data)
+		return err
+	}
+	c.seg = &x11Segment{seg: seg, data: data}
+	return nil
+}
+
+// handleEvents re-locates the captured area after the screen layout
+// changed.
+func (c *X11Capturer) handleEvents() {
+	changed := false
+	for {
+		ev, err := c.conn.PollForEvent()
+		if ev == nil && err == nil {
+			break
+		}
+		if _, ok := ev.(randr.ScreenChangeNotifyEvent); ok {
+			changed = true
+		}
+	}
+	if changed {
+		if err := c.locate(); err != nil {
+			log.Printf("X11 capture: %v", err)
+		}
+	}
+}
+
+// bgrxToRGBA converts 32-bit little-endian BGRX pixels to opaque RGBA.
+func bgrxToRGBA(dst, src []byte) {
+	for i := 0; i+4 <= len(dst); i += 4 {
+		v := binary.LittleEndian.Uint32(src[i:])
+		binary.LittleEndian.PutUint32(dst[i:], v>>16&0xff|v&0xff00|(v&0xff)<<16|0xff000000)
+	}
+}
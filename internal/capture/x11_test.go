@@ -0,0 +1,172 @@
+//go:build linux
+
+package capture
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jezek/xgb"
+	"github.com/jezek/xgb/xproto"
+)
+
+// startXvfb starts a virtual X server for the test and returns its
+// display name, skipping the test if Xvfb isn't installed.
+func startXvfb(t *testing.T, w, h int) string {
+	t.Helper()
+	path, err := exec.LookPath("Xvfb")
+	if err != nil {
+		t.Skip("Xvfb not installed")
+	}
+	// Xvfb picks a free display and writes its number to -displayfd once
+	// it accepts connections.
+	r, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cmd := exec.Command(path, "-displayfd", "3", "-nolisten", "tcp", "-screen", "0", fmt.Sprintf("%dx%dx24", w, h))
+	cmd.ExtraFiles = []*os.File{wr}
+	if err := cmd.Start(); err != nil {
+		wr.Close()
+		t.Skipf("start Xvfb: %v", err)
+	}
+	wr.Close()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	num := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		num <- strings.TrimSpace(line)
+	}()
+	select {
+	case n := <-num:
+		if n == "" {
+			t.Skip("Xvfb didn't start")
+		}
+		return ":" + n
+	case <-time.After(10 * time.Second):
+		t.Skip("Xvfb didn't start in time")
+	}
+	return ""
+}
+
+// quadrants are the colors drawn on the top left, top right, bottom left
+// and bottom right of the screen.
+var quadrants = [4]color.RGBA{
+	{0xff, 0, 0, 0xff},
+	{0, 0xff, 0, 0xff},
+	{0, 0, 0xff, 0xff},
+	{0x12, 0x34, 0x56, 0xff},
+}
+
+// drawQuadrants paints the root window of display in quadrants.
+func drawQuadrants(t *testing.T, display string, w, h int) {
+	t.Helper()
+	conn, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	root := xproto.Drawable(xproto.Setup(conn).DefaultScreen(conn).Root)
+	gc, err := xproto.NewGcontextId(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xproto.CreateGCChecked(conn, gc, root, 0, nil).Check(); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range quadrants {
+		x, y := i%2*w/2, i/2*h/2
+		pixel := uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+		xproto.ChangeGC(conn, gc, xproto.GcForeground, []uint32{pixel})
+		xproto.PolyFillRectangle(conn, root, gc, []xproto.Rectangle{{X: int16(x), Y: int16(y), Width: uint16(w / 2), Height: uint16(h / 2)}})
+	}
+	// A round trip makes sure the server has drawn everything.
+	if _, err := xproto.GetInputFocus(conn).Reply(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextFrame returns the next frame of src of the given size, skipping
+// frames captured before a switch.
+func nextFrame(t *testing.T, src Source, size image.Point) *image.RGBA {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case f, ok := <-src.Frames():
+			if !ok {
+				t.Fatal("source stopped")
+			}
+			if f.Image.Rect.Size() == size {
+				return f.Image
+			}
+			f.Release()
+		case <-deadline:
+			t.Fatalf("no %v frame", size)
+		}
+	}
+}
+
+// checkQuadrants checks that img shows the area r of a screen painted by
+// drawQuadrants.
+func checkQuadrants(t *testing.T, img *image.RGBA, r image.Rectangle, w, h int) {
+	t.Helper()
+	for y := r.Min.Y; y < r.Max.Y; y += 7 {
+		for x := r.Min.X; x < r.Max.X; x += 7 {
+			want := quadrants[x*2/w+y*2/h*2]
+			if got := img.RGBAAt(x-r.Min.X, y-r.Min.Y); got != want {
+				t.Fatalf("pixel %d,%d of the screen is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestX11Capture(t *testing.T) {
+	const w, h = 320, 240
+	display := startXvfb(t, w, h)
+	drawQuadrants(t, display, w, h)
+
+	c, err := NewX11Capturer(display, "", 0, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	if d := c.Display(); d.Width != w || d.Height != h {
+		t.Fatalf("display is %dx%d, want %dx%d", d.Width, d.Height, w, h)
+	}
+	checkQuadrants(t, nextFrame(t, c, image.Pt(w, h)), image.Rect(0, 0, w, h), w, h)
+
+	// Switch to each RandR output and back to the whole screen.
+	displays, err := c.Displays()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(displays) < 2 {
+		t.Log("Xvfb has no RandR outputs; only switching back to the screen")
+	}
+	for _, d := range append(displays[1:], displays[0]) {
+		if err := c.SetDisplay(d.ID); err != nil {
+			t.Fatalf("switch to %s: %v", d.Name, err)
+		}
+		if got := c.Display(); got.ID != d.ID {
+			t.Fatalf("switched to %s, but capturing %s", d.Name, got.Name)
+		}
+		checkQuadrants(t, nextFrame(t, c, d.Bounds.Size()), d.Bounds, w, h)
+	}
+}
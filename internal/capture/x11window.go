@@ -0,0 +1,217 @@
+//go:build linux
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jezek/xgb/xproto"
+)
+
+// X11WindowCapturer captures an X11 window, or every window of an
+// application, following them as they move and resize. Without a
+// compositor, windows have no contents of their own to read, so their area
+// of the screen is captured, including anything overlapping them.
+type X11WindowCapturer struct {
+	*ticker
+	x   *X11Capturer // connection and shared memory; not started
+	sel windowSelector
+	// lost is set while the windows are off screen, e.g. minimized.
+	lost bool
+
+	mu      sync.Mutex
+	info    DisplayInfo
+	windows []WindowInfo
+}
+
+// ListWindows lists the application windows on the X display in $DISPLAY,
+// front to back.
+func ListWindows() ([]WindowInfo, error) {
+	var list []WindowInfo
+	err := withQuery(func(c *X11Capturer) error {
+		var err error
+		list, err = c.listWindows()
+		return err
+	})
+	return list, err
+}
+
+// newWindowSource opens a capturer for "window:ID|TITLE" or "app:NAME|PID"
+// on the X display in $DISPLAY.
+func newWindowSource(kind, arg string, fps int) (Source, error) {
+	x, err := openX11("")
+	if err != nil {
+		return nil, err
+	}
+	list, err := x.listWindows()
+	if err != nil {
+		x.conn.Close()
+		return nil, err
+	}
+	sel, err := selectWindows(kind, arg, list)
+	if err != nil {
+		x.conn.Close()
+		return nil, err
+	}
+	x.initShm()
+	c := &X11WindowCapturer{x: x, sel: sel}
+	c.windows = sel.match(list)
+	b := windowBounds(c.windows)
+	c.info = windowsInfo(c.windows, b, b.Dx(), b.Dy())
+	t, err := newTicker(fps, c.capture)
+	if err != nil {
+		x.conn.Close()
+		return nil, err
+	}
+	c.ticker = t
+	return c, nil
+}
+
+func (c *X11WindowCapturer) Display() DisplayInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+func (c *X11WindowCapturer) Windows() []WindowInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]WindowInfo(nil), c.windows...)
+}
+
+// capture finds the windows where they are now and grabs their area of
+// the screen into a pooled buffer.
+func (c *X11WindowCapturer) capture() *Frame {
+	start := time.Now()
+	var windows []WindowInfo
+	if c.sel.id != 0 {
+		if w, ok := c.x.windowInfo(xproto.Window(c.sel.id)); ok {
+			windows = []WindowInfo{w}
+		}
+	} else if list, err := c.x.listWindows(); err == nil {
+		windows = c.sel.match(list)
+	}
+	var r image.Rectangle
+	if len(windows) > 0 {
+		if g, err := xproto.GetGeometry(c.x.conn, xproto.Drawable(c.x.root)).Reply(); err == nil {
+			r = windowBounds(windows).Intersect(image.Rect(0, 0, int(g.Width), int(g.Height)))
+		}
+	}
+	if r.Empty() {
+		if !c.lost {
+			log.Printf("window capture: %s is not on screen", c.Display().Name)
+		}
+		c.lost = true
+		return nil
+	}
+	c.lost = false
+
+	src, err := c.x.grab(r)
+	if err != nil {
+		log.Printf("X11 window capture: %v", err)
+		return nil
+	}
+	w, h := r.Dx(), r.Dy()
+	img := &image.RGBA{Pix: c.x.pool.get(w * h * 4), Stride: w * 4, Rect: image.Rect(0, 0, w, h)}
+	bgrxToRGBA(img.Pix, src)
+
+	c.mu.Lock()
+	c.windows = windows
+	c.info = windowsInfo(windows, r, w, h)
+	c.mu.Unlock()
+	return &Frame{
+		Image:           img,
+		Timestamp:       time.Now(),
+		CaptureDuration: time.Since(start),
+		pool:            c.x.pool,
+	}
+}
+
+// listWindows lists the viewable top-level windows, front to back: the
+// window manager's client list, or without one the root's children.
+func (c *X11Capturer) listWindows() ([]WindowInfo, error) {
+	var ids []xproto.Window
+	if data := c.property(c.root, "_NET_CLIENT_LIST_STACKING", xproto.AtomWindow); len(data) > 0 {
+		for i := 0; i+4 <= len(data); i += 4 {
+			ids = append(ids, xproto.Window(binary.LittleEndian.Uint32(data[i:])))
+		}
+	} else {
+		tree, err := xproto.QueryTree(c.conn, c.root).Reply()
+		if err != nil {
+			return nil, err
+		}
+		ids = tree.Children
+	}
+	// Both lists are in stacking order, bottom first.
+	var list []WindowInfo
+	for _, id := range slices.Backward(ids) {
+		if w, ok := c.windowInfo(id); ok {
+			list = append(list, w)
+		}
+	}
+	return list, nil
+}
+
+// windowInfo describes window w, if it is viewable.
+func (c *X11Capturer) windowInfo(w xproto.Window) (WindowInfo, bool) {
+	attrs, err := xproto.GetWindowAttributes(c.conn, w).Reply()
+	if err != nil || attrs.MapState != xproto.MapStateViewable || attrs.OverrideRedirect ||
+		attrs.Class == xproto.WindowClassInputOnly {
+		return WindowInfo{}, false
+	}
+	g, err := xproto.GetGeometry(c.conn, xproto.Drawable(w)).Reply()
+	if err != nil {
+		return WindowInfo{}, false
+	}
+	pos, err := xproto.TranslateCoordinates(c.conn, w, c.root, 0, 0).Reply()
+	if err != nil {
+		return WindowInfo{}, false
+	}
+	info := WindowInfo{
+		ID:     uint32(w),
+		Bounds: image.Rect(int(pos.DstX), int(pos.DstY), int(pos.DstX)+int(g.Width), int(pos.DstY)+int(g.Height)),
+	}
+	if title := c.property(w, "_NET_WM_NAME", c.atom("UTF8_STRING")); len(title) > 0 {
+		info.Title = string(title)
+	} else {
+		info.Title = string(c.property(w, "WM_NAME", xproto.AtomString))
+	}
+	// WM_CLASS is the instance name and then the class name, each
+	// NUL-terminated; the class names the application.
+	if class := bytes.Split(c.property(w, "WM_CLASS", xproto.AtomString), []byte{0}); len(class) > 1 {
+		info.App = string(class[1])
+	}
+	if pid := c.property(w, "_NET_WM_PID", xproto.AtomCardinal); len(pid) >= 4 {
+		info.PID = int(binary.LittleEndian.Uint32(pid))
+	}
+	return info, true
+}
+
+// property returns the value of a window property of the given type, or
+// nothing if it isn't set.
+func (c *X11Capturer) property(w xproto.Window, name string, typ xproto.Atom) []byte {
+	reply, err := xproto.GetProperty(c.conn, false, w, c.atom(name), typ, 0, 1<<16).Reply()
+	if err != nil || reply.Type != typ {
+		return nil
+	}
+	return reply.Value
+}
+
+// atom returns the atom for name, interning it on first use.
+func (c *X11Capturer) atom(name string) xproto.Atom {
+	if a, ok := c.atoms[name]; ok {
+		return a
+	}
+	reply, err := xproto.InternAtom(c.conn, false, uint16(len(name)), name).Reply()
+	if err != nil {
+		return xproto.AtomNone
+	}
+	c.atoms[name] = reply.Atom
+	return reply.Atom
+}
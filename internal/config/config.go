@@ -5,54 +5,356 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/fec"
+	"github.com/junsooki/AirMac/internal/privacy"
+	"github.com/junsooki/AirMac/internal/protocol"
+	"github.com/junsooki/AirMac/internal/scale"
 )
 
 // Config holds all runtime configuration.
 type Config struct {
 	SignalingURL string
+	RelayURL     string
 	HostID       string
-	DisplayIndex int
-	FPS          int
-	Quality      int
+	// Source selects what is captured: "screen[:OUTPUT]", "window:ID|TITLE",
+	// "app:NAME|PID", "pattern[:WxH]", "script:PATH" or "replay:PATH". Record, if set, is a file the
+	// captured frames are recorded to for replay.
+	Source string
+	Record string
+	// Displays are the indexes of the displays to capture, each streamed
+	// on its own, unless AllDisplays selects every one.
+	Displays    []int
+	AllDisplays bool
+	// ListDisplays makes the host print the displays it can capture and
+	// exit.
+	ListDisplays bool
+	// ListWindows makes the host print the windows it can capture and
+	// exit.
+	ListWindows bool
+	// Mask are the privacy rules whose areas are redacted from frames in
+	// MaskStyle. MaskInput also drops clicks in them.
+	Mask      []privacy.Rule
+	MaskStyle privacy.Style
+	MaskInput bool
+	FPS       int
+	// Pull captures each frame only once the previous one has been sent,
+	// rather than on every tick.
+	Pull    bool
+	Quality int
+	// Scale and MaxWidth shrink frames before encoding (1 and 0 = capture
+	// size), resampled with ScaleFilter.
+	Scale       float64
+	MaxWidth    int
+	ScaleFilter scale.Filter
+	// Codec is the image codec used unless the controller asks for another.
+	Codec protocol.Codec
+	// RefineAfter is the number of unchanged frames after which lossy tiles
+	// are re-sent at RefineQuality, then in RefineCodec (0 = off). A
+	// RefineQuality of 0 or a RefineCodec of 0 skips that pass.
+	RefineAfter   int
+	RefineQuality int
+	RefineCodec   protocol.Codec
+	// EncodeWorkers is the number of goroutines encoding JPEG strips
+	// (0 = one per CPU).
+	EncodeWorkers int
+	// Refresh is how often a full frame is sent between delta frames
+	// (0 = only when needed).
+	Refresh time.Duration
+	// Video selects the media-track codec offered to WebRTC controllers:
+	// "vp8" or "off". Bitrate is its target in kbit/s, and the bitrate the
+	// rate controller keeps frames under.
+	Video   string
+	Bitrate int
+
+	// Adaptive lowers Quality, FPS and, down to MinScale, the resolution
+	// when the network can't keep up, within LatencyBudget and Bitrate.
+	Adaptive      bool
+	LatencyBudget time.Duration
+	MinQuality    int
+	MinFPS        int
+	MinScale      float64
+
+	// DirectAddr, if set, makes the host listen for direct QUIC sessions
+	// instead of using signaling and WebRTC. DirectAllow holds the
+	// certificate fingerprints of the controllers allowed to connect.
+	DirectAddr  string
+	DirectCert  string
+	DirectAllow []string
+
+	// FECRedundancy is the parity added to WebRTC frames (parity chunks per
+	// data chunk). With FECAdaptive it is the floor and the actual value
+	// follows the loss the controller reports.
+	FECRedundancy float64
+	FECAdaptive   bool
 }
 
 // ParseHostFlags parses flags for the host binary.
 func ParseHostFlags() *Config {
 	cfg := &Config{}
 	flag.StringVar(&cfg.SignalingURL, "signaling", "ws://localhost:8080", "Signaling server WebSocket URL")
+	flag.StringVar(&cfg.RelayURL, "relay", "", "WebSocket relay URL (default: <signaling>/relay, \"off\" to disable)")
 	flag.StringVar(&cfg.HostID, "id", "", "Host ID (auto-generated if empty)")
-	flag.IntVar(&cfg.DisplayIndex, "display", 0, "Display index to capture (0 = primary)")
+	flag.StringVar(&cfg.Source, "source", "screen", "Frame source: screen[:OUTPUT], window:ID|TITLE, app:NAME|PID, pattern[:WxH], script:PATH or replay:PATH")
+	flag.StringVar(&cfg.Record, "record", "", "Record captured frames to this file (play back with -source replay:FILE)")
+	displays := flag.String("display", "0", "Displays to capture: an index (0 = primary), a list such as 0,1, or all (see -list-displays)")
+	flag.BoolVar(&cfg.ListDisplays, "list-displays", false, "List the displays that can be captured and exit")
+	window := flag.String("window", "", "Capture only this window, by ID or part of its title (see -list-windows)")
+	app := flag.String("app", "", "Capture only the windows of this application, by name or PID")
+	flag.BoolVar(&cfg.ListWindows, "list-windows", false, "List the windows that can be captured and exit")
+	var masks []string
+	flag.Func("mask", "Redact rect:X,Y,WxH, window:TITLE, app:NAME|BUNDLE|PID or locked from frames (repeatable)", func(v string) error {
+		masks = append(masks, v)
+		return nil
+	})
+	maskStyle := flag.String("mask-style", "fill", "How masked areas are drawn: fill or blur")
+	flag.BoolVar(&cfg.MaskInput, "mask-input", false, "Drop clicks in masked areas")
 	flag.IntVar(&cfg.FPS, "fps", 30, "Target frames per second")
+	flag.BoolVar(&cfg.Pull, "pull", false, "Capture each frame only after the previous one was sent (at most -fps)")
 	flag.IntVar(&cfg.Quality, "quality", 70, "JPEG quality (1-100)")
+	flag.Float64Var(&cfg.Scale, "scale", 1, "Scale frames by this factor before encoding (0-1)")
+	flag.IntVar(&cfg.MaxWidth, "max-width", 0, "Downscale frames wider than this many pixels (0 = no limit)")
+	filter := flag.String("scale-filter", "box", "Resampling filter: box or lanczos")
+	codec := flag.String("codec", "jpeg", "Default image codec: jpeg, screen, png, qoi or webp (webp needs -tags webp)")
+	flag.IntVar(&cfg.RefineAfter, "refine-after", 15, "Refine tiles unchanged for this many frames (0 = off)")
+	flag.IntVar(&cfg.RefineQuality, "refine-quality", 90, "Quality of the first refinement pass, in the session's codec (0 = skip)")
+	refineCodec := flag.String("refine-codec", "qoi", "Lossless codec of the last refinement pass: png, qoi, webp or off")
+	flag.IntVar(&cfg.EncodeWorkers, "encode-workers", 0, "Goroutines encoding JPEG strips in parallel (0 = one per CPU)")
+	flag.DurationVar(&cfg.Refresh, "refresh", 10*time.Second, "Interval between full frames (0 = only on request)")
+	flag.StringVar(&cfg.Video, "video", "vp8", "Video track codec for WebRTC sessions: \"vp8\" or \"off\" (needs -tags vpx)")
+	flag.IntVar(&cfg.Bitrate, "bitrate", 4000, "Target bitrate in kbit/s (video track and rate control)")
+	flag.BoolVar(&cfg.Adaptive, "adaptive", true, "Adapt quality, FPS and scale to network conditions")
+	flag.DurationVar(&cfg.LatencyBudget, "latency-budget", 100*time.Millisecond, "Rate control budget for one-way network and queueing delay (0 = none)")
+	flag.IntVar(&cfg.MinQuality, "min-quality", 30, "Lowest JPEG quality rate control may use")
+	flag.IntVar(&cfg.MinFPS, "min-fps", 10, "Lowest FPS rate control may use")
+	flag.Float64Var(&cfg.MinScale, "min-scale", 1, "Lowest scale rate control may downscale frames to (1 = never downscale)")
+	flag.StringVar(&cfg.DirectAddr, "direct", "", "Listen for direct QUIC sessions on host:port instead of using WebRTC")
+	flag.StringVar(&cfg.DirectCert, "direct-cert", defaultDirectCert("direct.pem"), "Certificate + key PEM for direct mode (created if missing)")
+	flag.Func("allow", "SHA-256 fingerprint of a controller certificate allowed in direct mode (repeatable, required with -direct)", func(v string) error {
+		cfg.DirectAllow = append(cfg.DirectAllow, v)
+		return nil
+	})
+	fecMode := flag.String("fec", "auto", "Frame FEC: \"auto\" (follow loss), \"off\", or a fixed redundancy such as 0.25")
 	flag.Parse()
 
 	if cfg.HostID == "" {
 		cfg.HostID = fmt.Sprintf("host-%s", randomID())
 	}
+	var err error
+	cfg.FECRedundancy, cfg.FECAdaptive, err = parseFEC(*fecMode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -fec: %v\n", err)
+		os.Exit(2)
+	}
+	if cfg.Displays, cfg.AllDisplays, err = parseDisplays(*displays); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -display: %v\n", err)
+		os.Exit(2)
+	}
+	if *window != "" || *app != "" {
+		name, spec := "window", "window:"+*window
+		if *app != "" {
+			name, spec = "app", "app:"+*app
+		}
+		switch {
+		case *window != "" && *app != "":
+			fmt.Fprintln(os.Stderr, "invalid -app: can't be used with -window")
+			os.Exit(2)
+		case cfg.Source != "screen":
+			fmt.Fprintf(os.Stderr, "invalid -%s: can't be used with -source %s\n", name, cfg.Source)
+			os.Exit(2)
+		}
+		cfg.Source = spec
+	}
+	for _, spec := range masks {
+		rule, err := privacy.ParseRule(spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -mask: %v\n", err)
+			os.Exit(2)
+		}
+		cfg.Mask = append(cfg.Mask, rule)
+	}
+	if cfg.MaskStyle, err = privacy.ParseStyle(*maskStyle); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -mask-style: %v\n", err)
+		os.Exit(2)
+	}
+	if cfg.MaskInput && len(cfg.Mask) == 0 {
+		fmt.Fprintln(os.Stderr, "invalid -mask-input: needs -mask")
+		os.Exit(2)
+	}
+	if cfg.Video != "vp8" && cfg.Video != "off" {
+		fmt.Fprintf(os.Stderr, "invalid -video %q: want vp8 or off\n", cfg.Video)
+		os.Exit(2)
+	}
+	if cfg.Codec, err = parseImageCodec(*codec); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -codec: %v\n", err)
+		os.Exit(2)
+	}
+	if *refineCodec != "off" {
+		cfg.RefineCodec, err = parseImageCodec(*refineCodec)
+		if err == nil && (cfg.RefineCodec == protocol.CodecJPEG || cfg.RefineCodec == protocol.CodecScreen) {
+			err = fmt.Errorf("%s is not lossless", cfg.RefineCodec)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -refine-codec: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	if cfg.RefineQuality < 0 || cfg.RefineQuality > 100 {
+		fmt.Fprintf(os.Stderr, "invalid -refine-quality %d: want 0-100\n", cfg.RefineQuality)
+		os.Exit(2)
+	}
+	if cfg.ScaleFilter, err = scale.ParseFilter(*filter); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -scale-filter: %v\n", err)
+		os.Exit(2)
+	}
+	if cfg.Scale <= 0 || cfg.Scale > 1 {
+		fmt.Fprintf(os.Stderr, "invalid -scale %v: want 0-1\n", cfg.Scale)
+		os.Exit(2)
+	}
+	if cfg.MinScale <= 0 || cfg.MinScale > 1 {
+		fmt.Fprintf(os.Stderr, "invalid -min-scale %v: want 0-1\n", cfg.MinScale)
+		os.Exit(2)
+	}
+	cfg.RelayURL = resolveRelayURL(cfg.RelayURL, cfg.SignalingURL)
 	return cfg
 }
 
 // ControllerConfig holds configuration for the controller binary.
 type ControllerConfig struct {
 	SignalingURL string
+	RelayURL     string
 	ControllerID string
 	HostID       string
+
+	// DirectAddr, if set, dials the host over QUIC instead of using
+	// signaling and WebRTC. DirectPin is the host certificate fingerprint;
+	// DirectCert is the controller's own certificate, which the host pins.
+	DirectAddr string
+	DirectPin  string
+	DirectCert string
+
+	// Video offers to receive frames on a VP8 media track.
+	Video bool
+	// Codec is the image codec to ask the host for (0 = host's choice).
+	Codec protocol.Codec
 }
 
 // ParseControllerFlags parses flags for the controller binary.
 func ParseControllerFlags() *ControllerConfig {
 	cfg := &ControllerConfig{}
 	flag.StringVar(&cfg.SignalingURL, "signaling", "ws://localhost:8080", "Signaling server WebSocket URL")
+	flag.StringVar(&cfg.RelayURL, "relay", "", "WebSocket relay URL (default: <signaling>/relay, \"off\" to disable)")
 	flag.StringVar(&cfg.ControllerID, "id", "", "Controller ID (auto-generated if empty)")
-	flag.StringVar(&cfg.HostID, "host", "", "Host ID to connect to (required)")
+	flag.StringVar(&cfg.HostID, "host", "", "Host ID to connect to (required unless -direct)")
+	flag.StringVar(&cfg.DirectAddr, "direct", "", "Connect directly to a host at host:port over QUIC")
+	flag.StringVar(&cfg.DirectPin, "pin", "", "SHA-256 fingerprint of the host certificate (required with -direct)")
+	flag.StringVar(&cfg.DirectCert, "direct-cert", defaultDirectCert("controller.pem"), "Certificate + key PEM presented to the host in direct mode (created if missing)")
+	flag.BoolVar(&cfg.Video, "video", true, "Offer to receive VP8 video over WebRTC (needs -tags vpx)")
+	codec := flag.String("codec", "", "Image codec to ask the host for: jpeg, screen, png, qoi or webp (default: host's choice)")
 	flag.Parse()
 
+	if *codec != "" {
+		var err error
+		if cfg.Codec, err = parseImageCodec(*codec); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -codec: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
 	if cfg.ControllerID == "" {
 		cfg.ControllerID = fmt.Sprintf("controller-%s", randomID())
 	}
+	cfg.RelayURL = resolveRelayURL(cfg.RelayURL, cfg.SignalingURL)
 	return cfg
 }
 
+// resolveRelayURL applies the relay flag: empty means the relay endpoint
+// hosted alongside signaling, "off" disables the relay fallback.
+func resolveRelayURL(relay, signalingURL string) string {
+	switch relay {
+	case "off":
+		return ""
+	case "":
+		u, err := url.Parse(signalingURL)
+		if err != nil {
+			return ""
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/relay"
+		return u.String()
+	}
+	return relay
+}
+
+// parseImageCodec parses a -codec flag, which must name an image codec.
+func parseImageCodec(name string) (protocol.Codec, error) {
+	c, err := protocol.ParseCodec(name)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := protocol.ImageTile(c).Codec(); !ok {
+		return 0, fmt.Errorf("%s is not an image codec", c)
+	}
+	return c, nil
+}
+
+// parseFEC parses the -fec flag.
+func parseFEC(mode string) (redundancy float64, adaptive bool, err error) {
+	switch mode {
+	case "auto":
+		return 0, true, nil
+	case "off":
+		return 0, false, nil
+	}
+	r, err := strconv.ParseFloat(mode, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	if r < 0 || r > fec.MaxRedundancy {
+		return 0, false, fmt.Errorf("redundancy %v outside 0-%v", r, fec.MaxRedundancy)
+	}
+	return r, false, nil
+}
+
+// maxDisplays is how many displays the host can stream at once; frame
+// headers number streams with a byte.
+const maxDisplays = 256
+
+// parseDisplays parses the -display flag.
+func parseDisplays(list string) (indexes []int, all bool, err error) {
+	if list == "all" {
+		return nil, true, nil
+	}
+	for _, f := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || i < 0 {
+			return nil, false, fmt.Errorf("%q is not a display index", f)
+		}
+		if slices.Contains(indexes, i) {
+			return nil, false, fmt.Errorf("display %d listed twice", i)
+		}
+		indexes = append(indexes, i)
+	}
+	if len(indexes) > maxDisplays {
+		return nil, false, fmt.Errorf("at most %d displays", maxDisplays)
+	}
+	return indexes, false, nil
+}
+
+func defaultDirectCert(name string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "airmac-" + name
+	}
+	return filepath.Join(dir, "AirMac", name)
+}
+
 func randomID() string {
 	b := make([]byte, 4)
 	rand.Read(b)
@@ -0,0 +1,93 @@
+package decoder
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"slices"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// Decoder decodes images of one image codec.
+type Decoder interface {
+	Decode(data []byte) (*image.RGBA, error)
+}
+
+// IntoDecoder is implemented by decoders that can decode into a
+// caller-supplied image, such as a region of a framebuffer, instead of
+// allocating a new one.
+type IntoDecoder interface {
+	// DecodeInto decodes data into dst, which must be the image's size.
+	DecodeInto(dst *image.RGBA, data []byte) error
+}
+
+// DecodeInto decodes data into dst with dec, without an intermediate copy
+// if dec is an IntoDecoder.
+func DecodeInto(dec Decoder, dst *image.RGBA, data []byte) error {
+	if d, ok := dec.(IntoDecoder); ok {
+		return d.DecodeInto(dst, data)
+	}
+	img, err := dec.Decode(data)
+	if err != nil {
+		return err
+	}
+	return drawInto(dst, img)
+}
+
+var factories = map[protocol.Codec]func() Decoder{}
+
+// Register makes a codec available to New. Codec implementations call it
+// from init, so a codec that needs a build tag is only present with it.
+func Register(c protocol.Codec, f func() Decoder) {
+	factories[c] = f
+}
+
+// New creates a decoder for c.
+func New(c protocol.Codec) (Decoder, error) {
+	f, ok := factories[c]
+	if !ok {
+		return nil, fmt.Errorf("no %s decoder in this build", c)
+	}
+	return f(), nil
+}
+
+// Codecs lists the codecs New supports, in ID order.
+func Codecs() []protocol.Codec {
+	codecs := make([]protocol.Codec, 0, len(factories))
+	for c := range factories {
+		codecs = append(codecs, c)
+	}
+	slices.Sort(codecs)
+	return codecs
+}
+
+// checkSize returns an error unless dst is w×h.
+func checkSize(dst *image.RGBA, w, h int) error {
+	if dst.Rect.Dx() != w || dst.Rect.Dy() != h {
+		return fmt.Errorf("image is %dx%d, want %v", w, h, dst.Rect.Size())
+	}
+	return nil
+}
+
+// drawInto copies img into dst, which must be the same size. draw.Draw has
+// fast paths for the image types the stdlib decoders return.
+func drawInto(dst *image.RGBA, img image.Image) error {
+	b := img.Bounds()
+	if err := checkSize(dst, b.Dx(), b.Dy()); err != nil {
+		return err
+	}
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+	return nil
+}
+
+// toRGBA returns img as *image.RGBA, converting it if needed.
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(b)
+	draw.Draw(rgba, b, img, b.Min, draw.Src)
+	return rgba
+}
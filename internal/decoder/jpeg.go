@@ -3,10 +3,15 @@ package decoder
 import (
 	"bytes"
 	"image"
-	"image/draw"
 	"image/jpeg"
+
+	"github.com/junsooki/AirMac/internal/protocol"
 )
 
+func init() {
+	Register(protocol.CodecJPEG, func() Decoder { return NewJPEGDecoder() })
+}
+
 // JPEGDecoder decodes JPEG bytes into *image.RGBA.
 type JPEGDecoder struct{}
 
@@ -19,12 +24,15 @@ func (d *JPEGDecoder) Decode(data []byte) (*image.RGBA, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Convert to RGBA if needed.
-	if rgba, ok := img.(*image.RGBA); ok {
-		return rgba, nil
+	return toRGBA(img), nil
+}
+
+// DecodeInto decodes the JPEG and converts it into dst, without the
+// intermediate RGBA image Decode makes.
+func (d *JPEGDecoder) DecodeInto(dst *image.RGBA, data []byte) error {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
 	}
-	b := img.Bounds()
-	rgba := image.NewRGBA(b)
-	draw.Draw(rgba, b, img, b.Min, draw.Src)
-	return rgba, nil
+	return drawInto(dst, img)
 }
@@ -0,0 +1,36 @@
+package decoder
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecPNG, func() Decoder { return NewPNGDecoder() })
+}
+
+// PNGDecoder decodes PNG bytes into *image.RGBA.
+type PNGDecoder struct{}
+
+func NewPNGDecoder() *PNGDecoder {
+	return &PNGDecoder{}
+}
+
+func (d *PNGDecoder) Decode(data []byte) (*image.RGBA, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return toRGBA(img), nil
+}
+
+func (d *PNGDecoder) DecodeInto(dst *image.RGBA, data []byte) error {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return drawInto(dst, img)
+}
@@ -0,0 +1,43 @@
+package decoder
+
+import (
+	"image"
+	"sync"
+)
+
+// maxPooled is how many frames a FramePool keeps. The display holds one
+// per stream and may not have drawn a few more yet.
+const maxPooled = 4
+
+// FramePool recycles the frames handed to the display, so decoding a
+// frame doesn't allocate a new one. It is safe for concurrent use.
+type FramePool struct {
+	mu   sync.Mutex
+	free []*image.RGBA
+}
+
+// Get returns a frame with bounds r, reused if one was put back. Its
+// pixels are undefined.
+func (p *FramePool) Get(r image.Rectangle) *image.RGBA {
+	p.mu.Lock()
+	for len(p.free) > 0 {
+		img := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		if img.Rect == r {
+			p.mu.Unlock()
+			return img
+		}
+		// The size changed; frames of the old size aren't needed again.
+	}
+	p.mu.Unlock()
+	return image.NewRGBA(r)
+}
+
+// Put returns a frame from Get once nothing uses it any more.
+func (p *FramePool) Put(img *image.RGBA) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.free) < maxPooled {
+		p.free = append(p.free, img)
+	}
+}
@@ -0,0 +1,128 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecQOI, func() Decoder { return NewQOIDecoder() })
+}
+
+const (
+	qoiHeaderSize = 14
+	qoiEndSize    = 8
+	// qoiMaxPixels bounds the image size a header may claim.
+	qoiMaxPixels = 8192 * 8192
+)
+
+var errQOITruncated = errors.New("qoi: truncated data")
+
+// QOIDecoder decodes QOI images into *image.RGBA.
+type QOIDecoder struct{}
+
+func NewQOIDecoder() *QOIDecoder {
+	return &QOIDecoder{}
+}
+
+func (d *QOIDecoder) Decode(data []byte) (*image.RGBA, error) {
+	w, h, err := qoiSize(data)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if err := qoiDecode(img, data); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (d *QOIDecoder) DecodeInto(dst *image.RGBA, data []byte) error {
+	w, h, err := qoiSize(data)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(dst, w, h); err != nil {
+		return err
+	}
+	return qoiDecode(dst, data)
+}
+
+// qoiSize checks the header of a QOI image and returns its size.
+func qoiSize(data []byte) (int, int, error) {
+	if len(data) < qoiHeaderSize+qoiEndSize || string(data[:4]) != "qoif" {
+		return 0, 0, errors.New("qoi: bad header")
+	}
+	w := int(binary.BigEndian.Uint32(data[4:]))
+	h := int(binary.BigEndian.Uint32(data[8:]))
+	if w == 0 || h == 0 || w > qoiMaxPixels/h {
+		return 0, 0, fmt.Errorf("qoi: bad size %dx%d", w, h)
+	}
+	if ch := data[12]; ch != 3 && ch != 4 {
+		return 0, 0, fmt.Errorf("qoi: bad channel count %d", ch)
+	}
+	return w, h, nil
+}
+
+// qoiDecode decodes the pixels of a QOI image with a valid header into dst,
+// which is its size.
+func qoiDecode(dst *image.RGBA, data []byte) error {
+	chunks := data[qoiHeaderSize : len(data)-qoiEndSize]
+	var index [64][4]byte
+	px := [4]byte{0, 0, 0, 255}
+	run, p := 0, 0
+	b := dst.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := dst.Pix[dst.PixOffset(b.Min.X, y):dst.PixOffset(b.Max.X, y)]
+		for o := 0; o < len(row); o += 4 {
+			if run > 0 {
+				run--
+			} else {
+				if p >= len(chunks) {
+					return errQOITruncated
+				}
+				b1 := chunks[p]
+				p++
+				switch {
+				case b1 == 0xfe:
+					if p+3 > len(chunks) {
+						return errQOITruncated
+					}
+					px[0], px[1], px[2] = chunks[p], chunks[p+1], chunks[p+2]
+					p += 3
+				case b1 == 0xff:
+					if p+4 > len(chunks) {
+						return errQOITruncated
+					}
+					px = [4]byte{chunks[p], chunks[p+1], chunks[p+2], chunks[p+3]}
+					p += 4
+				case b1&0xc0 == 0x00:
+					px = index[b1]
+				case b1&0xc0 == 0x40:
+					px[0] += (b1>>4)&3 - 2
+					px[1] += (b1>>2)&3 - 2
+					px[2] += b1&3 - 2
+				case b1&0xc0 == 0x80:
+					if p >= len(chunks) {
+						return errQOITruncated
+					}
+					b2 := chunks[p]
+					p++
+					vg := b1&0x3f - 32
+					px[0] += vg - 8 + (b2>>4)&0x0f
+					px[1] += vg
+					px[2] += vg - 8 + b2&0x0f
+				default:
+					run = int(b1 & 0x3f)
+				}
+				index[(px[0]*3+px[1]*5+px[2]*7+px[3]*11)%64] = px
+			}
+			copy(row[o:o+4], px[:])
+		}
+	}
+	return nil
+}
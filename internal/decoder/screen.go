@@ -0,0 +1,173 @@
+package decoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecScreen, func() Decoder { return NewScreenDecoder() })
+}
+
+var errPaletteTruncated = errors.New("screen: palette tile truncated")
+
+// ScreenDecoder decodes protocol.CodecScreen images into *image.RGBA.
+type ScreenDecoder struct {
+	jpeg *JPEGDecoder
+}
+
+func NewScreenDecoder() *ScreenDecoder {
+	return &ScreenDecoder{jpeg: NewJPEGDecoder()}
+}
+
+func (d *ScreenDecoder) Decode(data []byte) (*image.RGBA, error) {
+	w, h, err := screenSize(data)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if err := d.decode(img, data); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func (d *ScreenDecoder) DecodeInto(dst *image.RGBA, data []byte) error {
+	w, h, err := screenSize(data)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(dst, w, h); err != nil {
+		return err
+	}
+	return d.decode(dst, data)
+}
+
+func (d *ScreenDecoder) decode(dst *image.RGBA, data []byte) error {
+	n := binary.BigEndian.Uint32(data[4:])
+	data = data[protocol.ScreenHeaderSize:]
+	if uint64(n) > uint64(len(data)) {
+		return errors.New("screen: flat section truncated")
+	}
+	zr := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(zr)
+	if err := zr.(flate.Resetter).Reset(bytes.NewReader(data[:n]), nil); err != nil {
+		return err
+	}
+	flat, err := io.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("screen: flat section: %w", err)
+	}
+
+	b := dst.Rect
+	for _, payload := range [][]byte{flat, data[n:]} {
+		tiles, err := protocol.ParseTiles(payload, b.Dx(), b.Dy())
+		if err != nil {
+			return fmt.Errorf("screen: %w", err)
+		}
+		for _, t := range tiles {
+			r := image.Rect(int(t.X), int(t.Y), int(t.X)+int(t.W), int(t.Y)+int(t.H)).Add(b.Min)
+			tile := dst.SubImage(r).(*image.RGBA)
+			switch t.Kind {
+			case protocol.TileSolid:
+				if len(t.Data) != 4 {
+					return fmt.Errorf("screen: solid tile has %d bytes", len(t.Data))
+				}
+				fill(tile, [4]byte(t.Data))
+			case protocol.TilePalette:
+				err = decodePalette(tile, t.Data)
+			case protocol.TileJPEG:
+				err = d.jpeg.DecodeInto(tile, t.Data)
+			default:
+				err = fmt.Errorf("screen: unsupported tile kind %s", t.Kind)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flateReaders holds decompressors for the flat section.
+var flateReaders = sync.Pool{New: func() any {
+	return flate.NewReader(bytes.NewReader(nil))
+}}
+
+// screenSize returns the size in a CodecScreen image header.
+func screenSize(data []byte) (int, int, error) {
+	if len(data) < protocol.ScreenHeaderSize {
+		return 0, 0, errors.New("screen: header truncated")
+	}
+	w := int(binary.BigEndian.Uint16(data))
+	h := int(binary.BigEndian.Uint16(data[2:]))
+	if w == 0 || h == 0 {
+		return 0, 0, fmt.Errorf("screen: bad size %dx%d", w, h)
+	}
+	return w, h, nil
+}
+
+// fill sets every pixel of img to c.
+func fill(img *image.RGBA, c [4]byte) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			copy(row[i:i+4], c[:])
+		}
+	}
+}
+
+// decodePalette decodes a protocol.TilePalette into img.
+func decodePalette(img *image.RGBA, data []byte) error {
+	if len(data) < 1 {
+		return errPaletteTruncated
+	}
+	n := int(data[0])
+	if n == 0 || n > protocol.MaxPaletteColors || len(data) < 1+4*n {
+		return fmt.Errorf("screen: bad palette of %d colors", n)
+	}
+	palette := make([][4]byte, n)
+	for i := range palette {
+		palette[i] = [4]byte(data[1+4*i:])
+	}
+	runs := data[1+4*n:]
+
+	b := img.Bounds()
+	var px [4]byte
+	run := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			if run == 0 {
+				if len(runs) == 0 {
+					return errPaletteTruncated
+				}
+				idx := int(runs[0])
+				if idx >= n {
+					return fmt.Errorf("screen: palette index %d of %d", idx, n)
+				}
+				extra, k := binary.Uvarint(runs[1:])
+				if k <= 0 || extra >= uint64(len(img.Pix)) {
+					return errPaletteTruncated
+				}
+				runs = runs[1+k:]
+				px, run = palette[idx], int(extra)+1
+			}
+			copy(row[i:i+4], px[:])
+			run--
+		}
+	}
+	if run != 0 || len(runs) != 0 {
+		return errors.New("screen: palette runs don't match the tile size")
+	}
+	return nil
+}
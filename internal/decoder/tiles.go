@@ -0,0 +1,83 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// ErrNeedKeyframe is returned for a delta frame that has no base frame to
+// apply to (first frame, or the frame size changed).
+var ErrNeedKeyframe = errors.New("delta frame without a base frame")
+
+// TileDecoder decodes protocol.CodecTiles payloads by compositing their
+// tiles onto a persistent framebuffer. Image tiles may use any registered
+// codec, and may change codec from frame to frame.
+type TileDecoder struct {
+	decoders map[protocol.Codec]Decoder
+	fb       *image.RGBA
+	frames   *FramePool
+}
+
+// NewTileDecoder creates a tile decoder that takes the frames it returns
+// from frames, or from a pool of its own if frames is nil.
+func NewTileDecoder(frames *FramePool) *TileDecoder {
+	if frames == nil {
+		frames = &FramePool{}
+	}
+	return &TileDecoder{decoders: map[protocol.Codec]Decoder{}, frames: frames}
+}
+
+// Decode applies a frame's tiles and returns a copy of the framebuffer, so
+// the caller may keep it while later frames are decoded. The copy comes
+// from the decoder's FramePool; put it back once it isn't used any more.
+func (d *TileDecoder) Decode(width, height int, keyframe bool, payload []byte) (*image.RGBA, error) {
+	tiles, err := protocol.ParseTiles(payload, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	if keyframe {
+		if d.fb == nil || d.fb.Rect != bounds {
+			d.fb = image.NewRGBA(bounds)
+		}
+	} else if d.fb == nil || d.fb.Rect != bounds {
+		return nil, ErrNeedKeyframe
+	}
+
+	for _, t := range tiles {
+		r := image.Rect(int(t.X), int(t.Y), int(t.X)+int(t.W), int(t.Y)+int(t.H))
+		codec, ok := t.Kind.Codec()
+		if !ok {
+			return nil, fmt.Errorf("unsupported tile kind %s", t.Kind)
+		}
+		dec, err := d.decoder(codec)
+		if err != nil {
+			return nil, err
+		}
+		// Tiles decode straight into the framebuffer.
+		if err := DecodeInto(dec, d.fb.SubImage(r).(*image.RGBA), t.Data); err != nil {
+			return nil, fmt.Errorf("tile at %v: %w", r, err)
+		}
+	}
+
+	out := d.frames.Get(bounds)
+	copy(out.Pix, d.fb.Pix)
+	return out, nil
+}
+
+// decoder returns the decoder for c, creating it on first use.
+func (d *TileDecoder) decoder(c protocol.Codec) (Decoder, error) {
+	if dec, ok := d.decoders[c]; ok {
+		return dec, nil
+	}
+	dec, err := New(c)
+	if err != nil {
+		return nil, err
+	}
+	d.decoders[c] = dec
+	return dec, nil
+}
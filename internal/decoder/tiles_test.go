@@ -0,0 +1,104 @@
+package decoder
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/junsooki/AirMac/internal/encoder"
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// testScreen draws a w by h frame with a moving block, so successive
+// frames change a few tiles.
+func testScreen(w, h, frame int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = byte(x), byte(y), byte(x^y), 255
+		}
+	}
+	x0 := frame * 16 % (w - 32)
+	for y := 32; y < 64; y++ {
+		for x := x0; x < x0+32; x++ {
+			i := img.PixOffset(x, y)
+			copy(img.Pix[i:i+4], []byte{255, 255, 255, 255})
+		}
+	}
+	return img
+}
+
+func TestTileDecoderReusesFrames(t *testing.T) {
+	enc := encoder.NewTileEncoder(encoder.NewQOIEncoder(), 1, 0)
+	frames := &FramePool{}
+	dec := NewTileDecoder(frames)
+
+	var prev *image.RGBA
+	for i := range 4 {
+		want := testScreen(256, 192, i)
+		payload, keyframe, err := enc.Encode(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyframe != (i == 0) {
+			t.Fatalf("frame %d: keyframe = %v", i, keyframe)
+		}
+		got, err := dec.Decode(256, 192, keyframe, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Fatalf("frame %d decoded differently", i)
+		}
+		if prev != nil && got != prev {
+			t.Fatalf("frame %d: the frame put back wasn't reused", i)
+		}
+		frames.Put(got)
+		prev = got
+	}
+
+	if _, err := dec.Decode(128, 128, false, protocol.AppendTiles(nil, nil)); err != ErrNeedKeyframe {
+		t.Fatalf("delta of another size: err = %v, want ErrNeedKeyframe", err)
+	}
+}
+
+// BenchmarkTileDecoder decodes the delta frames of a screen whose frames
+// the display gives back after drawing them.
+func BenchmarkTileDecoder(b *testing.B) {
+	for _, size := range []struct {
+		name string
+		w, h int
+	}{
+		{"1080p", 1920, 1080},
+		{"4K", 3840, 2160},
+	} {
+		b.Run(size.name, func(b *testing.B) {
+			enc := encoder.NewTileEncoder(encoder.NewJPEGEncoder(80), 0, 0)
+			key, _, err := enc.Encode(testScreen(size.w, size.h, 0))
+			if err != nil {
+				b.Fatal(err)
+			}
+			delta, _, err := enc.Encode(testScreen(size.w, size.h, 1))
+			if err != nil {
+				b.Fatal(err)
+			}
+			frames := &FramePool{}
+			dec := NewTileDecoder(frames)
+			img, err := dec.Decode(size.w, size.h, true, key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			frames.Put(img)
+
+			b.ReportAllocs()
+			for b.Loop() {
+				img, err := dec.Decode(size.w, size.h, false, delta)
+				if err != nil {
+					b.Fatal(err)
+				}
+				frames.Put(img)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+//go:build vpx
+
+package decoder
+
+/*
+#cgo pkg-config: vpx
+#include <vpx/vpx_decoder.h>
+#include <vpx/vp8dx.h>
+
+static vpx_codec_err_t airmacDecInit(vpx_codec_ctx_t *ctx) {
+	vpx_codec_dec_cfg_t cfg = {0};
+	cfg.threads = 2;
+	return vpx_codec_dec_init(ctx, vpx_codec_vp8_dx(), &cfg, 0);
+}
+
+// airmacDecode decodes one frame and returns the last image it produced,
+// or NULL with *err set on failure (or unset if there is no image yet).
+static vpx_image_t *airmacDecode(vpx_codec_ctx_t *ctx, const unsigned char *data,
+		unsigned int size, int *err) {
+	*err = 0;
+	if (vpx_codec_decode(ctx, data, size, NULL, 0) != VPX_CODEC_OK) {
+		*err = 1;
+		return NULL;
+	}
+	vpx_codec_iter_t iter = NULL;
+	vpx_image_t *img = NULL, *next;
+	while ((next = vpx_codec_get_frame(ctx, &iter)) != NULL) {
+		img = next;
+	}
+	return img;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"unsafe"
+)
+
+// VP8Available reports whether this build includes the libvpx VP8 codec.
+const VP8Available = true
+
+// VP8Decoder decodes a VP8 stream into *image.RGBA using libvpx.
+type VP8Decoder struct {
+	ctx C.vpx_codec_ctx_t
+}
+
+func NewVP8Decoder() (*VP8Decoder, error) {
+	d := &VP8Decoder{}
+	if err := C.airmacDecInit(&d.ctx); err != C.VPX_CODEC_OK {
+		return nil, fmt.Errorf("vp8 init: %s", C.GoString(C.vpx_codec_err_to_string(err)))
+	}
+	return d, nil
+}
+
+// Decode decodes one frame. It returns a nil image without error if the
+// frame produced no picture.
+func (d *VP8Decoder) Decode(data []byte) (*image.RGBA, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var failed C.int
+	img := C.airmacDecode(&d.ctx, (*C.uchar)(unsafe.Pointer(&data[0])), C.uint(len(data)), &failed)
+	if failed != 0 {
+		return nil, fmt.Errorf("vp8: %s", C.GoString(C.vpx_codec_error(&d.ctx)))
+	}
+	if img == nil {
+		return nil, nil
+	}
+	if img.fmt != C.VPX_IMG_FMT_I420 {
+		return nil, fmt.Errorf("vp8: unexpected image format %d", img.fmt)
+	}
+
+	// Wrap libvpx's planes without copying; draw converts them to RGBA
+	// before the next Decode can reuse them.
+	w, h := int(img.d_w), int(img.d_h)
+	ch := (h + 1) / 2
+	ycc := &image.YCbCr{
+		Y:              unsafe.Slice((*byte)(unsafe.Pointer(img.planes[0])), int(img.stride[0])*h),
+		Cb:             unsafe.Slice((*byte)(unsafe.Pointer(img.planes[1])), int(img.stride[1])*ch),
+		Cr:             unsafe.Slice((*byte)(unsafe.Pointer(img.planes[2])), int(img.stride[2])*ch),
+		YStride:        int(img.stride[0]),
+		CStride:        int(img.stride[1]),
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, w, h),
+	}
+	rgba := image.NewRGBA(ycc.Rect)
+	draw.Draw(rgba, rgba.Rect, ycc, image.Point{}, draw.Src)
+	return rgba, nil
+}
+
+// Close releases the libvpx decoder.
+func (d *VP8Decoder) Close() {
+	C.vpx_codec_destroy(&d.ctx)
+}
@@ -0,0 +1,27 @@
+//go:build !vpx
+
+package decoder
+
+import (
+	"errors"
+	"image"
+)
+
+// VP8Available reports whether this build includes the libvpx VP8 codec.
+// Build with -tags vpx (and libvpx installed) to enable it.
+const VP8Available = false
+
+var errNoVP8 = errors.New("vp8: built without libvpx (use -tags vpx)")
+
+// VP8Decoder is unavailable in this build.
+type VP8Decoder struct{}
+
+func NewVP8Decoder() (*VP8Decoder, error) {
+	return nil, errNoVP8
+}
+
+func (d *VP8Decoder) Decode(data []byte) (*image.RGBA, error) {
+	return nil, errNoVP8
+}
+
+func (d *VP8Decoder) Close() {}
@@ -0,0 +1,80 @@
+//go:build webp
+
+package decoder
+
+/*
+#cgo pkg-config: libwebp
+#include <webp/decode.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecWebP, func() Decoder { return NewWebPDecoder() })
+}
+
+// webpMaxPixels bounds the image size a WebP header may claim.
+const webpMaxPixels = 8192 * 8192
+
+// WebPDecoder decodes WebP images into *image.RGBA using libwebp.
+type WebPDecoder struct{}
+
+func NewWebPDecoder() *WebPDecoder {
+	return &WebPDecoder{}
+}
+
+func (d *WebPDecoder) Decode(data []byte) (*image.RGBA, error) {
+	w, h, err := webpSize(data)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if err := d.decode(img, data); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// DecodeInto has libwebp write straight into dst's rows.
+func (d *WebPDecoder) DecodeInto(dst *image.RGBA, data []byte) error {
+	w, h, err := webpSize(data)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(dst, w, h); err != nil {
+		return err
+	}
+	return d.decode(dst, data)
+}
+
+func (d *WebPDecoder) decode(dst *image.RGBA, data []byte) error {
+	pix := dst.Pix[dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y):]
+	if C.WebPDecodeRGBAInto((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)),
+		(*C.uint8_t)(unsafe.Pointer(&pix[0])), C.size_t(len(pix)), C.int(dst.Stride)) == nil {
+		return errors.New("webp: decode failed")
+	}
+	return nil
+}
+
+// webpSize returns the size of the WebP image in data.
+func webpSize(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errors.New("webp: empty data")
+	}
+	var w, h C.int
+	if C.WebPGetInfo((*C.uint8_t)(unsafe.Pointer(&data[0])), C.size_t(len(data)), &w, &h) == 0 {
+		return 0, 0, errors.New("webp: bad header")
+	}
+	if w <= 0 || h <= 0 || int(w) > webpMaxPixels/int(h) {
+		return 0, 0, fmt.Errorf("webp: bad size %dx%d", w, h)
+	}
+	return int(w), int(h), nil
+}
@@ -1,10 +1,11 @@
 package display
 
 import (
-	"encoding/json"
 	"image"
 	"math"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/inpututil"
@@ -12,45 +13,178 @@ import (
 	"github.com/junsooki/AirMac/internal/input"
 )
 
-// InputCallback is called when the user generates an input event.
-type InputCallback func(eventJSON []byte)
+// InputCallback is called with each encoded input event the user generates.
+// reliable reports which input lane the event belongs on (see input.Reliable).
+type InputCallback func(data []byte, reliable bool)
 
 // EbitenDisplay renders the remote screen using Ebitengine and captures input.
+// A host that captures several displays sends each as its own stream;
+// their frames are tiled in the window, and input goes to the stream under
+// the pointer.
 type EbitenDisplay struct {
-	mu          sync.Mutex
-	frame       *image.RGBA
-	ebitenImage *ebiten.Image
-	onInput     InputCallback
+	mu      sync.Mutex
+	panes   []*pane
+	onInput InputCallback
+	// retired are the frames replaced since the last Draw, given back once
+	// Draw can no longer be using them.
+	retired []retiredFrame
+	// presented is set once the current frame has been drawn; onPresent
+	// is called at that moment.
+	presented bool
+	onPresent func()
+	// onSwitchDisplay is called with the active stream and -1 or 1 for the
+	// display switching shortcuts, which aren't sent to the host.
+	// localKeys holds the shortcut keys that are down, so their release
+	// isn't sent either.
+	onSwitchDisplay func(stream uint8, step int)
+	localKeys       map[ebiten.Key]bool
+	// zoomed is the stream shown on its own, or -1 to tile them all.
+	zoomed int
+
+	// The host's pointer, drawn over the frame of cursorStream once its
+	// shape is known. cursorX and cursorY are fractions of the host
+	// screen, whose width cursorScreenW relates the shape's pixels to the
+	// frame's.
+	cursorShape   image.Image // set by SetCursorShape until Draw uploads it
+	cursorHotspot image.Point
+	cursorImage   *ebiten.Image
+	cursorStream  uint8
+	cursorX       float64
+	cursorY       float64
+	cursorScreenW int
+	cursorVisible bool
+	hideSysCursor bool
+	// localMove is when the local pointer last moved over a frame, that
+	// of localStream. The pointer is drawn there until the host's position
+	// has had time to catch up, so it tracks the mouse without a network
+	// round trip.
+	localMove   time.Time
+	localStream uint8
+	localX      int
+	localY      int
 
-	screenW int
-	screenH int
+	inputMu     sync.Mutex
+	inputFormat input.Format
+	inputSeq    uint32
 
+	// active is the stream input goes to: the one under the pointer, or
+	// the one a held mouse button was pressed on.
+	active     uint8
 	prevMouseX int
 	prevMouseY int
+	// pendingMove holds the latest mouse position until the end of the
+	// tick, so at most one move is sent per tick.
+	pendingMove *input.InputEvent
+}
+
+// pane holds the latest frame of one stream.
+type pane struct {
+	frame       *image.RGBA
+	release     func(*image.RGBA)
+	ebitenImage *ebiten.Image
+}
+
+// retiredFrame is a frame that is no longer shown, and how to give it
+// back.
+type retiredFrame struct {
+	img     *image.RGBA
+	release func(*image.RGBA)
 }
 
 // NewEbitenDisplay creates an Ebitengine-based display.
 func NewEbitenDisplay(onInput InputCallback) *EbitenDisplay {
 	return &EbitenDisplay{
-		onInput: onInput,
-		screenW: 1280,
-		screenH: 720,
+		onInput:     onInput,
+		localKeys:   map[ebiten.Key]bool{},
+		zoomed:      -1,
+		inputFormat: input.FormatJSON,
+	}
+}
+
+// SetFrame updates the displayed frame of a stream (called from network
+// goroutine). If release is not nil, it is called with img once img has
+// been replaced and is no longer drawn, so its buffer can be reused.
+func (d *EbitenDisplay) SetFrame(stream uint8, img *image.RGBA, release func(*image.RGBA)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for int(stream) >= len(d.panes) {
+		d.panes = append(d.panes, &pane{})
+	}
+	p := d.panes[stream]
+	d.retire(p)
+	p.frame, p.release = img, release
+	d.presented = false
+}
+
+// retire queues the frame of p to be released after the next Draw starts.
+// d.mu must be held.
+func (d *EbitenDisplay) retire(p *pane) {
+	if p.frame != nil && p.release != nil {
+		d.retired = append(d.retired, retiredFrame{p.frame, p.release})
 	}
+	p.frame, p.release = nil, nil
 }
 
-// SetFrame updates the displayed frame (called from network goroutine).
-func (d *EbitenDisplay) SetFrame(img *image.RGBA) {
+// SetStreams sets how many streams the host sends, dropping the panes of
+// any it no longer does.
+func (d *EbitenDisplay) SetStreams(n int) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.frame = img
-	if img != nil {
-		w := img.Bounds().Dx()
-		h := img.Bounds().Dy()
-		if w != d.screenW || h != d.screenH {
-			d.screenW = w
-			d.screenH = h
+	if n < len(d.panes) {
+		for _, p := range d.panes[n:] {
+			d.retire(p)
 		}
+		d.panes = d.panes[:n]
 	}
+	if d.zoomed >= n {
+		d.zoomed = -1
+	}
+}
+
+// SetCursor moves the host's pointer to (x, y) on the screen of a stream,
+// which has the given size in pixels, or hides it.
+func (d *EbitenDisplay) SetCursor(stream uint8, x, y, screenW, screenH int, visible bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cursorStream = stream
+	d.cursorX = float64(x) / float64(screenW)
+	d.cursorY = float64(y) / float64(screenH)
+	d.cursorScreenW = screenW
+	d.cursorVisible = visible
+}
+
+// SetCursorShape sets the host's pointer image and the point of it placed
+// at the pointer position, in pixels of the host screen.
+func (d *EbitenDisplay) SetCursorShape(img image.Image, hotspot image.Point) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cursorShape = img
+	d.cursorHotspot = hotspot
+}
+
+// OnPresent sets a callback invoked the first time each frame passed to
+// SetFrame is drawn. Frames replaced before being drawn never trigger it.
+func (d *EbitenDisplay) OnPresent(cb func()) {
+	d.mu.Lock()
+	d.onPresent = cb
+	d.mu.Unlock()
+}
+
+// OnSwitchDisplay sets a callback invoked with the active stream and -1 or
+// 1 when Ctrl+Alt+Left or Ctrl+Alt+Right is pressed, to switch that stream
+// to the host's previous or next display.
+func (d *EbitenDisplay) OnSwitchDisplay(cb func(stream uint8, step int)) {
+	d.mu.Lock()
+	d.onSwitchDisplay = cb
+	d.mu.Unlock()
+}
+
+// SetInputFormat switches the wire format of input events once the host
+// has agreed to it. Events are sent as JSON until then.
+func (d *EbitenDisplay) SetInputFormat(f input.Format) {
+	d.inputMu.Lock()
+	d.inputFormat = f
+	d.inputMu.Unlock()
 }
 
 // Run starts the Ebitengine game loop. Must be called from the main goroutine.
@@ -66,33 +200,139 @@ func (d *EbitenDisplay) Run() error {
 func (d *EbitenDisplay) Update() error {
 	d.captureMouseInput()
 	d.captureKeyboardInput()
+	d.flushMove()
 	return nil
 }
 
 func (d *EbitenDisplay) Draw(screen *ebiten.Image) {
 	d.mu.Lock()
-	frame := d.frame
+	panes := d.layout(screen.Bounds().Dx(), screen.Bounds().Dy())
+	var presented func()
+	if !d.presented {
+		d.presented = true
+		presented = d.onPresent
+	}
+	// Frames replaced before now can't be in use: the previous Draw has
+	// finished and this one only draws the current frames.
+	retired := d.retired
+	d.retired = nil
 	d.mu.Unlock()
+	for _, f := range retired {
+		f.release(f.img)
+	}
 
-	if frame == nil {
-		return
+	for _, p := range panes {
+		frame := p.frame
+		if p.ebitenImage == nil ||
+			p.ebitenImage.Bounds().Dx() != frame.Bounds().Dx() ||
+			p.ebitenImage.Bounds().Dy() != frame.Bounds().Dy() {
+			p.ebitenImage = ebiten.NewImage(frame.Bounds().Dx(), frame.Bounds().Dy())
+		}
+		p.ebitenImage.WritePixels(frame.Pix)
+
+		op := &ebiten.DrawImageOptions{}
+		op.GeoM.Scale(p.scale, p.scale)
+		op.GeoM.Translate(p.offsetX, p.offsetY)
+		screen.DrawImage(p.ebitenImage, op)
 	}
+	d.drawCursor(screen, panes)
+
+	if presented != nil {
+		presented()
+	}
+}
 
-	if d.ebitenImage == nil ||
-		d.ebitenImage.Bounds().Dx() != frame.Bounds().Dx() ||
-		d.ebitenImage.Bounds().Dy() != frame.Bounds().Dy() {
-		d.ebitenImage = ebiten.NewImage(frame.Bounds().Dx(), frame.Bounds().Dy())
+// placedPane is a pane with a frame, and where it is drawn: its frame is
+// scaled by scale and moved to offsetX, offsetY, centred in cell.
+type placedPane struct {
+	*pane
+	stream           uint8
+	frame            *image.RGBA
+	cell             image.Rectangle
+	scale            float64
+	offsetX, offsetY float64
+}
+
+// contains reports whether the window point (x, y) is on the pane's frame.
+func (p *placedPane) contains(x, y int) bool {
+	fx, fy := p.toFrame(x, y)
+	return fx >= 0 && fy >= 0 && fx < float64(p.frame.Bounds().Dx()) && fy < float64(p.frame.Bounds().Dy())
+}
+
+// toFrame converts the window point (x, y) to pixels of the pane's frame.
+func (p *placedPane) toFrame(x, y int) (float64, float64) {
+	return (float64(x) - p.offsetX) / p.scale, (float64(y) - p.offsetY) / p.scale
+}
+
+// layout places the panes that have a frame in a w by h window: the zoomed
+// one alone, or all of them in a grid of equal cells. d.mu must be held.
+func (d *EbitenDisplay) layout(w, h int) []placedPane {
+	var placed []placedPane
+	for i, p := range d.panes {
+		if p.frame != nil && (d.zoomed < 0 || d.zoomed == i) {
+			placed = append(placed, placedPane{pane: p, stream: uint8(i), frame: p.frame})
+		}
+	}
+	if len(placed) == 0 {
+		return nil
+	}
+	cols := int(math.Ceil(math.Sqrt(float64(len(placed)))))
+	rows := (len(placed) + cols - 1) / cols
+	for i := range placed {
+		p := &placed[i]
+		col, row := i%cols, i/cols
+		p.cell = image.Rect(w*col/cols, h*row/rows, w*(col+1)/cols, h*(row+1)/rows)
+		fw, fh := float64(p.frame.Bounds().Dx()), float64(p.frame.Bounds().Dy())
+		p.scale, p.offsetX, p.offsetY = aspectFitTransform(float64(p.cell.Dx()), float64(p.cell.Dy()), fw, fh)
+		p.offsetX += float64(p.cell.Min.X)
+		p.offsetY += float64(p.cell.Min.Y)
 	}
-	d.ebitenImage.WritePixels(frame.Pix)
+	return placed
+}
+
+// localCursorHold is how long after the local pointer stops that the host's
+// pointer is drawn under it rather than at the position the host reports.
+const localCursorHold = 300 * time.Millisecond
 
-	sw, sh := screen.Bounds().Dx(), screen.Bounds().Dy()
-	fw, fh := float64(frame.Bounds().Dx()), float64(frame.Bounds().Dy())
-	scale, offsetX, offsetY := aspectFitTransform(float64(sw), float64(sh), fw, fh)
+// drawCursor draws the host's pointer over the frame of its stream.
+func (d *EbitenDisplay) drawCursor(screen *ebiten.Image, panes []placedPane) {
+	d.mu.Lock()
+	if d.cursorShape != nil {
+		d.cursorImage = ebiten.NewImageFromImage(d.cursorShape)
+		d.cursorShape = nil
+	}
+	img, hot := d.cursorImage, d.cursorHotspot
+	stream, visible, screenW := d.cursorStream, d.cursorVisible, d.cursorScreenW
+	cx, cy := d.cursorX, d.cursorY
+	local := time.Since(d.localMove) < localCursorHold
+	if local {
+		stream, visible = d.localStream, true
+	}
+	localX, localY := d.localX, d.localY
+	d.mu.Unlock()
+	if img == nil || !visible || screenW == 0 {
+		return
+	}
+	i := slices.IndexFunc(panes, func(p placedPane) bool { return p.stream == stream })
+	if i < 0 {
+		return
+	}
+	p := &panes[i]
+	fw, fh := float64(p.frame.Bounds().Dx()), float64(p.frame.Bounds().Dy())
+	x, y := p.offsetX+cx*fw*p.scale, p.offsetY+cy*fh*p.scale
+	if local {
+		x, y = float64(localX), float64(localY)
+	}
 
+	// The shape is in host screen pixels, which may be more than the
+	// frame's if the host scaled it down.
+	s := p.scale * fw / float64(screenW)
 	op := &ebiten.DrawImageOptions{}
-	op.GeoM.Scale(scale, scale)
-	op.GeoM.Translate(offsetX, offsetY)
-	screen.DrawImage(d.ebitenImage, op)
+	op.GeoM.Translate(-float64(hot.X), -float64(hot.Y))
+	op.GeoM.Scale(s, s)
+	op.GeoM.Translate(x, y)
+	op.Filter = ebiten.FilterLinear
+	screen.DrawImage(img, op)
 }
 
 func (d *EbitenDisplay) Layout(outsideWidth, outsideHeight int) (int, int) {
@@ -106,27 +346,61 @@ func (d *EbitenDisplay) captureMouseInput() {
 
 	sw, sh := ebiten.WindowSize()
 	d.mu.Lock()
-	frame := d.frame
+	panes := d.layout(sw, sh)
 	d.mu.Unlock()
-	if frame == nil {
+	if len(panes) == 0 {
 		return
 	}
 
-	fw := float64(frame.Bounds().Dx())
-	fh := float64(frame.Bounds().Dy())
-	scale, offsetX, offsetY := aspectFitTransform(float64(sw), float64(sh), fw, fh)
-	remoteX := (float64(mx) - offsetX) / scale
-	remoteY := (float64(my) - offsetY) / scale
+	// Input goes to the pane under the pointer, but a drag stays on the
+	// pane it started on.
+	dragging := false
+	for _, b := range []ebiten.MouseButton{ebiten.MouseButtonLeft, ebiten.MouseButtonRight, ebiten.MouseButtonMiddle} {
+		if ebiten.IsMouseButtonPressed(b) && !inpututil.IsMouseButtonJustPressed(b) {
+			dragging = true
+		}
+	}
+	i := slices.IndexFunc(panes, func(p placedPane) bool { return p.stream == d.active })
+	if !dragging || i < 0 {
+		if j := slices.IndexFunc(panes, func(p placedPane) bool { return image.Pt(mx, my).In(p.cell) }); j >= 0 {
+			i = j
+		}
+	}
+	p := &panes[max(i, 0)]
+	d.active = p.stream
+	remoteX, remoteY := p.toFrame(mx, my)
+
+	// Over the frame, the host's pointer replaces the local one once its
+	// shape is known.
+	over := p.contains(mx, my)
+	d.mu.Lock()
+	hide := over && (d.cursorImage != nil || d.cursorShape != nil)
+	d.mu.Unlock()
+	if hide != d.hideSysCursor {
+		d.hideSysCursor = hide
+		if hide {
+			ebiten.SetCursorMode(ebiten.CursorModeHidden)
+		} else {
+			ebiten.SetCursorMode(ebiten.CursorModeVisible)
+		}
+	}
 
 	// Mouse move.
 	if mx != d.prevMouseX || my != d.prevMouseY {
 		d.prevMouseX = mx
 		d.prevMouseY = my
-		d.sendInput(input.InputEvent{
+		if over {
+			d.mu.Lock()
+			d.localMove = time.Now()
+			d.localStream = p.stream
+			d.localX, d.localY = mx, my
+			d.mu.Unlock()
+		}
+		d.pendingMove = &input.InputEvent{
 			Type: input.EventMouseMove,
 			X:    remoteX,
 			Y:    remoteY,
-		})
+		}
 	}
 
 	// Mouse buttons.
@@ -147,10 +421,11 @@ func (d *EbitenDisplay) captureMouseInput() {
 		}
 	}
 
-	// Scroll.
+	// Scroll. The pointer position lets the host tell whether it is over a
+	// captured window.
 	_, scrollY := ebiten.Wheel()
 	if scrollY != 0 {
-		d.sendInput(input.InputEvent{Type: input.EventMouseScroll, ScrollDY: scrollY})
+		d.sendInput(input.InputEvent{Type: input.EventMouseScroll, X: remoteX, Y: remoteY, ScrollDY: scrollY})
 	}
 }
 
@@ -158,6 +433,10 @@ func (d *EbitenDisplay) captureKeyboardInput() {
 	// Check all keys.
 	for k := ebiten.Key(0); k <= ebiten.KeyMax; k++ {
 		if inpututil.IsKeyJustPressed(k) {
+			if d.shortcut(k) {
+				d.localKeys[k] = true
+				continue
+			}
 			d.sendInput(input.InputEvent{
 				Type:      input.EventKeyDown,
 				KeyCode:   ebitenKeyToMacKeyCode(k),
@@ -165,6 +444,10 @@ func (d *EbitenDisplay) captureKeyboardInput() {
 			})
 		}
 		if inpututil.IsKeyJustReleased(k) {
+			if d.localKeys[k] {
+				delete(d.localKeys, k)
+				continue
+			}
 			d.sendInput(input.InputEvent{
 				Type:      input.EventKeyUp,
 				KeyCode:   ebitenKeyToMacKeyCode(k),
@@ -174,15 +457,63 @@ func (d *EbitenDisplay) captureKeyboardInput() {
 	}
 }
 
+// shortcut handles k if it completes a local shortcut.
+func (d *EbitenDisplay) shortcut(k ebiten.Key) bool {
+	if !ebiten.IsKeyPressed(ebiten.KeyControl) || !ebiten.IsKeyPressed(ebiten.KeyAlt) {
+		return false
+	}
+	step := 0
+	switch k {
+	case ebiten.KeyArrowLeft:
+		step = -1
+	case ebiten.KeyArrowRight:
+		step = 1
+	case ebiten.KeyEnter:
+		d.mu.Lock()
+		if d.zoomed < 0 {
+			d.zoomed = int(d.active)
+		} else {
+			d.zoomed = -1
+		}
+		d.mu.Unlock()
+		return true
+	default:
+		return false
+	}
+	d.mu.Lock()
+	cb := d.onSwitchDisplay
+	d.mu.Unlock()
+	if cb != nil {
+		cb(d.active, step)
+	}
+	return true
+}
+
+// flushMove sends the coalesced mouse move for this tick, if any.
+func (d *EbitenDisplay) flushMove() {
+	if d.pendingMove == nil {
+		return
+	}
+	d.sendInput(*d.pendingMove)
+	d.pendingMove = nil
+}
+
 func (d *EbitenDisplay) sendInput(e input.InputEvent) {
 	if d.onInput == nil {
 		return
 	}
-	data, err := json.Marshal(e)
+	d.inputMu.Lock()
+	d.inputSeq++
+	e.Seq = d.inputSeq
+	e.Stream = d.active
+	format := d.inputFormat
+	d.inputMu.Unlock()
+
+	data, err := input.EncodeEvent(&e, format)
 	if err != nil {
 		return
 	}
-	d.onInput(data)
+	d.onInput(data, input.Reliable(e.Type))
 }
 
 func currentModifiers() uint8 {
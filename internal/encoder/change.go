@@ -0,0 +1,63 @@
+package encoder
+
+import (
+	"hash/maphash"
+	"image"
+)
+
+// changeRowStride is how many rows apart ChangeDetector samples. A change
+// at least this many rows tall is seen in the frame it happens; a thinner
+// one within this many frames.
+const changeRowStride = 4
+
+// ChangeDetector tells cheaply whether the screen changed, so idle frames
+// can be dropped before they are scaled, hashed per tile and encoded. Each
+// call hashes every changeRowStride-th row, starting one row further down
+// than the call before, and compares each against the hash it had when it
+// was last sampled.
+type ChangeDetector struct {
+	seed  maphash.Seed
+	rows  []uint64
+	width int
+	phase int
+}
+
+// NewChangeDetector creates a change detector.
+func NewChangeDetector() *ChangeDetector {
+	return &ChangeDetector{seed: maphash.MakeSeed()}
+}
+
+// Changed reports whether img differs from the frames passed before it.
+// The first frame, and a frame of a new size, count as changed.
+//
+// A change seen in one frame may be reported again in the next few, for
+// rows of it that weren't sampled yet; callers encoding those frames find
+// nothing new in them.
+func (d *ChangeDetector) Changed(img *image.RGBA) bool {
+	b := img.Bounds()
+	if d.rows == nil || d.width != b.Dx() || len(d.rows) != b.Dy() {
+		d.width = b.Dx()
+		d.rows = make([]uint64, b.Dy())
+		for y := range d.rows {
+			d.rows[y] = d.hashRow(img, y)
+		}
+		return true
+	}
+
+	changed := false
+	for y := d.phase; y < len(d.rows); y += changeRowStride {
+		if h := d.hashRow(img, y); h != d.rows[y] {
+			d.rows[y] = h
+			changed = true
+		}
+	}
+	d.phase = (d.phase + 1) % changeRowStride
+	return changed
+}
+
+// hashRow hashes row y of img, counted from the top of its bounds.
+func (d *ChangeDetector) hashRow(img *image.RGBA, y int) uint64 {
+	b := img.Bounds()
+	y += b.Min.Y
+	return maphash.Bytes(d.seed, img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)])
+}
@@ -0,0 +1,53 @@
+package encoder
+
+import (
+	"fmt"
+	"image"
+	"slices"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// Encoder encodes images with one image codec. Implementations must be safe
+// for concurrent use, as tiles are encoded in parallel.
+type Encoder interface {
+	Codec() protocol.Codec
+	Encode(img *image.RGBA) ([]byte, error)
+}
+
+// QualitySetter is implemented by lossy encoders whose quality can change
+// while they are in use.
+type QualitySetter interface {
+	SetQuality(quality int)
+	Quality() int
+}
+
+// Factory creates an encoder. Lossless codecs ignore quality.
+type Factory func(quality int) Encoder
+
+var factories = map[protocol.Codec]Factory{}
+
+// Register makes a codec available to New. Codec implementations call it
+// from init, so a codec that needs a build tag is only present with it.
+func Register(c protocol.Codec, f Factory) {
+	factories[c] = f
+}
+
+// New creates an encoder for c.
+func New(c protocol.Codec, quality int) (Encoder, error) {
+	f, ok := factories[c]
+	if !ok {
+		return nil, fmt.Errorf("no %s encoder in this build", c)
+	}
+	return f(quality), nil
+}
+
+// Codecs lists the codecs New supports, in ID order.
+func Codecs() []protocol.Codec {
+	codecs := make([]protocol.Codec, 0, len(factories))
+	for c := range factories {
+		codecs = append(codecs, c)
+	}
+	slices.Sort(codecs)
+	return codecs
+}
@@ -4,31 +4,75 @@ import (
 	"bytes"
 	"image"
 	"image/jpeg"
+	"sync"
+	"sync/atomic"
+
+	"github.com/junsooki/AirMac/internal/protocol"
 )
 
-// JPEGEncoder encodes frames as JPEG.
+func init() {
+	Register(protocol.CodecJPEG, func(quality int) Encoder { return NewJPEGEncoder(quality) })
+}
+
+// JPEGEncoder encodes frames as JPEG. Its quality can be changed while it
+// is in use.
 type JPEGEncoder struct {
-	quality int
+	quality atomic.Int32
 }
 
 // NewJPEGEncoder creates a JPEG encoder with the given quality (1-100).
 func NewJPEGEncoder(quality int) *JPEGEncoder {
+	e := &JPEGEncoder{}
+	e.SetQuality(quality)
+	return e
+}
+
+// SetQuality sets the quality (clamped to 1-100) used by later Encode calls.
+func (e *JPEGEncoder) SetQuality(quality int) {
 	if quality < 1 {
 		quality = 1
 	}
 	if quality > 100 {
 		quality = 100
 	}
-	return &JPEGEncoder{quality: quality}
+	e.quality.Store(int32(quality))
+}
+
+// Quality returns the current quality.
+func (e *JPEGEncoder) Quality() int {
+	return int(e.quality.Load())
 }
 
+func (e *JPEGEncoder) Codec() protocol.Codec {
+	return protocol.CodecJPEG
+}
+
+// jpegBuffer is an encode buffer. With Flush it satisfies image/jpeg's
+// writer interface, so jpeg.Encode writes to it directly instead of
+// allocating a bufio.Writer per call.
+type jpegBuffer struct {
+	bytes.Buffer
+}
+
+func (b *jpegBuffer) Flush() error {
+	return nil
+}
+
+// jpegBuffers holds encode buffers across calls, pre-allocated at 256KB.
+var jpegBuffers = sync.Pool{New: func() any {
+	b := &jpegBuffer{}
+	b.Grow(256 * 1024)
+	return b
+}}
+
+// Encode encodes img into a pooled buffer and returns a copy sized to the
+// result.
 func (e *JPEGEncoder) Encode(img *image.RGBA) ([]byte, error) {
-	var buf bytes.Buffer
-	buf.Grow(256 * 1024) // pre-allocate 256KB
-	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: e.quality})
-	if err != nil {
+	buf := jpegBuffers.Get().(*jpegBuffer)
+	defer jpegBuffers.Put(buf)
+	buf.Reset()
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: e.Quality()}); err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	return bytes.Clone(buf.Bytes()), nil
 }
-
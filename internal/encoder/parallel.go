@@ -0,0 +1,137 @@
+package encoder
+
+import (
+	"image"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// ParallelEncoder encodes regions of a frame as independent images on
+// several goroutines. The stdlib encoders are single-threaded, so a large
+// frame is split into horizontal strips that are encoded concurrently and
+// sent as separate tiles. The codec can be switched between calls.
+type ParallelEncoder struct {
+	workers int
+
+	mu  sync.Mutex
+	enc Encoder
+}
+
+// NewParallelEncoder creates an encoder that runs enc on the given number
+// of workers (0 = one per CPU).
+func NewParallelEncoder(enc Encoder, workers int) *ParallelEncoder {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &ParallelEncoder{enc: enc, workers: workers}
+}
+
+// Encoder returns the current encoder.
+func (e *ParallelEncoder) Encoder() Encoder {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc
+}
+
+// SetEncoder replaces the encoder used by later calls.
+func (e *ParallelEncoder) SetEncoder(enc Encoder) {
+	e.mu.Lock()
+	e.enc = enc
+	e.mu.Unlock()
+}
+
+// SetQuality sets the quality of the current encoder, if it is lossy.
+func (e *ParallelEncoder) SetQuality(quality int) {
+	if q, ok := e.Encoder().(QualitySetter); ok {
+		q.SetQuality(quality)
+	}
+}
+
+// Workers returns the number of goroutines used per call.
+func (e *ParallelEncoder) Workers() int {
+	return e.workers
+}
+
+// Strips splits r into up to Workers() horizontal strips whose heights are
+// multiples of align, except possibly the last.
+func (e *ParallelEncoder) Strips(r image.Rectangle, align int) []image.Rectangle {
+	units := (r.Dy() + align - 1) / align
+	n := min(e.workers, units)
+	if n <= 1 {
+		return []image.Rectangle{r}
+	}
+	strips := make([]image.Rectangle, 0, n)
+	y := r.Min.Y
+	for i := range n {
+		// Spread the remainder over the first strips.
+		h := (units / n) * align
+		if i < units%n {
+			h += align
+		}
+		y1 := min(y+h, r.Max.Y)
+		strips = append(strips, image.Rect(r.Min.X, y, r.Max.X, y1))
+		y = y1
+	}
+	return strips
+}
+
+// EncodeRects encodes each rectangle of img (in img's coordinates) as its
+// own image, concurrently, and returns them in the order given along with
+// the codec they were encoded with.
+func (e *ParallelEncoder) EncodeRects(img *image.RGBA, rects []image.Rectangle) ([][]byte, protocol.Codec, error) {
+	enc := e.Encoder()
+	out, err := e.EncodeRectsWith(enc, img, rects)
+	if err != nil {
+		return nil, 0, err
+	}
+	return out, enc.Codec(), nil
+}
+
+// EncodeRectsWith is like EncodeRects, but encodes with enc instead of the
+// current encoder.
+func (e *ParallelEncoder) EncodeRectsWith(enc Encoder, img *image.RGBA, rects []image.Rectangle) ([][]byte, error) {
+	out := make([][]byte, len(rects))
+	if len(rects) == 1 || e.workers == 1 {
+		for i, r := range rects {
+			data, err := enc.Encode(img.SubImage(r).(*image.RGBA))
+			if err != nil {
+				return nil, err
+			}
+			out[i] = data
+		}
+		return out, nil
+	}
+
+	var (
+		next    atomic.Int32
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		err     error
+	)
+	for range min(e.workers, len(rects)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(rects) {
+					return
+				}
+				data, encErr := enc.Encode(img.SubImage(rects[i]).(*image.RGBA))
+				if encErr != nil {
+					errOnce.Do(func() { err = encErr })
+					return
+				}
+				out[i] = data
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,81 @@
+package encoder
+
+import (
+	"image"
+	"runtime"
+	"testing"
+)
+
+// benchSizes are the frame sizes the encoders are benchmarked at.
+var benchSizes = []struct {
+	name string
+	w, h int
+}{
+	{"1080p", 1920, 1080},
+	{"4K", 3840, 2160},
+}
+
+// benchFrame draws a w by h desktop-like frame: a gradient background with
+// flat panels holding rows of dark, text-like marks.
+func benchFrame(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = byte(40+x*80/w), byte(60+y*80/h), 140, 255
+		}
+	}
+	for py := h / 16; py+h/4 < h; py += h / 3 {
+		for px := w / 16; px+w/3 < w; px += w / 2 {
+			for y := py; y < py+h/4; y++ {
+				for x := px; x < px+w/3; x++ {
+					i := img.PixOffset(x, y)
+					v := byte(245)
+					// Marks 1 pixel wide in lines of 12, like glyph stems.
+					if (y-py)%12 < 8 && (x*7+y/12*13)%5 == 0 {
+						v = 30
+					}
+					img.Pix[i], img.Pix[i+1], img.Pix[i+2] = v, v, v
+				}
+			}
+		}
+	}
+	return img
+}
+
+// BenchmarkJPEGEncoder encodes whole frames on one goroutine.
+func BenchmarkJPEGEncoder(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(size.name, func(b *testing.B) {
+			img := benchFrame(size.w, size.h)
+			enc := NewJPEGEncoder(80)
+			b.SetBytes(int64(len(img.Pix)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := enc.Encode(img); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkParallelEncoder encodes the same frames as BenchmarkJPEGEncoder
+// as strips on GOMAXPROCS goroutines (set with -cpu), the way keyframes
+// are sent.
+func BenchmarkParallelEncoder(b *testing.B) {
+	for _, size := range benchSizes {
+		b.Run(size.name, func(b *testing.B) {
+			img := benchFrame(size.w, size.h)
+			enc := NewParallelEncoder(NewJPEGEncoder(80), runtime.GOMAXPROCS(0))
+			strips := enc.Strips(img.Rect, TileSize)
+			b.SetBytes(int64(len(img.Pix)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, _, err := enc.EncodeRects(img, strips); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
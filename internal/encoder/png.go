@@ -0,0 +1,34 @@
+package encoder
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecPNG, func(int) Encoder { return NewPNGEncoder() })
+}
+
+// PNGEncoder encodes frames as PNG at the fastest compression level.
+type PNGEncoder struct {
+	enc png.Encoder
+}
+
+func NewPNGEncoder() *PNGEncoder {
+	return &PNGEncoder{enc: png.Encoder{CompressionLevel: png.BestSpeed}}
+}
+
+func (e *PNGEncoder) Codec() protocol.Codec {
+	return protocol.CodecPNG
+}
+
+func (e *PNGEncoder) Encode(img *image.RGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := e.enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
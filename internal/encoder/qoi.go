@@ -0,0 +1,97 @@
+package encoder
+
+import (
+	"encoding/binary"
+	"image"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecQOI, func(int) Encoder { return NewQOIEncoder() })
+}
+
+// QOI ops (https://qoiformat.org/qoi-specification.pdf).
+const (
+	qoiOpIndex = 0x00
+	qoiOpDiff  = 0x40
+	qoiOpLuma  = 0x80
+	qoiOpRun   = 0xc0
+	qoiOpRGB   = 0xfe
+	qoiOpRGBA  = 0xff
+)
+
+// QOIEncoder encodes frames as QOI, a lossless format that is much faster
+// to encode than PNG and compresses flat UI content well.
+type QOIEncoder struct{}
+
+func NewQOIEncoder() *QOIEncoder {
+	return &QOIEncoder{}
+}
+
+func (e *QOIEncoder) Codec() protocol.Codec {
+	return protocol.CodecQOI
+}
+
+func (e *QOIEncoder) Encode(img *image.RGBA) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]byte, 0, 14+w*h+8)
+	out = append(out, "qoif"...)
+	out = binary.BigEndian.AppendUint32(out, uint32(w))
+	out = binary.BigEndian.AppendUint32(out, uint32(h))
+	out = append(out, 4, 0) // RGBA, sRGB
+
+	var index [64][4]byte
+	prev := [4]byte{0, 0, 0, 255}
+	run := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			px := [4]byte{row[i], row[i+1], row[i+2], row[i+3]}
+			if px == prev {
+				run++
+				if run == 62 {
+					out = append(out, qoiOpRun|byte(run-1))
+					run = 0
+				}
+				continue
+			}
+			if run > 0 {
+				out = append(out, qoiOpRun|byte(run-1))
+				run = 0
+			}
+
+			h := qoiHash(px)
+			switch {
+			case index[h] == px:
+				out = append(out, qoiOpIndex|h)
+			case px[3] != prev[3]:
+				out = append(out, qoiOpRGBA, px[0], px[1], px[2], px[3])
+			default:
+				vr := int8(px[0] - prev[0])
+				vg := int8(px[1] - prev[1])
+				vb := int8(px[2] - prev[2])
+				vgr, vgb := vr-vg, vb-vg
+				switch {
+				case vr >= -2 && vr <= 1 && vg >= -2 && vg <= 1 && vb >= -2 && vb <= 1:
+					out = append(out, qoiOpDiff|byte(vr+2)<<4|byte(vg+2)<<2|byte(vb+2))
+				case vg >= -32 && vg <= 31 && vgr >= -8 && vgr <= 7 && vgb >= -8 && vgb <= 7:
+					out = append(out, qoiOpLuma|byte(vg+32), byte(vgr+8)<<4|byte(vgb+8))
+				default:
+					out = append(out, qoiOpRGB, px[0], px[1], px[2])
+				}
+			}
+			index[h] = px
+			prev = px
+		}
+	}
+	if run > 0 {
+		out = append(out, qoiOpRun|byte(run-1))
+	}
+	return append(out, 0, 0, 0, 0, 0, 0, 0, 1), nil
+}
+
+func qoiHash(px [4]byte) byte {
+	return (px[0]*3 + px[1]*5 + px[2]*7 + px[3]*11) % 64
+}
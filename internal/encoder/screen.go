@@ -0,0 +1,210 @@
+package encoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"image"
+	"slices"
+	"sync"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecScreen, func(quality int) Encoder { return NewScreenEncoder(quality) })
+}
+
+// paletteBudget is the most a palette tile may cost per pixel, in bytes
+// before compression, before it is sent as JPEG instead. Text on a flat
+// background stays well under it; dithered or noisy content with few
+// colors doesn't.
+const paletteBudget = 0.75
+
+// ScreenEncoder encodes frames as protocol.CodecScreen images for screen
+// content. Each TileSize tile is classified on its own: a single color is
+// sent as a solid tile, a few colors as a run-length coded palette, which
+// keeps text and UI edges exact, and anything else as JPEG. Solid and
+// palette tiles are compressed together, and adjacent JPEG tiles are
+// merged into rectangles to share headers.
+type ScreenEncoder struct {
+	jpeg *JPEGEncoder
+}
+
+// NewScreenEncoder creates a screen encoder whose JPEG tiles have the given
+// quality (1-100).
+func NewScreenEncoder(quality int) *ScreenEncoder {
+	return &ScreenEncoder{jpeg: NewJPEGEncoder(quality)}
+}
+
+// SetQuality sets the quality of JPEG tiles.
+func (e *ScreenEncoder) SetQuality(quality int) {
+	e.jpeg.SetQuality(quality)
+}
+
+func (e *ScreenEncoder) Quality() int {
+	return e.jpeg.Quality()
+}
+
+func (e *ScreenEncoder) Codec() protocol.Codec {
+	return protocol.CodecScreen
+}
+
+func (e *ScreenEncoder) Encode(img *image.RGBA) ([]byte, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cols := (w + TileSize - 1) / TileSize
+	rows := (h + TileSize - 1) / TileSize
+
+	var flat, photos []protocol.Tile
+	photo := make([]bool, cols*rows)
+	var palette []uint32
+	for ty := range rows {
+		for tx := range cols {
+			r := image.Rect(tx*TileSize, ty*TileSize, (tx+1)*TileSize, (ty+1)*TileSize).Intersect(image.Rect(0, 0, w, h))
+			tile := img.SubImage(r.Add(b.Min)).(*image.RGBA)
+			t := protocol.Tile{X: uint16(r.Min.X), Y: uint16(r.Min.Y), W: uint16(r.Dx()), H: uint16(r.Dy())}
+
+			palette = tilePalette(tile, palette[:0])
+			slices.Sort(palette)
+			switch {
+			case len(palette) == 1:
+				t.Kind = protocol.TileSolid
+				t.Data = binary.BigEndian.AppendUint32(nil, palette[0])
+			case palette != nil:
+				t.Kind = protocol.TilePalette
+				t.Data = encodePalette(tile, palette, int(paletteBudget*float64(r.Dx()*r.Dy())))
+			}
+			if t.Data == nil {
+				photo[ty*cols+tx] = true
+				continue
+			}
+			flat = append(flat, t)
+		}
+	}
+
+	for _, r := range dirtyRects(photo, cols, rows) {
+		r = image.Rect(r.Min.X*TileSize, r.Min.Y*TileSize, r.Max.X*TileSize, r.Max.Y*TileSize).Intersect(image.Rect(0, 0, w, h))
+		data, err := e.jpeg.Encode(img.SubImage(r.Add(b.Min)).(*image.RGBA))
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, protocol.Tile{
+			X:    uint16(r.Min.X),
+			Y:    uint16(r.Min.Y),
+			W:    uint16(r.Dx()),
+			H:    uint16(r.Dy()),
+			Kind: protocol.TileJPEG,
+			Data: data,
+		})
+	}
+
+	var out bytes.Buffer
+	out.Write(binary.BigEndian.AppendUint16(nil, uint16(w)))
+	out.Write(binary.BigEndian.AppendUint16(nil, uint16(h)))
+	out.Write(make([]byte, 4)) // flat section length, set below
+	zw := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(zw)
+	zw.Reset(&out)
+	if _, err := zw.Write(protocol.AppendTiles(nil, flat)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	data := out.Bytes()
+	binary.BigEndian.PutUint32(data[4:], uint32(len(data)-protocol.ScreenHeaderSize))
+	return protocol.AppendTiles(data, photos), nil
+}
+
+// flateWriters holds compressors for the flat section, which are costly to
+// create.
+var flateWriters = sync.Pool{New: func() any {
+	zw, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return zw
+}}
+
+// tilePalette appends the distinct colors of tile, as big-endian RGBA, to
+// palette. It returns nil if there are more than
+// protocol.MaxPaletteColors.
+func tilePalette(tile *image.RGBA, palette []uint32) []uint32 {
+	b := tile.Bounds()
+	last := uint32(0)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := tile.Pix[tile.PixOffset(b.Min.X, y):tile.PixOffset(b.Max.X, y)]
+	pixels:
+		for i := 0; i < len(row); i += 4 {
+			c := binary.BigEndian.Uint32(row[i:])
+			// Most pixels repeat their left neighbour.
+			if c == last && len(palette) > 0 {
+				continue
+			}
+			last = c
+			for _, p := range palette {
+				if p == c {
+					continue pixels
+				}
+			}
+			if len(palette) == protocol.MaxPaletteColors {
+				return nil
+			}
+			palette = append(palette, c)
+		}
+	}
+	return palette
+}
+
+// encodePalette encodes tile as a protocol.TilePalette with the given
+// palette, or returns nil if that takes more than budget bytes or the
+// palette lacks one of the tile's colors.
+func encodePalette(tile *image.RGBA, palette []uint32, budget int) []byte {
+	out := make([]byte, 0, 1+4*len(palette)+budget/4)
+	out = append(out, byte(len(palette)))
+	for _, c := range palette {
+		out = binary.BigEndian.AppendUint32(out, c)
+	}
+
+	index := func(c uint32) (byte, bool) {
+		for i, p := range palette {
+			if p == c {
+				return byte(i), true
+			}
+		}
+		return 0, false
+	}
+	emit := func(idx byte, run int) {
+		out = append(out, idx)
+		out = binary.AppendUvarint(out, uint64(run-1))
+	}
+
+	b := tile.Bounds()
+	var cur uint32
+	var idx byte
+	run := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := tile.Pix[tile.PixOffset(b.Min.X, y):tile.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			c := binary.BigEndian.Uint32(row[i:])
+			if run > 0 && c == cur {
+				run++
+				continue
+			}
+			if run > 0 {
+				emit(idx, run)
+				if len(out) > budget {
+					return nil
+				}
+			}
+			i, ok := index(c)
+			if !ok {
+				return nil
+			}
+			cur, idx, run = c, i, 1
+		}
+	}
+	emit(idx, run)
+	if len(out) > budget {
+		return nil
+	}
+	return out
+}
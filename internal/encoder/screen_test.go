@@ -0,0 +1,117 @@
+package encoder
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/junsooki/AirMac/internal/decoder"
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// loadScreens reads the screenshots in testdata/screens: an editor, a
+// terminal and a dialog, with anti-aliased text.
+func loadScreens(t *testing.T) map[string]*image.RGBA {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "screens", "*.png"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("no screenshots in testdata/screens: %v", err)
+	}
+	screens := map[string]*image.RGBA{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+		screens[filepath.Base(path)] = rgba
+	}
+	return screens
+}
+
+// flatTiles returns the solid and palette tiles of a CodecScreen image.
+func flatTiles(t *testing.T, data []byte, w, h int) []protocol.Tile {
+	t.Helper()
+	n := binary.BigEndian.Uint32(data[4:])
+	zr := flate.NewReader(bytes.NewReader(data[protocol.ScreenHeaderSize:][:n]))
+	flat, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles, err := protocol.ParseTiles(flat, w, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tiles
+}
+
+// TestScreenEncoderScreenshots checks that the screen codec keeps text
+// exact for less than JPEG costs overall. Colored anti-aliased text leaves
+// a screenshot few tiles that fit a palette, so each may cost a little more
+// than JPEG.
+func TestScreenEncoderScreenshots(t *testing.T) {
+	var screenTotal, jpegTotal int
+	for name, img := range loadScreens(t) {
+		t.Run(name, func(t *testing.T) {
+			data, err := NewScreenEncoder(80).Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jpg, err := NewJPEGEncoder(80).Encode(img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("screen %d bytes, jpeg %d bytes", len(data), len(jpg))
+			screenTotal += len(data)
+			jpegTotal += len(jpg)
+			if len(data) > len(jpg)*5/4 {
+				t.Errorf("screen codec takes %d bytes, over 25%% more than JPEG's %d", len(data), len(jpg))
+			}
+
+			got, err := decoder.NewScreenDecoder().Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Rect != img.Rect {
+				t.Fatalf("decoded %v, want %v", got.Rect, img.Rect)
+			}
+			tiles := flatTiles(t, data, img.Rect.Dx(), img.Rect.Dy())
+			if len(tiles) == 0 {
+				t.Fatal("no solid or palette tiles")
+			}
+			for _, tile := range tiles {
+				r := image.Rect(int(tile.X), int(tile.Y), int(tile.X+tile.W), int(tile.Y+tile.H))
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					want := img.Pix[img.PixOffset(r.Min.X, y):img.PixOffset(r.Max.X, y)]
+					if !bytes.Equal(got.Pix[got.PixOffset(r.Min.X, y):got.PixOffset(r.Max.X, y)], want) {
+						t.Fatalf("%s tile at %v differs in row %d", tile.Kind, r, y)
+					}
+				}
+			}
+		})
+	}
+	if screenTotal >= jpegTotal {
+		t.Errorf("screen codec takes %d bytes in all, no less than JPEG's %d", screenTotal, jpegTotal)
+	}
+}
+
+func TestEncodePaletteMissingColor(t *testing.T) {
+	tile := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	tile.Pix[0] = 1
+	if data := encodePalette(tile, []uint32{0}, 1<<10); data != nil {
+		t.Fatalf("encoded a tile whose palette lacks a color: %x", data)
+	}
+}
@@ -0,0 +1,348 @@
+package encoder
+
+import (
+	"hash/maphash"
+	"image"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// TileSize is the edge length, in pixels, of the tiles frames are compared in.
+const TileSize = 64
+
+// fullFrameRatio is the fraction of changed tiles above which the whole
+// frame is sent instead, as one JPEG costs less than many small ones.
+const fullFrameRatio = 0.5
+
+// Refinement levels of a tile, i.e. how it was last sent.
+const (
+	levelBase     = iota // in the session's codec and quality
+	levelHQ              // at a higher quality
+	levelLossless        // losslessly
+	numLevels
+)
+
+// TileEncoder encodes frames as protocol.CodecTiles payloads holding only
+// the tiles that changed since the previous frame, as images of a
+// switchable codec. It sends a full frame
+// (keyframe) on the first call, when the size changes, every refresh
+// interval, and when asked to with RequestRefresh. Keyframes and large
+// changed regions are split into strips that are encoded in parallel.
+//
+// With refinement enabled, tiles that stop changing are re-sent at higher
+// quality in passes, so motion is cheap and static content ends up crisp.
+type TileEncoder struct {
+	enc     *ParallelEncoder
+	refresh time.Duration
+	seed    maphash.Seed
+
+	mu        sync.Mutex
+	hashes    []uint64
+	width     int
+	height    int
+	lastFull  time.Time
+	forceFull bool
+
+	// refineAfter is the number of unchanged frames before each refinement
+	// pass (0 = off). static counts each tile's unchanged frames and levels
+	// holds how it was last sent.
+	refineAfter int
+	refine      [numLevels]Encoder
+	static      []int
+	levels      []uint8
+}
+
+// NewTileEncoder creates a tile encoder that encodes tiles with enc, on up
+// to workers goroutines (0 = one per CPU). A refresh of 0 disables periodic
+// keyframes.
+func NewTileEncoder(enc Encoder, workers int, refresh time.Duration) *TileEncoder {
+	return &TileEncoder{
+		enc:     NewParallelEncoder(enc, workers),
+		refresh: refresh,
+		seed:    maphash.MakeSeed(),
+	}
+}
+
+// SetRefinement enables progressive refinement while the codec is lossy. A
+// tile unchanged for after frames is re-sent with hq, if that is of higher
+// quality than the current encoder, and after as many more frames with
+// lossless. Either may be nil to skip its pass; after 0 disables
+// refinement. A refined tile is not sent again until it changes.
+func (e *TileEncoder) SetRefinement(after int, hq, lossless Encoder) {
+	e.mu.Lock()
+	e.refineAfter = after
+	e.refine[levelHQ] = hq
+	e.refine[levelLossless] = lossless
+	e.mu.Unlock()
+}
+
+// RequestRefresh makes the next Encode send a keyframe.
+func (e *TileEncoder) RequestRefresh() {
+	e.mu.Lock()
+	e.forceFull = true
+	e.mu.Unlock()
+}
+
+// SetQuality sets the quality of tiles encoded from now on, if the codec
+// is lossy. Tiles already on the receiver keep their quality until they
+// change or the next keyframe replaces them.
+func (e *TileEncoder) SetQuality(quality int) {
+	e.enc.SetQuality(quality)
+}
+
+// Codec returns the image codec tiles are encoded with.
+func (e *TileEncoder) Codec() protocol.Codec {
+	return e.enc.Encoder().Codec()
+}
+
+// SetCodec switches the codec tiles are encoded with. The next frame is a
+// keyframe, so the whole picture is in the new codec.
+func (e *TileEncoder) SetCodec(enc Encoder) {
+	e.enc.SetEncoder(enc)
+	e.RequestRefresh()
+}
+
+// SkipUnchanged records a frame identical to the previous one without
+// encoding it, so it still counts towards refinement. It reports false,
+// recording nothing, if the frame must be passed to Encode anyway because
+// a keyframe was requested or tiles are due to be refined. Idle frames
+// don't bring the periodic keyframe forward.
+func (e *TileEncoder) SkipUnchanged() bool {
+	encs := e.encoders()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.hashes == nil || e.forceFull {
+		return false
+	}
+	for i := range e.static {
+		e.static[i]++
+		due := e.nextLevel(i, encs) != levelBase
+		e.static[i]--
+		if due {
+			return false
+		}
+	}
+	for i := range e.static {
+		e.static[i]++
+	}
+	return true
+}
+
+// Encode returns the payload for img and whether it is a keyframe. The
+// payload is nil if no tile needs to be sent.
+func (e *TileEncoder) Encode(img *image.RGBA) ([]byte, bool, error) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	cols := (w + TileSize - 1) / TileSize
+	rows := (h + TileSize - 1) / TileSize
+	hashes := e.hashTiles(img, cols, rows)
+	now := time.Now()
+	encs := e.encoders()
+
+	e.mu.Lock()
+	resized := e.hashes == nil || w != e.width || h != e.height
+	full := e.forceFull || resized ||
+		(e.refresh > 0 && now.Sub(e.lastFull) >= e.refresh)
+	if resized {
+		e.static = make([]int, len(hashes))
+		e.levels = make([]uint8, len(hashes))
+	}
+	dirty := make([]bool, len(hashes))
+	changed := 0
+	for i := range hashes {
+		if resized || hashes[i] != e.hashes[i] {
+			dirty[i] = true
+			changed++
+		}
+	}
+	full = full || float64(changed) > fullFrameRatio*float64(len(hashes))
+
+	// masks[l] marks the tiles to send at level l. A keyframe sends every
+	// tile at the level it is at, so refined tiles stay refined.
+	var masks [numLevels][]bool
+	for l := range masks {
+		masks[l] = make([]bool, len(hashes))
+	}
+	for i := range hashes {
+		if dirty[i] {
+			e.static[i], e.levels[i] = 0, levelBase
+			masks[levelBase][i] = true
+			continue
+		}
+		e.static[i]++
+		if encs[e.levels[i]] == nil {
+			// The pass for this level is off now, e.g. after a codec change.
+			e.levels[i] = levelBase
+		}
+		if l := e.nextLevel(i, encs); l != levelBase {
+			e.levels[i] = uint8(l)
+			masks[l][i] = true
+		} else if full {
+			masks[e.levels[i]][i] = true
+		}
+	}
+	e.hashes, e.width, e.height = hashes, w, h
+	e.forceFull = false
+	if full {
+		e.lastFull = now
+	}
+	e.mu.Unlock()
+	if !full && !slices.ContainsFunc(masks[:], func(m []bool) bool { return slices.Contains(m, true) }) {
+		return nil, false, nil
+	}
+
+	bounds := image.Rect(0, 0, w, h)
+	var tiles []protocol.Tile
+	for l, mask := range masks {
+		var rects []image.Rectangle
+		if full && l == levelBase && !slices.Contains(mask, false) {
+			rects = []image.Rectangle{bounds}
+		} else {
+			for _, r := range dirtyRects(mask, cols, rows) {
+				r = image.Rect(r.Min.X*TileSize, r.Min.Y*TileSize, r.Max.X*TileSize, r.Max.Y*TileSize)
+				rects = append(rects, r.Intersect(bounds))
+			}
+		}
+		if len(rects) == 0 {
+			continue
+		}
+		// With fewer regions than workers, split them into strips so every
+		// worker has something to encode.
+		if len(rects) < e.enc.Workers() {
+			var strips []image.Rectangle
+			for _, r := range rects {
+				strips = append(strips, e.enc.Strips(r, TileSize)...)
+			}
+			rects = strips
+		}
+
+		abs := make([]image.Rectangle, len(rects))
+		for i, r := range rects {
+			abs[i] = r.Add(b.Min)
+		}
+		data, err := e.enc.EncodeRectsWith(encs[l], img, abs)
+		if err != nil {
+			// The stored hashes already include this frame; make sure the
+			// controller gets it in full next time.
+			e.RequestRefresh()
+			return nil, false, err
+		}
+		for i, r := range rects {
+			tiles = append(tiles, protocol.Tile{
+				X:    uint16(r.Min.X),
+				Y:    uint16(r.Min.Y),
+				W:    uint16(r.Dx()),
+				H:    uint16(r.Dy()),
+				Kind: protocol.ImageTile(encs[l].Codec()),
+				Data: data[i],
+			})
+		}
+	}
+	return protocol.AppendTiles(nil, tiles), full, nil
+}
+
+// encoders returns the encoder for each refinement level, nil for passes
+// that are off. Refinement only applies while the codec is lossy, and the
+// HQ pass only while it is below the HQ encoder's quality.
+func (e *TileEncoder) encoders() [numLevels]Encoder {
+	base := e.enc.Encoder()
+	encs := [numLevels]Encoder{levelBase: base}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	q, lossy := base.(QualitySetter)
+	if e.refineAfter <= 0 || !lossy {
+		return encs
+	}
+	if hq, ok := e.refine[levelHQ].(QualitySetter); ok && hq.Quality() > q.Quality() {
+		encs[levelHQ] = e.refine[levelHQ]
+	}
+	encs[levelLossless] = e.refine[levelLossless]
+	return encs
+}
+
+// nextLevel returns the level tile i is due to be refined to, or levelBase
+// if none. e.mu must be held.
+func (e *TileEncoder) nextLevel(i int, encs [numLevels]Encoder) int {
+	// Each pass waits refineAfter frames after the one before it.
+	passes := 0
+	for l := levelBase + 1; l < numLevels; l++ {
+		if encs[l] == nil {
+			continue
+		}
+		passes++
+		if l <= int(e.levels[i]) {
+			continue
+		}
+		if e.static[i] >= passes*e.refineAfter {
+			return l
+		}
+		return levelBase
+	}
+	return levelBase
+}
+
+// hashTiles hashes each tile of img, in row-major tile order. It walks the
+// image row by row, feeding each row segment to its column's hash.
+func (e *TileEncoder) hashTiles(img *image.RGBA, cols, rows int) []uint64 {
+	b := img.Bounds()
+	hashes := make([]uint64, cols*rows)
+	hs := make([]maphash.Hash, cols)
+	for i := range hs {
+		hs[i].SetSeed(e.seed)
+	}
+
+	for ty := range rows {
+		for i := range hs {
+			hs[i].Reset()
+		}
+		y0 := b.Min.Y + ty*TileSize
+		y1 := min(y0+TileSize, b.Max.Y)
+		for y := y0; y < y1; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+			for tx := range cols {
+				x0 := tx * TileSize * 4
+				x1 := min(x0+TileSize*4, len(row))
+				hs[tx].Write(row[x0:x1])
+			}
+		}
+		for tx := range cols {
+			hashes[ty*cols+tx] = hs[tx].Sum64()
+		}
+	}
+	return hashes
+}
+
+// dirtyRects merges dirty tiles into rectangles, in tile units: runs of
+// dirty tiles along each row, extended downwards while the rows below have
+// the exact same run.
+func dirtyRects(dirty []bool, cols, rows int) []image.Rectangle {
+	type run struct{ x0, x1 int }
+	var rects []image.Rectangle
+	open := map[run]int{} // run -> index of the rect ending in the previous row
+	for y := range rows {
+		next := map[run]int{}
+		for x := 0; x < cols; {
+			if !dirty[y*cols+x] {
+				x++
+				continue
+			}
+			x0 := x
+			for x < cols && dirty[y*cols+x] {
+				x++
+			}
+			r := run{x0, x}
+			if i, ok := open[r]; ok {
+				rects[i].Max.Y = y + 1
+				next[r] = i
+			} else {
+				rects = append(rects, image.Rect(x0, y, x, y+1))
+				next[r] = len(rects) - 1
+			}
+		}
+		open = next
+	}
+	return rects
+}
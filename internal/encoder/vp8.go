@@ -0,0 +1,222 @@
+//go:build vpx
+
+package encoder
+
+/*
+#cgo pkg-config: vpx
+#include <stdlib.h>
+#include <string.h>
+#include <vpx/vpx_encoder.h>
+#include <vpx/vp8cx.h>
+
+static vpx_codec_err_t airmacEncInit(vpx_codec_ctx_t *ctx, unsigned int w, unsigned int h, int fps, unsigned int kbps) {
+	vpx_codec_enc_cfg_t cfg;
+	vpx_codec_err_t err = vpx_codec_enc_config_default(vpx_codec_vp8_cx(), &cfg, 0);
+	if (err != VPX_CODEC_OK) {
+		return err;
+	}
+	cfg.g_w = w;
+	cfg.g_h = h;
+	cfg.g_timebase.num = 1;
+	cfg.g_timebase.den = fps;
+	cfg.g_threads = 4;
+	cfg.g_lag_in_frames = 0;
+	cfg.g_error_resilient = VPX_ERROR_RESILIENT_DEFAULT;
+	cfg.rc_end_usage = VPX_CBR;
+	cfg.rc_target_bitrate = kbps;
+	cfg.rc_min_quantizer = 4;
+	cfg.rc_max_quantizer = 56;
+	cfg.kf_mode = VPX_KF_AUTO;
+	cfg.kf_max_dist = fps * 10;
+
+	err = vpx_codec_enc_init(ctx, vpx_codec_vp8_cx(), &cfg, 0);
+	if (err != VPX_CODEC_OK) {
+		return err;
+	}
+	// Fastest real-time preset; screen content compresses well regardless.
+	vpx_codec_control(ctx, VP8E_SET_CPUUSED, 10);
+	vpx_codec_control(ctx, VP8E_SET_SCREEN_CONTENT_MODE, 1);
+	return VPX_CODEC_OK;
+}
+
+// airmacEncode encodes one frame into out and returns its length, -1 on an
+// encoder error, or -2 if out is too small.
+static int airmacEncode(vpx_codec_ctx_t *ctx, vpx_image_t *img, vpx_codec_pts_t pts,
+		int forceKeyframe, unsigned char *out, int cap, int *keyframe) {
+	vpx_enc_frame_flags_t flags = forceKeyframe ? VPX_EFLAG_FORCE_KF : 0;
+	if (vpx_codec_encode(ctx, img, pts, 1, flags, VPX_DL_REALTIME) != VPX_CODEC_OK) {
+		return -1;
+	}
+	const vpx_codec_cx_pkt_t *pkt;
+	vpx_codec_iter_t iter = NULL;
+	int n = 0;
+	*keyframe = 0;
+	while ((pkt = vpx_codec_get_cx_data(ctx, &iter)) != NULL) {
+		if (pkt->kind != VPX_CODEC_CX_FRAME_PKT) {
+			continue;
+		}
+		if (n + (int)pkt->data.frame.sz > cap) {
+			return -2;
+		}
+		memcpy(out + n, pkt->data.frame.buf, pkt->data.frame.sz);
+		n += (int)pkt->data.frame.sz;
+		if (pkt->data.frame.flags & VPX_FRAME_IS_KEY) {
+			*keyframe = 1;
+		}
+	}
+	return n;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"sync"
+	"unsafe"
+)
+
+// VP8Available reports whether this build includes the libvpx VP8 codec.
+const VP8Available = true
+
+// VP8Encoder encodes frames as a VP8 stream using libvpx, tuned for
+// real-time screen content. It is re-initialized when the frame size
+// changes, starting again with a keyframe.
+type VP8Encoder struct {
+	fps  int
+	kbps int
+
+	mu       sync.Mutex
+	ctx      C.vpx_codec_ctx_t
+	img      *C.vpx_image_t
+	width    int
+	height   int
+	pts      int64
+	keyframe bool
+	out      []byte
+}
+
+// NewVP8Encoder creates a VP8 encoder for the given frame rate and target
+// bitrate in kbit/s.
+func NewVP8Encoder(fps, kbps int) (*VP8Encoder, error) {
+	if fps < 1 || kbps < 1 {
+		return nil, fmt.Errorf("vp8: invalid fps %d or bitrate %d", fps, kbps)
+	}
+	return &VP8Encoder{fps: fps, kbps: kbps}, nil
+}
+
+// RequestKeyframe makes the next Encode produce a keyframe, e.g. when the
+// receiver sent a PLI.
+func (e *VP8Encoder) RequestKeyframe() {
+	e.mu.Lock()
+	e.keyframe = true
+	e.mu.Unlock()
+}
+
+// KeyframePending reports whether a keyframe was requested and not yet
+// encoded.
+func (e *VP8Encoder) KeyframePending() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.keyframe
+}
+
+// Encode encodes img and reports whether the result is a keyframe.
+func (e *VP8Encoder) Encode(img *image.RGBA) ([]byte, bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if e.img == nil || w != e.width || h != e.height {
+		if err := e.reset(w, h); err != nil {
+			return nil, false, err
+		}
+	}
+	e.fillI420(img)
+
+	force := 0
+	if e.keyframe {
+		force = 1
+		e.keyframe = false
+	}
+	var keyframe C.int
+	n := C.airmacEncode(&e.ctx, e.img, C.vpx_codec_pts_t(e.pts), C.int(force),
+		(*C.uchar)(unsafe.Pointer(&e.out[0])), C.int(len(e.out)), &keyframe)
+	e.pts++
+	switch {
+	case n == -2:
+		return nil, false, fmt.Errorf("vp8: frame larger than %d bytes", len(e.out))
+	case n < 0:
+		return nil, false, fmt.Errorf("vp8: %s", C.GoString(C.vpx_codec_error(&e.ctx)))
+	}
+	return append([]byte(nil), e.out[:n]...), keyframe != 0, nil
+}
+
+// Close releases the libvpx encoder.
+func (e *VP8Encoder) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.release()
+}
+
+func (e *VP8Encoder) reset(w, h int) error {
+	e.release()
+	if err := C.airmacEncInit(&e.ctx, C.uint(w), C.uint(h), C.int(e.fps), C.uint(e.kbps)); err != C.VPX_CODEC_OK {
+		return fmt.Errorf("vp8 init: %s", C.GoString(C.vpx_codec_err_to_string(err)))
+	}
+	e.img = C.vpx_img_alloc(nil, C.VPX_IMG_FMT_I420, C.uint(w), C.uint(h), 16)
+	if e.img == nil {
+		C.vpx_codec_destroy(&e.ctx)
+		return fmt.Errorf("vp8: allocate %dx%d image", w, h)
+	}
+	e.width, e.height = w, h
+	e.pts = 0
+	e.out = make([]byte, w*h*3/2+64*1024)
+	return nil
+}
+
+func (e *VP8Encoder) release() {
+	if e.img == nil {
+		return
+	}
+	C.vpx_img_free(e.img)
+	C.vpx_codec_destroy(&e.ctx)
+	e.img = nil
+}
+
+// fillI420 converts img into the encoder's I420 image (BT.601, studio
+// range), averaging each 2x2 block for chroma.
+func (e *VP8Encoder) fillI420(img *image.RGBA) {
+	w, h := e.width, e.height
+	cw, ch := (w+1)/2, (h+1)/2
+	yStride, uStride, vStride := int(e.img.stride[0]), int(e.img.stride[1]), int(e.img.stride[2])
+	yPlane := unsafe.Slice((*byte)(unsafe.Pointer(e.img.planes[0])), yStride*h)
+	uPlane := unsafe.Slice((*byte)(unsafe.Pointer(e.img.planes[1])), uStride*ch)
+	vPlane := unsafe.Slice((*byte)(unsafe.Pointer(e.img.planes[2])), vStride*ch)
+
+	b := img.Bounds()
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			r, g, bl := int(row[4*x]), int(row[4*x+1]), int(row[4*x+2])
+			yPlane[y*yStride+x] = uint8((66*r+129*g+25*bl+128)>>8 + 16)
+		}
+	}
+	for cy := 0; cy < ch; cy++ {
+		for cx := 0; cx < cw; cx++ {
+			var r, g, bl, n int
+			for dy := 0; dy < 2 && 2*cy+dy < h; dy++ {
+				o := img.PixOffset(b.Min.X+2*cx, b.Min.Y+2*cy+dy)
+				for dx := 0; dx < 2 && 2*cx+dx < w; dx++ {
+					r += int(img.Pix[o+4*dx])
+					g += int(img.Pix[o+4*dx+1])
+					bl += int(img.Pix[o+4*dx+2])
+					n++
+				}
+			}
+			r, g, bl = r/n, g/n, bl/n
+			uPlane[cy*uStride+cx] = uint8((-38*r-74*g+112*bl+128)>>8 + 128)
+			vPlane[cy*vStride+cx] = uint8((112*r-94*g-18*bl+128)>>8 + 128)
+		}
+	}
+}
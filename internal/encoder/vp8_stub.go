@@ -0,0 +1,31 @@
+//go:build !vpx
+
+package encoder
+
+import (
+	"errors"
+	"image"
+)
+
+// VP8Available reports whether this build includes the libvpx VP8 codec.
+// Build with -tags vpx (and libvpx installed) to enable it.
+const VP8Available = false
+
+var errNoVP8 = errors.New("vp8: built without libvpx (use -tags vpx)")
+
+// VP8Encoder is unavailable in this build.
+type VP8Encoder struct{}
+
+func NewVP8Encoder(fps, kbps int) (*VP8Encoder, error) {
+	return nil, errNoVP8
+}
+
+func (e *VP8Encoder) RequestKeyframe() {}
+
+func (e *VP8Encoder) KeyframePending() bool { return false }
+
+func (e *VP8Encoder) Encode(img *image.RGBA) ([]byte, bool, error) {
+	return nil, false, errNoVP8
+}
+
+func (e *VP8Encoder) Close() {}
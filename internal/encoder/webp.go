@@ -0,0 +1,80 @@
+//go:build webp
+
+package encoder
+
+/*
+#cgo pkg-config: libwebp
+#include <webp/encode.h>
+
+// airmacWebPEncode encodes rgba losslessly with the fastest method. It
+// returns the size of *out, which the caller frees with WebPFree, or 0 on
+// failure.
+static size_t airmacWebPEncode(const uint8_t *rgba, int w, int h, int stride, uint8_t **out) {
+	WebPConfig config;
+	WebPPicture pic;
+	WebPMemoryWriter wr;
+	if (!WebPConfigInit(&config) || !WebPPictureInit(&pic)) {
+		return 0;
+	}
+	config.lossless = 1;
+	config.method = 0;
+	config.quality = 0; // for lossless, effort rather than fidelity
+	pic.use_argb = 1;
+	pic.width = w;
+	pic.height = h;
+	if (!WebPPictureImportRGBA(&pic, rgba, stride)) {
+		return 0;
+	}
+	WebPMemoryWriterInit(&wr);
+	pic.writer = WebPMemoryWrite;
+	pic.custom_ptr = &wr;
+	int ok = WebPEncode(&config, &pic);
+	WebPPictureFree(&pic);
+	if (!ok) {
+		WebPMemoryWriterClear(&wr);
+		return 0;
+	}
+	*out = wr.mem;
+	return wr.size;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"unsafe"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+func init() {
+	Register(protocol.CodecWebP, func(int) Encoder { return NewWebPEncoder() })
+}
+
+// WebPEncoder encodes frames as lossless WebP using libwebp. It compresses
+// text and UI better than PNG at a similar speed.
+type WebPEncoder struct{}
+
+func NewWebPEncoder() *WebPEncoder {
+	return &WebPEncoder{}
+}
+
+func (e *WebPEncoder) Codec() protocol.Codec {
+	return protocol.CodecWebP
+}
+
+func (e *WebPEncoder) Encode(img *image.RGBA) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, fmt.Errorf("webp: empty image")
+	}
+	var out *C.uint8_t
+	n := C.airmacWebPEncode((*C.uint8_t)(unsafe.Pointer(&img.Pix[img.PixOffset(b.Min.X, b.Min.Y)])),
+		C.int(b.Dx()), C.int(b.Dy()), C.int(img.Stride), &out)
+	if n == 0 {
+		return nil, fmt.Errorf("webp: encode %dx%d failed", b.Dx(), b.Dy())
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+	return C.GoBytes(unsafe.Pointer(out), C.int(n)), nil
+}
@@ -0,0 +1,181 @@
+package fec
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// window is how many recent messages are kept for reassembly. A message
+	// older than the newest by more than this is given up on.
+	window = 16
+	// ReportInterval is how often the decoder produces a loss report.
+	ReportInterval = time.Second
+)
+
+// Decoder reassembles messages from chunks, repairing losses from parity,
+// and counts lost chunks for loss reports.
+type Decoder struct {
+	mu       sync.Mutex
+	messages map[uint32]*message
+	newest   uint32
+	started  bool
+
+	expected   uint32
+	received   uint32
+	lastReport time.Time
+}
+
+// message is a message being reassembled.
+type message struct {
+	hdr     header
+	data    [][]byte
+	arrived []bool // data chunks received, as opposed to repaired
+	parity  [][]byte
+	have    int // data chunks present
+	got     int // chunks received, data and parity
+	done    bool
+}
+
+// NewDecoder returns an empty Decoder.
+func NewDecoder() *Decoder {
+	return &Decoder{messages: make(map[uint32]*message)}
+}
+
+// Add takes one chunk and returns the message it completes, if any. Each
+// message is returned at most once; chunks of messages too old to matter
+// are ignored.
+func (d *Decoder) Add(chunk []byte) ([]byte, error) {
+	h, payload, err := parseHeader(chunk)
+	if err != nil {
+		return nil, err
+	}
+	payload = append(make([]byte, 0, len(payload)), payload...)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.started || int32(h.id-d.newest) > 0 {
+		d.newest, d.started = h.id, true
+		d.evict()
+	} else if int32(d.newest-h.id) >= window {
+		return nil, nil
+	}
+
+	m := d.messages[h.id]
+	if m == nil {
+		m = &message{hdr: h, data: make([][]byte, h.count), arrived: make([]bool, h.count)}
+		if h.group > 0 {
+			m.parity = make([][]byte, groupCount(h.count, h.group))
+		}
+		d.messages[h.id] = m
+	} else if h.group != m.hdr.group || h.total != m.hdr.total {
+		return nil, fmt.Errorf("chunk: message %d changed shape", h.id)
+	}
+
+	var group int
+	switch h.kind {
+	case kindData:
+		if m.arrived[h.index] {
+			return nil, nil
+		}
+		m.arrived[h.index] = true
+		if m.data[h.index] == nil {
+			m.data[h.index] = payload
+			m.have++
+		}
+		if h.group > 0 {
+			group = h.index / h.group
+		}
+	case kindParity:
+		if m.parity[h.index] != nil {
+			return nil, nil
+		}
+		m.parity[h.index] = payload
+		group = h.index
+	}
+	m.got++
+
+	if m.done {
+		return nil, nil
+	}
+	if m.have < h.count && h.group > 0 {
+		m.repair(group)
+	}
+	if m.have < h.count {
+		return nil, nil
+	}
+	m.done = true
+	return m.assemble(), nil
+}
+
+// repair rebuilds the one missing data chunk of group g, if exactly one is
+// missing and the group's parity has arrived.
+func (m *message) repair(g int) {
+	if m.parity[g] == nil {
+		return
+	}
+	first := g * m.hdr.group
+	last := min(first+m.hdr.group, m.hdr.count)
+	missing := -1
+	for i := first; i < last; i++ {
+		if m.data[i] == nil {
+			if missing >= 0 {
+				return
+			}
+			missing = i
+		}
+	}
+	if missing < 0 {
+		return
+	}
+
+	rebuilt := append([]byte(nil), m.parity[g]...)
+	for i := first; i < last; i++ {
+		if i != missing {
+			xorInto(rebuilt, m.data[i])
+		}
+	}
+	m.data[missing] = rebuilt[:chunkLen(missing, m.hdr.total)]
+	m.have++
+}
+
+func (m *message) assemble() []byte {
+	out := make([]byte, 0, m.hdr.total)
+	for _, c := range m.data {
+		out = append(out, c...)
+	}
+	return out
+}
+
+// evict drops messages that fell out of the window, counting their chunks
+// for the next loss report.
+func (d *Decoder) evict() {
+	for id, m := range d.messages {
+		if int32(d.newest-id) < window {
+			continue
+		}
+		expected := m.hdr.count
+		if m.parity != nil {
+			expected += len(m.parity)
+		}
+		d.expected += uint32(expected)
+		d.received += uint32(m.got)
+		delete(d.messages, id)
+	}
+}
+
+// Report returns a loss report covering the chunks accounted for since the
+// previous one, or nil if it is not yet time for one.
+func (d *Decoder) Report(now time.Time) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastReport) < ReportInterval || d.expected == 0 {
+		return nil
+	}
+	r := appendReport(nil, d.expected, d.received)
+	d.expected, d.received = 0, 0
+	d.lastReport = now
+	return r
+}
@@ -0,0 +1,151 @@
+package fec
+
+import (
+	"bytes"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testMessage returns n bytes of deterministic noise.
+func testMessage(n int) []byte {
+	msg := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(msg)
+	return msg
+}
+
+// deliver adds chunks to d, skipping the indexes in drop, and returns the
+// messages completed.
+func deliver(t *testing.T, d *Decoder, chunks [][]byte, drop ...int) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for i, c := range chunks {
+		if slices.Contains(drop, i) {
+			continue
+		}
+		msg, err := d.Add(c)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", i, err)
+		}
+		if msg != nil {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		redundancy float64
+	}{
+		{"empty", 0, 0.25},
+		{"one byte", 1, 0.25},
+		{"one chunk", ChunkSize, 0.25},
+		{"short last chunk", ChunkSize + 1, 0.25},
+		{"many chunks", 10*ChunkSize + 17, 0.25},
+		{"no parity", 10*ChunkSize + 17, 0},
+		{"max parity", 10*ChunkSize + 17, MaxRedundancy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := testMessage(tt.size)
+			chunks := NewEncoder(tt.redundancy, false).Encode(msg)
+			for i, c := range chunks {
+				if !IsChunk(c) || len(c) > HeaderSize+ChunkSize {
+					t.Fatalf("chunk %d is %d bytes", i, len(c))
+				}
+			}
+			got := deliver(t, NewDecoder(), chunks)
+			if len(got) != 1 || !bytes.Equal(got[0], msg) {
+				t.Fatalf("got %d messages, want the %d-byte message once", len(got), len(msg))
+			}
+		})
+	}
+}
+
+func TestRepairOneLossPerGroup(t *testing.T) {
+	// 11 data chunks in groups of 4, the last one short, then 3 parity
+	// chunks at indexes 11-13.
+	msg := testMessage(10*ChunkSize + 17)
+	tests := []struct {
+		name string
+		drop []int
+	}{
+		{"first of each group", []int{0, 4, 8}},
+		{"last of each group", []int{3, 7, 10}},
+		{"short last chunk", []int{10}},
+		{"parity", []int{11, 12, 13}},
+		{"data and other parity", []int{1, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := NewEncoder(0.25, false).Encode(msg)
+			if len(chunks) != 14 {
+				t.Fatalf("%d chunks, want 14", len(chunks))
+			}
+			got := deliver(t, NewDecoder(), chunks, tt.drop...)
+			if len(got) != 1 || !bytes.Equal(got[0], msg) {
+				t.Fatalf("got %d messages, want the message repaired", len(got))
+			}
+		})
+	}
+}
+
+func TestNoRepairTwoLossesInGroup(t *testing.T) {
+	msg := testMessage(10*ChunkSize + 17)
+	tests := []struct {
+		name string
+		drop []int
+	}{
+		{"two data", []int{0, 1}},
+		{"data and its parity", []int{5, 12}},
+		{"short last chunk and its parity", []int{10, 13}},
+		{"whole group", []int{4, 5, 6, 7, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := NewEncoder(0.25, false).Encode(msg)
+			if got := deliver(t, NewDecoder(), chunks, tt.drop...); len(got) != 0 {
+				t.Fatalf("got %d messages from an unrepairable loss", len(got))
+			}
+		})
+	}
+}
+
+func TestStaleMessagesEvicted(t *testing.T) {
+	enc := NewEncoder(0, false)
+	d := NewDecoder()
+
+	// The first message loses one of its three chunks and can't be
+	// repaired.
+	stale := enc.Encode(testMessage(3 * ChunkSize))
+	if got := deliver(t, d, stale, 2); len(got) != 0 {
+		t.Fatal("incomplete message returned")
+	}
+	// window newer messages push it out.
+	for range window {
+		if got := deliver(t, d, enc.Encode(testMessage(10))); len(got) != 1 {
+			t.Fatal("single-chunk message not returned")
+		}
+	}
+	if len(d.messages) > window {
+		t.Fatalf("%d messages kept, window is %d", len(d.messages), window)
+	}
+	if got := deliver(t, d, stale[2:]); len(got) != 0 {
+		t.Fatal("evicted message completed by a late chunk")
+	}
+
+	expected, received, err := parseReport(d.Report(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected != 3 || received != 2 {
+		t.Fatalf("report says %d of %d chunks received, want 2 of 3", received, expected)
+	}
+	if d.Report(time.Now()) != nil {
+		t.Fatal("second report within the interval")
+	}
+}
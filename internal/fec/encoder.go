@@ -0,0 +1,133 @@
+package fec
+
+import (
+	"log"
+	"math"
+	"sync"
+)
+
+const (
+	// MaxRedundancy is one parity chunk per two data chunks.
+	MaxRedundancy = 0.5
+	// maxGroup is the largest group, i.e. the lowest nonzero redundancy.
+	maxGroup = 64
+	// lossPerGroup is the expected number of lost chunks per group the
+	// adaptive policy aims for. XOR parity repairs at most one.
+	lossPerGroup = 0.3
+)
+
+// Encoder splits messages into chunks with parity.
+type Encoder struct {
+	mu       sync.Mutex
+	id       uint32
+	floor    float64
+	adaptive bool
+	group    int
+	loss     float64
+}
+
+// NewEncoder returns an Encoder with the given redundancy (parity chunks per
+// data chunk, 0 to MaxRedundancy). If adaptive, redundancy is the floor and
+// the actual value follows the loss the receiver reports.
+func NewEncoder(redundancy float64, adaptive bool) *Encoder {
+	floor := min(max(redundancy, 0), MaxRedundancy)
+	return &Encoder{
+		floor:    floor,
+		adaptive: adaptive,
+		group:    groupSize(floor),
+	}
+}
+
+// groupSize maps a redundancy to a group size, 0 meaning no parity.
+func groupSize(redundancy float64) int {
+	if redundancy <= 0 {
+		return 0
+	}
+	return min(max(int(math.Round(1/redundancy)), 2), maxGroup)
+}
+
+// Redundancy returns the current parity chunks per data chunk.
+func (e *Encoder) Redundancy() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return redundancy(e.group)
+}
+
+// Loss returns the smoothed chunk loss the receiver reports, 0 to 1. It
+// stays 0 unless the encoder is adaptive.
+func (e *Encoder) Loss() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.loss
+}
+
+func redundancy(group int) float64 {
+	if group == 0 {
+		return 0
+	}
+	return 1 / float64(group)
+}
+
+// Encode splits msg into data chunks followed by the parity chunks.
+func (e *Encoder) Encode(msg []byte) [][]byte {
+	e.mu.Lock()
+	e.id++
+	id, group := e.id, e.group
+	e.mu.Unlock()
+
+	total := len(msg)
+	count := chunkCount(total)
+	h := header{group: group, id: id, count: count, total: total}
+
+	chunks := make([][]byte, 0, count+groupCount(count, max(group, 1)))
+	for i := range count {
+		payload := msg[i*ChunkSize : i*ChunkSize+chunkLen(i, total)]
+		h.kind, h.index = kindData, i
+		c := appendHeader(make([]byte, 0, HeaderSize+len(payload)), h)
+		chunks = append(chunks, append(c, payload...))
+	}
+	if group == 0 {
+		return chunks
+	}
+
+	for g := range groupCount(count, group) {
+		first := g * group
+		parity := make([]byte, chunkLen(first, total))
+		for i := first; i < min(first+group, count); i++ {
+			xorInto(parity, chunks[i][HeaderSize:])
+		}
+		h.kind, h.index = kindParity, g
+		c := appendHeader(make([]byte, 0, HeaderSize+len(parity)), h)
+		chunks = append(chunks, append(c, parity...))
+	}
+	return chunks
+}
+
+// HandleReport adjusts the redundancy to a loss report from the receiver.
+// Loss is tracked as a moving average that rises immediately and decays
+// slowly, so redundancy reacts to bursts without flapping.
+func (e *Encoder) HandleReport(data []byte) error {
+	expected, received, err := parseReport(data)
+	if err != nil {
+		return err
+	}
+	if !e.adaptive || expected == 0 {
+		return nil
+	}
+	loss := 1 - float64(received)/float64(expected)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if loss > e.loss {
+		e.loss = loss
+	} else {
+		e.loss = 0.8*e.loss + 0.2*loss
+	}
+	group := groupSize(max(e.loss/lossPerGroup, e.floor))
+	if group != e.group {
+		log.Printf("fec: loss %.1f%%, redundancy %.0f%% (was %.0f%%)",
+			100*e.loss, 100*redundancy(group), 100*redundancy(e.group))
+		e.group = group
+	}
+	return nil
+}
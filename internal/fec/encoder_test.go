@@ -0,0 +1,72 @@
+package fec
+
+import "testing"
+
+func TestHandleReportAdjustsGroup(t *testing.T) {
+	type report struct{ expected, received uint32 }
+	tests := []struct {
+		name      string
+		floor     float64
+		adaptive  bool
+		reports   []report
+		wantGroup int
+	}{
+		{"not adaptive", 0.25, false, []report{{100, 50}}, 4},
+		{"no loss keeps floor", 0.1, true, []report{{100, 100}}, 10},
+		{"no loss no floor", 0, true, []report{{100, 100}}, 0},
+		{"loss raises", 0, true, []report{{100, 90}}, 3},
+		{"floor above loss", 0.5, true, []report{{100, 99}}, 2},
+		{"heavy loss capped", 0, true, []report{{100, 50}}, 2},
+		{"decays slowly", 0, true, []report{{100, 90}, {100, 100}}, 4},
+		{"empty report ignored", 0, true, []report{{100, 90}, {0, 0}}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEncoder(tt.floor, tt.adaptive)
+			for _, r := range tt.reports {
+				if err := e.HandleReport(appendReport(nil, r.expected, r.received)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, want := e.Redundancy(), redundancy(tt.wantGroup); got != want {
+				t.Fatalf("redundancy %v, want %v", got, want)
+			}
+
+			// The next message uses the new group size.
+			const count = 12
+			chunks := e.Encode(testMessage(count * ChunkSize))
+			parity := 0
+			if tt.wantGroup > 0 {
+				parity = groupCount(count, tt.wantGroup)
+			}
+			if len(chunks) != count+parity {
+				t.Fatalf("%d chunks, want %d data and %d parity", len(chunks), count, parity)
+			}
+			for _, c := range chunks {
+				h, _, err := parseHeader(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.group != tt.wantGroup {
+					t.Fatalf("chunk group %d, want %d", h.group, tt.wantGroup)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleReportInvalid(t *testing.T) {
+	e := NewEncoder(0, true)
+	for _, data := range [][]byte{
+		nil,
+		appendReport(nil, 10, 11),
+		appendReport(nil, 10, 5)[:reportSize-1],
+	} {
+		if err := e.HandleReport(data); err == nil {
+			t.Errorf("report %x accepted", data)
+		}
+	}
+	if e.Redundancy() != 0 {
+		t.Fatal("invalid report changed redundancy")
+	}
+}
@@ -0,0 +1,159 @@
+// Package fec splits messages into chunks small enough to travel in a single
+// SCTP packet and adds XOR parity chunks, so a receiver can rebuild a message
+// despite losing some of its chunks.
+//
+// Data chunks are grouped k at a time and each group gets one parity chunk,
+// the XOR of its data chunks (zero-padded to equal length). Any one missing
+// chunk of a group can be rebuilt from the rest. The redundancy is 1/k; the
+// sender can raise or lower it as the receiver reports loss.
+package fec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ChunkSize is the maximum payload of a chunk. With the header it stays
+// under the usual 1200-byte SCTP payload limit.
+const ChunkSize = 1100
+
+// HeaderSize is the size of a chunk header.
+//
+// Wire layout (big-endian):
+//
+//	0      marker (0xFE)
+//	1      kind: 0 data, 1 parity
+//	2      group size k, 0 if the message has no parity
+//	3      reserved (0)
+//	4-7    message ID
+//	8-9    index: chunk index for data, group index for parity
+//	10-11  number of data chunks
+//	12-15  message length
+const HeaderSize = 16
+
+const (
+	chunkMarker  = 0xFE
+	reportMarker = 0xFD
+
+	kindData   = 0
+	kindParity = 1
+
+	// reportSize is a marker, then expected and received chunk counts.
+	reportSize = 9
+)
+
+// IsChunk reports whether data is a chunk rather than a whole message.
+func IsChunk(data []byte) bool {
+	return len(data) >= HeaderSize && data[0] == chunkMarker
+}
+
+// IsReport reports whether data is a loss report.
+func IsReport(data []byte) bool {
+	return len(data) == reportSize && data[0] == reportMarker
+}
+
+type header struct {
+	kind  byte
+	group int
+	id    uint32
+	index int
+	count int
+	total int
+}
+
+func appendHeader(dst []byte, h header) []byte {
+	var b [HeaderSize]byte
+	b[0] = chunkMarker
+	b[1] = h.kind
+	b[2] = byte(h.group)
+	binary.BigEndian.PutUint32(b[4:], h.id)
+	binary.BigEndian.PutUint16(b[8:], uint16(h.index))
+	binary.BigEndian.PutUint16(b[10:], uint16(h.count))
+	binary.BigEndian.PutUint32(b[12:], uint32(h.total))
+	return append(dst, b[:]...)
+}
+
+func parseHeader(data []byte) (header, []byte, error) {
+	if !IsChunk(data) {
+		return header{}, nil, fmt.Errorf("not a chunk")
+	}
+	h := header{
+		kind:  data[1],
+		group: int(data[2]),
+		id:    binary.BigEndian.Uint32(data[4:]),
+		index: int(binary.BigEndian.Uint16(data[8:])),
+		count: int(binary.BigEndian.Uint16(data[10:])),
+		total: int(binary.BigEndian.Uint32(data[12:])),
+	}
+	payload := data[HeaderSize:]
+
+	if h.kind != kindData && h.kind != kindParity {
+		return header{}, nil, fmt.Errorf("chunk: unknown kind %d", h.kind)
+	}
+	if h.count != chunkCount(h.total) {
+		return header{}, nil, fmt.Errorf("chunk: %d chunks for %d bytes", h.count, h.total)
+	}
+	switch h.kind {
+	case kindData:
+		if h.index >= h.count {
+			return header{}, nil, fmt.Errorf("chunk: index %d of %d", h.index, h.count)
+		}
+		if len(payload) != chunkLen(h.index, h.total) {
+			return header{}, nil, fmt.Errorf("chunk: %d bytes at index %d", len(payload), h.index)
+		}
+	case kindParity:
+		if h.group == 0 || h.index >= groupCount(h.count, h.group) {
+			return header{}, nil, fmt.Errorf("parity chunk: bad group %d", h.index)
+		}
+		if len(payload) != chunkLen(h.index*h.group, h.total) {
+			return header{}, nil, fmt.Errorf("parity chunk: %d bytes", len(payload))
+		}
+	}
+	return h, payload, nil
+}
+
+// chunkCount is the number of data chunks for a message of n bytes. Even an
+// empty message has one.
+func chunkCount(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return (n + ChunkSize - 1) / ChunkSize
+}
+
+// chunkLen is the length of data chunk i of a message of n bytes. It is
+// also the length of the parity chunk of a group starting at i, since only
+// the last chunk can be shorter.
+func chunkLen(i, n int) int {
+	return min(ChunkSize, n-i*ChunkSize)
+}
+
+func groupCount(count, group int) int {
+	return (count + group - 1) / group
+}
+
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+func appendReport(dst []byte, expected, received uint32) []byte {
+	var b [reportSize]byte
+	b[0] = reportMarker
+	binary.BigEndian.PutUint32(b[1:], expected)
+	binary.BigEndian.PutUint32(b[5:], received)
+	return append(dst, b[:]...)
+}
+
+func parseReport(data []byte) (expected, received uint32, err error) {
+	if !IsReport(data) {
+		return 0, 0, fmt.Errorf("not a loss report")
+	}
+	expected = binary.BigEndian.Uint32(data[1:])
+	received = binary.BigEndian.Uint32(data[5:])
+	if received > expected {
+		return 0, 0, fmt.Errorf("loss report: received %d of %d", received, expected)
+	}
+	return expected, received, nil
+}
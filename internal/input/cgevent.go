@@ -1,3 +1,5 @@
+//go:build darwin
+
 package input
 
 /*
@@ -71,6 +73,11 @@ func NewCGEventInjector() *CGEventInjector {
 	return &CGEventInjector{}
 }
 
+// NewInjector returns the platform's input injector.
+func NewInjector() (Injector, error) {
+	return NewCGEventInjector(), nil
+}
+
 func (inj *CGEventInjector) Inject(e *InputEvent) error {
 	flags := modifiersToFlags(e.Modifiers)
 
@@ -0,0 +1,158 @@
+package input
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Format is a wire format for input events.
+type Format string
+
+const (
+	// FormatJSON is the original format, always understood by hosts.
+	FormatJSON Format = "json"
+	// FormatBinary is the fixed-layout format described by BinaryEventSize.
+	FormatBinary Format = "binary"
+)
+
+// Formats lists the supported formats in order of preference.
+var Formats = []Format{FormatBinary, FormatJSON}
+
+// ChooseFormat picks the first offered format this side supports,
+// falling back to JSON.
+func ChooseFormat(offered []string) Format {
+	for _, o := range offered {
+		for _, f := range Formats {
+			if Format(o) == f {
+				return f
+			}
+		}
+	}
+	return FormatJSON
+}
+
+// BinaryEventSize is the size of an event in FormatBinary.
+//
+// Wire layout (big-endian):
+//
+//	0      event type code (see eventCodes)
+//	1      button
+//	2      modifiers
+//	3      stream
+//	4-7    sequence number
+//	8-11   x, float32
+//	12-15  y, float32
+//	16-19  scrollDX, float32
+//	20-23  scrollDY, float32
+//	24-25  key code
+//
+// The type code is never '{', so a receiver can tell the two formats apart
+// by the first byte.
+const BinaryEventSize = 26
+
+var eventCodes = map[EventType]byte{
+	EventMouseMove:   1,
+	EventMouseDown:   2,
+	EventMouseUp:     3,
+	EventMouseScroll: 4,
+	EventKeyDown:     5,
+	EventKeyUp:       6,
+}
+
+var eventTypes = map[byte]EventType{
+	1: EventMouseMove,
+	2: EventMouseDown,
+	3: EventMouseUp,
+	4: EventMouseScroll,
+	5: EventKeyDown,
+	6: EventKeyUp,
+}
+
+// EncodeEvent serializes e in format f.
+func EncodeEvent(e *InputEvent, f Format) ([]byte, error) {
+	if f == FormatBinary {
+		return e.MarshalBinary()
+	}
+	return json.Marshal(e)
+}
+
+// DecodeEvent parses an event in either format.
+func DecodeEvent(data []byte) (*InputEvent, error) {
+	var e InputEvent
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, err
+		}
+		return &e, nil
+	}
+	if err := e.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// MarshalBinary encodes e in FormatBinary.
+func (e *InputEvent) MarshalBinary() ([]byte, error) {
+	return e.AppendBinary(make([]byte, 0, BinaryEventSize))
+}
+
+// AppendBinary appends e in FormatBinary to b.
+func (e *InputEvent) AppendBinary(b []byte) ([]byte, error) {
+	code, ok := eventCodes[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown event type %q", e.Type)
+	}
+	var buf [BinaryEventSize]byte
+	buf[0] = code
+	buf[1] = byte(e.Button)
+	buf[2] = e.Modifiers
+	buf[3] = e.Stream
+	binary.BigEndian.PutUint32(buf[4:], e.Seq)
+	binary.BigEndian.PutUint32(buf[8:], math.Float32bits(float32(e.X)))
+	binary.BigEndian.PutUint32(buf[12:], math.Float32bits(float32(e.Y)))
+	binary.BigEndian.PutUint32(buf[16:], math.Float32bits(float32(e.ScrollDX)))
+	binary.BigEndian.PutUint32(buf[20:], math.Float32bits(float32(e.ScrollDY)))
+	binary.BigEndian.PutUint16(buf[24:], e.KeyCode)
+	return append(b, buf[:]...), nil
+}
+
+// UnmarshalBinary decodes an event in FormatBinary. It rejects anything
+// that could not have come from MarshalBinary, since input arrives from
+// the network.
+func (e *InputEvent) UnmarshalBinary(data []byte) error {
+	if len(data) != BinaryEventSize {
+		return fmt.Errorf("binary event: want %d bytes, got %d", BinaryEventSize, len(data))
+	}
+	typ, ok := eventTypes[data[0]]
+	if !ok {
+		return fmt.Errorf("binary event: unknown type code %d", data[0])
+	}
+	if data[1] > byte(MouseButtonMiddle) {
+		return fmt.Errorf("binary event: invalid button %d", data[1])
+	}
+
+	var coords [4]float64
+	for i := range coords {
+		v := math.Float32frombits(binary.BigEndian.Uint32(data[8+4*i:]))
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return fmt.Errorf("binary event: non-finite value")
+		}
+		coords[i] = float64(v)
+	}
+
+	*e = InputEvent{
+		Type:      typ,
+		Button:    MouseButton(data[1]),
+		Modifiers: data[2],
+		Stream:    data[3],
+		Seq:       binary.BigEndian.Uint32(data[4:]),
+		X:         coords[0],
+		Y:         coords[1],
+		ScrollDX:  coords[2],
+		ScrollDY:  coords[3],
+		KeyCode:   binary.BigEndian.Uint16(data[24:]),
+	}
+	return nil
+}
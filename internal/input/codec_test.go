@@ -0,0 +1,121 @@
+package input
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+var codecEvents = []InputEvent{
+	{Type: EventMouseMove, X: 0, Y: 0},
+	{Type: EventMouseMove, X: 3839, Y: 2159, Seq: 1, Stream: 1},
+	{Type: EventMouseMove, X: -1920.5, Y: -0.25, Seq: math.MaxUint32, Stream: 255},
+	{Type: EventMouseMove, X: math.MaxFloat32, Y: -math.MaxFloat32},
+	{Type: EventMouseDown, X: 10, Y: 20, Button: MouseButtonLeft, Modifiers: 1},
+	{Type: EventMouseDown, X: 10, Y: 20, Button: MouseButtonMiddle, Modifiers: 15},
+	{Type: EventMouseUp, X: 10, Y: 20, Button: MouseButtonRight, Modifiers: 255},
+	{Type: EventMouseScroll, X: 1, Y: 2, ScrollDX: -120, ScrollDY: 0.5, Modifiers: 8},
+	{Type: EventKeyDown, KeyCode: 0, Modifiers: 2},
+	{Type: EventKeyDown, KeyCode: math.MaxUint16, Modifiers: 4 | 8},
+	{Type: EventKeyUp, KeyCode: 53, Seq: 42},
+}
+
+func TestEventRoundTrip(t *testing.T) {
+	for _, f := range Formats {
+		for _, want := range codecEvents {
+			data, err := EncodeEvent(&want, f)
+			if err != nil {
+				t.Fatalf("%s: encode %+v: %v", f, want, err)
+			}
+			if f == FormatBinary && len(data) != BinaryEventSize {
+				t.Fatalf("binary event is %d bytes, want %d", len(data), BinaryEventSize)
+			}
+			got, err := DecodeEvent(data)
+			if err != nil {
+				t.Fatalf("%s: decode %+v: %v", f, want, err)
+			}
+			if *got != want {
+				t.Errorf("%s: got %+v, want %+v", f, *got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeEventRejects(t *testing.T) {
+	valid, err := (&InputEvent{Type: EventMouseDown, X: 1, Y: 2}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(f func(b []byte)) []byte {
+		b := bytes.Clone(valid)
+		f(b)
+		return b
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", valid[:BinaryEventSize-1]},
+		{"long", append(bytes.Clone(valid), 0)},
+		{"unknown type", with(func(b []byte) { b[0] = 0 })},
+		{"unknown type 7", with(func(b []byte) { b[0] = 7 })},
+		{"invalid button", with(func(b []byte) { b[1] = byte(MouseButtonMiddle) + 1 })},
+		{"NaN", with(func(b []byte) { binary.BigEndian.PutUint32(b[8:], math.Float32bits(float32(math.NaN()))) })},
+		{"infinity", with(func(b []byte) { binary.BigEndian.PutUint32(b[20:], math.Float32bits(float32(math.Inf(-1)))) })},
+		{"bad JSON", []byte(`{"type":`)},
+	} {
+		if e, err := DecodeEvent(tc.data); err == nil {
+			t.Errorf("%s: decoded %+v", tc.name, *e)
+		}
+	}
+
+	if _, err := EncodeEvent(&InputEvent{Type: "wheel"}, FormatBinary); err == nil {
+		t.Error("encoded an unknown event type")
+	}
+}
+
+// FuzzDecodeEvent checks that decoding never panics, and that whatever
+// decodes encodes back to the same event: byte for byte in FormatBinary.
+func FuzzDecodeEvent(f *testing.F) {
+	for _, e := range codecEvents {
+		for _, format := range Formats {
+			data, err := EncodeEvent(&e, format)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(data)
+		}
+	}
+	f.Add([]byte{})
+	f.Add([]byte{'{'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		e, err := DecodeEvent(data)
+		if err != nil {
+			return
+		}
+		if data[0] != '{' {
+			again, err := e.MarshalBinary()
+			if err != nil {
+				t.Fatalf("decoded %+v but can't encode it: %v", *e, err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Fatalf("%x decoded to %+v, which encodes to %x", data, *e, again)
+			}
+			return
+		}
+		again, err := EncodeEvent(e, FormatJSON)
+		if err != nil {
+			t.Fatalf("decoded %+v but can't encode it: %v", *e, err)
+		}
+		e2, err := DecodeEvent(again)
+		if err != nil {
+			t.Fatalf("%s doesn't decode: %v", again, err)
+		}
+		if *e2 != *e {
+			t.Fatalf("%s decoded to %+v, which round trips to %+v", data, *e, *e2)
+		}
+	})
+}
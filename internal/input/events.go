@@ -32,4 +32,9 @@ type InputEvent struct {
 	Modifiers uint8 `json:"modifiers,omitempty"`
 	ScrollDX  float64 `json:"scrollDX,omitempty"`
 	ScrollDY  float64 `json:"scrollDY,omitempty"`
+	// Seq increases by one per event sent by the controller.
+	Seq uint32 `json:"seq,omitempty"`
+	// Stream is the frame stream X and Y are on, for a host that captures
+	// several displays.
+	Stream uint8 `json:"stream,omitempty"`
 }
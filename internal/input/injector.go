@@ -0,0 +1,13 @@
+package input
+
+// Injector delivers controller input to the host.
+type Injector interface {
+	Inject(e *InputEvent) error
+}
+
+// NopInjector drops all input, for sources that aren't a screen.
+type NopInjector struct{}
+
+func (NopInjector) Inject(e *InputEvent) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package input
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// NewInjector reports that this platform has no input injector.
+func NewInjector() (Injector, error) {
+	return nil, fmt.Errorf("input injection is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,41 @@
+package input
+
+import "sync"
+
+// Reliable reports whether events of type t must go on the reliable input
+// lane. Only mouse moves go on the unreliable lane: a newer move supersedes
+// them, and every button event carries its own coordinates.
+func Reliable(t EventType) bool {
+	return t != EventMouseMove
+}
+
+// MoveFilter drops mouse moves that arrive after a newer positioned event,
+// which happens because the unreliable lane is unordered. Events with
+// Seq 0 (from controllers that don't number events) are always allowed.
+type MoveFilter struct {
+	mu   sync.Mutex
+	last uint32
+	seen bool
+}
+
+// Allow reports whether e should be injected.
+func (f *MoveFilter) Allow(e *InputEvent) bool {
+	if e.Seq == 0 {
+		return true
+	}
+	switch e.Type {
+	case EventMouseMove, EventMouseDown, EventMouseUp:
+	default:
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	newer := !f.seen || int32(e.Seq-f.last) > 0
+	if newer {
+		f.last = e.Seq
+		f.seen = true
+	}
+	// Button events are reliable and must never be dropped.
+	return newer || e.Type != EventMouseMove
+}
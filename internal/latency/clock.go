@@ -0,0 +1,68 @@
+package latency
+
+import (
+	"sync"
+	"time"
+)
+
+// clockSamples is how many recent ping exchanges the offset is chosen from.
+const clockSamples = 8
+
+// Clock estimates the offset between the host's clock and the local one from
+// NTP-style ping exchanges. Of the recent exchanges, the one with the lowest
+// round-trip time gives the offset, since it had the least queuing delay.
+type Clock struct {
+	mu      sync.Mutex
+	samples []clockSample
+}
+
+type clockSample struct {
+	offset time.Duration
+	rtt    time.Duration
+}
+
+// AddExchange records one exchange: origin and dest are the local send and
+// receive times, receive and transmit the host's receive and send times.
+func (c *Clock) AddExchange(origin, receive, transmit, dest time.Time) {
+	s := clockSample{
+		offset: (receive.Sub(origin) + transmit.Sub(dest)) / 2,
+		rtt:    dest.Sub(origin) - transmit.Sub(receive),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples = append(c.samples, s)
+	if len(c.samples) > clockSamples {
+		c.samples = c.samples[1:]
+	}
+}
+
+// Synced reports whether at least one exchange has completed.
+func (c *Clock) Synced() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.samples) > 0
+}
+
+// Offset returns the host clock minus the local clock, and the round-trip
+// time of the exchange it came from.
+func (c *Clock) Offset() (offset, rtt time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return 0, 0
+	}
+	best := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	return best.offset, best.rtt
+}
+
+// ToLocal converts a host timestamp to the local clock.
+func (c *Clock) ToLocal(host time.Time) time.Time {
+	offset, _ := c.Offset()
+	return host.Add(-offset)
+}
@@ -0,0 +1,135 @@
+package latency
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stage is one step of a frame's trip from the host's screen to the
+// controller's.
+type Stage int
+
+const (
+	StageCapture Stage = iota
+	StageEncode
+	StageNetwork
+	StageDecode
+	StagePresent
+	StageTotal
+	numStages
+)
+
+var stageNames = [numStages]string{"capture", "encode", "network", "decode", "present", "total"}
+
+func (s Stage) String() string {
+	if s < 0 || s >= numStages {
+		return fmt.Sprintf("stage(%d)", int(s))
+	}
+	return stageNames[s]
+}
+
+// Sample is the per-stage latency of one displayed frame. Network is only
+// meaningful once the clock is synced.
+type Sample struct {
+	Capture time.Duration
+	Encode  time.Duration
+	Network time.Duration
+	Decode  time.Duration
+	Present time.Duration
+}
+
+// Total is the end-to-end latency of the frame.
+func (s Sample) Total() time.Duration {
+	return s.Capture + s.Encode + s.Network + s.Decode + s.Present
+}
+
+func (s Sample) stage(st Stage) time.Duration {
+	switch st {
+	case StageCapture:
+		return s.Capture
+	case StageEncode:
+		return s.Encode
+	case StageNetwork:
+		return s.Network
+	case StageDecode:
+		return s.Decode
+	case StagePresent:
+		return s.Present
+	}
+	return s.Total()
+}
+
+// Percentiles is a latency distribution summary.
+type Percentiles struct {
+	P50, P95, P99, Max time.Duration
+}
+
+// Stats keeps the most recent samples and reports rolling percentiles.
+type Stats struct {
+	mu      sync.Mutex
+	samples []Sample
+	next    int
+	size    int
+}
+
+// NewStats returns a Stats that keeps the last size samples.
+func NewStats(size int) *Stats {
+	return &Stats{samples: make([]Sample, 0, size), size: size}
+}
+
+// Add records a sample, replacing the oldest once the window is full.
+func (s *Stats) Add(sample Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) < s.size {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % s.size
+}
+
+// Len returns the number of samples in the window.
+func (s *Stats) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.samples)
+}
+
+// Percentiles returns the distribution of one stage over the window.
+func (s *Stats) Percentiles(st Stage) Percentiles {
+	s.mu.Lock()
+	values := make([]time.Duration, len(s.samples))
+	for i, sample := range s.samples {
+		values[i] = sample.stage(st)
+	}
+	s.mu.Unlock()
+
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	slices.Sort(values)
+	at := func(p float64) time.Duration {
+		return values[int(p*float64(len(values)-1)+0.5)]
+	}
+	return Percentiles{P50: at(0.50), P95: at(0.95), P99: at(0.99), Max: values[len(values)-1]}
+}
+
+// String summarizes every stage as p50/p95/p99 in milliseconds, suitable
+// for logging.
+func (s *Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "latency over %d frames (p50/p95/p99 ms):", s.Len())
+	for st := Stage(0); st < numStages; st++ {
+		p := s.Percentiles(st)
+		fmt.Fprintf(&b, " %s %.1f/%.1f/%.1f", st, ms(p.P50), ms(p.P95), ms(p.P99))
+	}
+	return b.String()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
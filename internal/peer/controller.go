@@ -1,8 +1,12 @@
 package peer
 
 import (
+	"crypto/ecdh"
 	"encoding/json"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v4"
 
@@ -11,25 +15,39 @@ import (
 )
 
 // Controller manages the controller side of the WebRTC connection.
+// If ICE does not connect within ICEFailureTimeout, it falls back to
+// tunnelling the session through the WebSocket relay at relayURL.
 type Controller struct {
 	pc        *webrtc.PeerConnection
 	sig       *signaling.Client
-	transport *transport.DataChannelTransport
+	dc        *transport.DataChannelTransport
+	transport *transport.SwitchableTransport
 	hostID    string
+	relayURL  string
+
+	mu           sync.Mutex
+	connected    bool
+	fallbackOnce sync.Once
+	relayKey     *ecdh.PrivateKey
+	relaySession string
 }
 
-// NewController creates a Controller peer manager.
-func NewController(sig *signaling.Client, hostID string) (*Controller, error) {
+// NewController creates a Controller peer manager. An empty relayURL
+// disables the relay fallback.
+func NewController(sig *signaling.Client, hostID, relayURL string) (*Controller, error) {
 	pc, err := NewPeerConnection()
 	if err != nil {
 		return nil, err
 	}
 
+	dc := transport.NewDataChannelTransport(nil, nil)
 	ctrl := &Controller{
 		pc:        pc,
 		sig:       sig,
-		transport: transport.NewDataChannelTransport(nil, nil),
+		dc:        dc,
+		transport: transport.NewSwitchableTransport(dc),
 		hostID:    hostID,
+		relayURL:  relayURL,
 	}
 
 	// Accept data channels from the host.
@@ -40,12 +58,27 @@ func NewController(sig *signaling.Client, hostID string) (*Controller, error) {
 			dc.OnOpen(func() {
 				log.Println("frames data channel open")
 			})
-			ctrl.transport.SetFramesChannel(dc)
+			ctrl.dc.SetFramesChannel(dc)
 		case "input":
 			dc.OnOpen(func() {
 				log.Println("input data channel open")
 			})
-			ctrl.transport.SetInputChannel(dc)
+			ctrl.dc.SetInputChannel(dc)
+		case "moves":
+			dc.OnOpen(func() {
+				log.Println("moves data channel open")
+			})
+			ctrl.dc.SetMovesChannel(dc)
+		case "control":
+			dc.OnOpen(func() {
+				log.Println("control data channel open")
+			})
+			ctrl.dc.SetControlChannel(dc)
+		case "cursor":
+			dc.OnOpen(func() {
+				log.Println("cursor data channel open")
+			})
+			ctrl.dc.SetCursorChannel(dc)
 		}
 	})
 
@@ -62,14 +95,39 @@ func NewController(sig *signaling.Client, hostID string) (*Controller, error) {
 		_ = sig.SendICECandidate(hostID, data)
 	})
 
+	// Fall back to the relay if ICE gives up.
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		switch state {
+		case webrtc.ICEConnectionStateConnected:
+			ctrl.mu.Lock()
+			ctrl.connected = true
+			ctrl.mu.Unlock()
+		case webrtc.ICEConnectionStateFailed:
+			go ctrl.fallbackToRelay("ICE failed")
+		}
+	})
+
 	return ctrl, nil
 }
 
-// Transport returns the DataChannelTransport.
-func (c *Controller) Transport() *transport.DataChannelTransport {
+// Transport returns the transport for receiving frames and sending input.
+// It keeps working across a fallback to the relay.
+func (c *Controller) Transport() transport.Transport {
 	return c.transport
 }
 
+// EnableVideo offers to receive a VP8 track; the host sends one if it
+// supports it, otherwise frames keep arriving on the data channel. Must be
+// called before Connect.
+func (c *Controller) EnableVideo() error {
+	v, err := transport.NewRemoteVideoTrack(c.pc)
+	if err != nil {
+		return err
+	}
+	c.dc.SetVideo(v)
+	return nil
+}
+
 // Connect initiates the WebRTC connection by creating and sending an offer.
 func (c *Controller) Connect() error {
 	offer, err := c.pc.CreateOffer(nil)
@@ -86,7 +144,19 @@ func (c *Controller) Connect() error {
 		return err
 	}
 
-	return c.sig.SendOffer(c.hostID, offerJSON)
+	if err := c.sig.SendOffer(c.hostID, offerJSON); err != nil {
+		return err
+	}
+
+	time.AfterFunc(ICEFailureTimeout, func() {
+		c.mu.Lock()
+		connected := c.connected
+		c.mu.Unlock()
+		if !connected {
+			c.fallbackToRelay(fmt.Sprintf("ICE not connected after %s", ICEFailureTimeout))
+		}
+	})
+	return nil
 }
 
 // HandleAnswer processes an incoming SDP answer.
@@ -107,8 +177,70 @@ func (c *Controller) HandleICECandidate(payload json.RawMessage) error {
 	return c.pc.AddICECandidate(candidate)
 }
 
-// Close shuts down the peer connection.
+// HandleRelayAnswer completes the key exchange and joins the relay session.
+// The relay key is used for a single answer: dialing again with it would
+// restart the sequence numbers and reuse AES-GCM nonces, so duplicate or
+// replayed answers are rejected.
+func (c *Controller) HandleRelayAnswer(payload json.RawMessage) error {
+	var params RelayParams
+	if err := json.Unmarshal(payload, &params); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	key, session := c.relayKey, c.relaySession
+	if key == nil || params.Session != session {
+		c.mu.Unlock()
+		return fmt.Errorf("unexpected relay answer for session %q", params.Session)
+	}
+	c.relayKey = nil
+	c.mu.Unlock()
+
+	rt, err := transport.DialRelay(c.relayURL, session, transport.RelayRoleController, key, params.PublicKey)
+	if err != nil {
+		return err
+	}
+	c.transport.Switch(rt)
+	c.pc.Close()
+	log.Println("switched to WebSocket relay")
+	return nil
+}
+
+// fallbackToRelay offers the host a relay session. It runs at most once.
+func (c *Controller) fallbackToRelay(reason string) {
+	if c.relayURL == "" {
+		log.Printf("%s; relay fallback disabled", reason)
+		return
+	}
+	c.fallbackOnce.Do(func() {
+		log.Printf("%s; falling back to WebSocket relay", reason)
+
+		key, err := transport.NewRelayKey()
+		if err != nil {
+			log.Printf("relay key: %v", err)
+			return
+		}
+		session := newRelaySession()
+
+		c.mu.Lock()
+		c.relayKey = key
+		c.relaySession = session
+		c.mu.Unlock()
+
+		data, err := json.Marshal(RelayParams{Session: session, PublicKey: key.PublicKey().Bytes()})
+		if err != nil {
+			log.Printf("marshal relay offer: %v", err)
+			return
+		}
+		if err := c.sig.SendRelayOffer(c.hostID, data); err != nil {
+			log.Printf("send relay offer: %v", err)
+		}
+	})
+}
+
+// Close shuts down the peer connection and any relay session.
 func (c *Controller) Close() {
+	c.transport.Close()
 	if c.pc != nil {
 		c.pc.Close()
 	}
@@ -2,10 +2,12 @@ package peer
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 
 	"github.com/pion/webrtc/v4"
 
+	"github.com/junsooki/AirMac/internal/fec"
 	"github.com/junsooki/AirMac/internal/signaling"
 	"github.com/junsooki/AirMac/internal/transport"
 )
@@ -14,20 +16,25 @@ import (
 type Host struct {
 	pc        *webrtc.PeerConnection
 	sig       *signaling.Client
-	transport *transport.DataChannelTransport
+	dc        *transport.DataChannelTransport
+	transport *transport.SwitchableTransport
+	relayURL  string
 	peerID    string // the controller we're connected to
+	video     bool   // answer a video offer with a VP8 track
 }
 
-// NewHost creates a Host peer manager.
-func NewHost(sig *signaling.Client) (*Host, error) {
+// NewHost creates a Host peer manager. An empty relayURL makes the host
+// refuse relay sessions.
+func NewHost(sig *signaling.Client, relayURL string) (*Host, error) {
 	pc, err := NewPeerConnection()
 	if err != nil {
 		return nil, err
 	}
 
 	h := &Host{
-		pc:  pc,
-		sig: sig,
+		pc:       pc,
+		sig:      sig,
+		relayURL: relayURL,
 	}
 
 	// Create DataChannels (host is the offerer-side for DCs created here,
@@ -53,7 +60,43 @@ func NewHost(sig *signaling.Client) (*Host, error) {
 		return nil, err
 	}
 
-	h.transport = transport.NewDataChannelTransport(framesDC, inputDC)
+	movesOrdered := false
+	movesMaxRetransmits := uint16(0)
+	movesDC, err := pc.CreateDataChannel("moves", &webrtc.DataChannelInit{
+		Ordered:        &movesOrdered,
+		MaxRetransmits: &movesMaxRetransmits,
+	})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	controlOrdered := true
+	controlDC, err := pc.CreateDataChannel("control", &webrtc.DataChannelInit{
+		Ordered: &controlOrdered,
+	})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	// Pointer updates are retransmitted, since a lost shape would stick,
+	// but unordered so a lost position doesn't delay the next.
+	cursorOrdered := false
+	cursorDC, err := pc.CreateDataChannel("cursor", &webrtc.DataChannelInit{
+		Ordered: &cursorOrdered,
+	})
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	h.dc = transport.NewDataChannelTransport(framesDC, inputDC)
+	h.dc.SetMovesChannel(movesDC)
+	h.dc.SetControlChannel(controlDC)
+	h.dc.SetCursorChannel(cursorDC)
+	h.dc.SetPeerConnection(pc)
+	h.transport = transport.NewSwitchableTransport(h.dc)
 
 	// ICE candidate handling.
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
@@ -71,11 +114,24 @@ func NewHost(sig *signaling.Client) (*Host, error) {
 	return h, nil
 }
 
-// Transport returns the DataChannelTransport for sending frames and receiving input.
-func (h *Host) Transport() *transport.DataChannelTransport {
+// Transport returns the transport for sending frames and receiving input.
+// It keeps working if the controller moves the session to the relay.
+func (h *Host) Transport() transport.Transport {
 	return h.transport
 }
 
+// SetFEC enables forward error correction on the WebRTC frames channel.
+// The relay and QUIC transports are reliable and don't use it.
+func (h *Host) SetFEC(enc *fec.Encoder) {
+	h.dc.SetFEC(enc)
+}
+
+// EnableVideo makes the host send a VP8 track if the controller's offer
+// asks for video. Must be called before HandleOffer.
+func (h *Host) EnableVideo() {
+	h.video = true
+}
+
 // HandleOffer processes an incoming offer from a controller.
 func (h *Host) HandleOffer(from string, payload json.RawMessage) error {
 	h.peerID = from
@@ -89,6 +145,15 @@ func (h *Host) HandleOffer(from string, payload json.RawMessage) error {
 		return err
 	}
 
+	if h.video && offersVideo(h.pc) {
+		track, err := transport.NewLocalVideoTrack(h.pc)
+		if err != nil {
+			log.Printf("video track: %v; sending frames over the data channel", err)
+		} else {
+			h.dc.SetVideo(track)
+		}
+	}
+
 	answer, err := h.pc.CreateAnswer(nil)
 	if err != nil {
 		return err
@@ -106,6 +171,16 @@ func (h *Host) HandleOffer(from string, payload json.RawMessage) error {
 	return h.sig.SendAnswer(from, answerJSON)
 }
 
+// offersVideo reports whether the remote offer on pc includes video.
+func offersVideo(pc *webrtc.PeerConnection) bool {
+	for _, t := range pc.GetTransceivers() {
+		if t.Kind() == webrtc.RTPCodecTypeVideo {
+			return true
+		}
+	}
+	return false
+}
+
 // HandleICECandidate adds a remote ICE candidate.
 func (h *Host) HandleICECandidate(payload json.RawMessage) error {
 	var candidate webrtc.ICECandidateInit
@@ -115,8 +190,49 @@ func (h *Host) HandleICECandidate(payload json.RawMessage) error {
 	return h.pc.AddICECandidate(candidate)
 }
 
-// Close shuts down the peer connection.
+// HandleRelayOffer joins the relay session offered by the controller and
+// answers with the host's half of the key exchange.
+func (h *Host) HandleRelayOffer(from string, payload json.RawMessage) error {
+	if h.relayURL == "" {
+		return fmt.Errorf("relay disabled")
+	}
+	if from != h.peerID {
+		return fmt.Errorf("relay offer from %s, but connected to %s", from, h.peerID)
+	}
+
+	var params RelayParams
+	if err := json.Unmarshal(payload, &params); err != nil {
+		return err
+	}
+
+	key, err := transport.NewRelayKey()
+	if err != nil {
+		return err
+	}
+	rt, err := transport.DialRelay(h.relayURL, params.Session, transport.RelayRoleHost, key, params.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(RelayParams{Session: params.Session, PublicKey: key.PublicKey().Bytes()})
+	if err != nil {
+		rt.Close()
+		return err
+	}
+	if err := h.sig.SendRelayAnswer(from, data); err != nil {
+		rt.Close()
+		return err
+	}
+
+	h.transport.Switch(rt)
+	h.pc.Close()
+	log.Println("switched to WebSocket relay")
+	return nil
+}
+
+// Close shuts down the peer connection and any relay session.
 func (h *Host) Close() {
+	h.transport.Close()
 	if h.pc != nil {
 		h.pc.Close()
 	}
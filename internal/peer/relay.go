@@ -0,0 +1,24 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// ICEFailureTimeout is how long the controller waits for ICE to connect
+// before falling back to the WebSocket relay.
+var ICEFailureTimeout = 10 * time.Second
+
+// RelayParams is the signaling payload of relay-offer and relay-answer.
+// PublicKey is the sender's ephemeral X25519 key for the relay key exchange.
+type RelayParams struct {
+	Session   string `json:"session"`
+	PublicKey []byte `json:"publicKey"`
+}
+
+func newRelaySession() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
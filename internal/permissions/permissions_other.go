@@ -0,0 +1,13 @@
+//go:build !darwin
+
+package permissions
+
+// Other platforms have no permission prompts for screen capture and input.
+
+func HasScreenRecording() bool { return true }
+
+func RequestScreenRecording() bool { return true }
+
+func HasAccessibility() bool { return true }
+
+func RequestAccessibility() bool { return true }
@@ -0,0 +1,131 @@
+package privacy
+
+import "image"
+
+// fill paints r of img in fillColor.
+func fill(img *image.RGBA, r image.Rectangle) {
+	row := img.Pix[img.PixOffset(r.Min.X, r.Min.Y):][:r.Dx()*4]
+	for x := 0; x < len(row); x += 4 {
+		row[x], row[x+1], row[x+2], row[x+3] = fillColor.R, fillColor.G, fillColor.B, fillColor.A
+	}
+	for y := r.Min.Y + 1; y < r.Max.Y; y++ {
+		copy(img.Pix[img.PixOffset(r.Min.X, y):], row)
+	}
+}
+
+// blur blurs r of img. Blurring at full size would cost more the larger
+// the radius, so r is shrunk by averaging blocks of pixels, blurred with
+// blurPasses box blurs of smallRadius blocks, each run across the rows and
+// then down the columns, and scaled back up, interpolating between block
+// centres. Together the passes approach a Gaussian blur of about radius
+// pixels. Only pixels inside r are read, so nothing from outside bleeds in.
+func blur(img *image.RGBA, r image.Rectangle, radius int) {
+	block := max(radius/smallRadius, 1)
+	sw, sh := (r.Dx()+block-1)/block, (r.Dy()+block-1)/block
+	small := make([]uint8, sw*sh*4)
+	for sy := range sh {
+		y0, y1 := r.Min.Y+sy*block, min(r.Min.Y+(sy+1)*block, r.Max.Y)
+		for sx := range sw {
+			x0, x1 := r.Min.X+sx*block, min(r.Min.X+(sx+1)*block, r.Max.X)
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := img.Pix[img.PixOffset(x0, y):][:(x1-x0)*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			p := (sy*sw + sx) * 4
+			for c := range sum {
+				small[p+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	line := make([]uint8, max(sw, sh)*4)
+	for range blurPasses {
+		for sy := range sh {
+			boxLine(small[sy*sw*4:], 4, sw, smallRadius, line)
+		}
+		for sx := range sw {
+			boxLine(small[sx*4:], sw*4, sh, smallRadius, line)
+		}
+	}
+
+	xs := lerpSteps(r.Dx(), block, sw)
+	mid := make([]int, sw*4)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		// Blend the two rows of blocks around y, then along them.
+		ly := lerpAt(y-r.Min.Y, block, sh)
+		row0, row1 := small[ly.i0*sw*4:][:sw*4], small[ly.i1*sw*4:][:sw*4]
+		for i := range mid {
+			mid[i] = int(row0[i])*(256-ly.w) + int(row1[i])*ly.w
+		}
+		out := img.Pix[img.PixOffset(r.Min.X, y):][:r.Dx()*4]
+		for x, lx := range xs {
+			a, b := mid[lx.i0*4:][:4], mid[lx.i1*4:][:4]
+			o := out[x*4:][:4]
+			o[0] = uint8((a[0]*(256-lx.w) + b[0]*lx.w) >> 16)
+			o[1] = uint8((a[1]*(256-lx.w) + b[1]*lx.w) >> 16)
+			o[2] = uint8((a[2]*(256-lx.w) + b[2]*lx.w) >> 16)
+			o[3] = uint8((a[3]*(256-lx.w) + b[3]*lx.w) >> 16)
+		}
+	}
+}
+
+// lerp is a position between two blocks: i0 and i1 weighted by
+// (256-w)/256 and w/256.
+type lerp struct {
+	i0, i1, w int
+}
+
+// lerpAt places pixel p between the centres of blocks of size block, of
+// which there are n.
+func lerpAt(p, block, n int) lerp {
+	// In 1/256ths of a block, from the first block's centre.
+	f := (2*p+1)*128/block - 128
+	if f <= 0 {
+		return lerp{}
+	}
+	i := min(f/256, n-1)
+	return lerp{i0: i, i1: min(i+1, n-1), w: f % 256}
+}
+
+// lerpSteps returns lerpAt for each of the n pixels of a line.
+func lerpSteps(n, block, blocks int) []lerp {
+	out := make([]lerp, n)
+	for p := range out {
+		out[p] = lerpAt(p, block, blocks)
+	}
+	return out
+}
+
+// boxLine replaces each of the n pixels of a line, step bytes apart in
+// pix, with the average of the pixels within radius of it. The ends of the
+// line are repeated as far as needed. line is scratch space for n pixels.
+func boxLine(pix []uint8, step, n, radius int, line []uint8) {
+	for i := range n {
+		copy(line[i*4:i*4+4], pix[i*step:])
+	}
+	at := func(i int) int { return min(max(i, 0), n-1) * 4 }
+	var sum [4]int
+	for i := -radius; i <= radius; i++ {
+		p := at(i)
+		for c := range sum {
+			sum[c] += int(line[p+c])
+		}
+	}
+	width := 2*radius + 1
+	for i := range n {
+		for c := range sum {
+			pix[i*step+c] = uint8(sum[c] / width)
+		}
+		out, in := at(i-radius), at(i+radius+1)
+		for c := range sum {
+			sum[c] += int(line[in+c]) - int(line[out+c])
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package privacy
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/capture"
+)
+
+const (
+	// pollInterval is how often the window list and lock state are read
+	// again for Covers between frames. Frames read them again themselves.
+	pollInterval = 200 * time.Millisecond
+	// blurRadius is about how far, in points, the Blur style spreads each
+	// pixel. It blurs blurPasses times with a box of smallRadius blocks.
+	blurRadius  = 24
+	blurPasses  = 3
+	smallRadius = 2
+)
+
+// fillColor is what the Fill style paints, and the whole frame while the
+// screen is locked or the masked areas are unknown.
+var fillColor = color.RGBA{0x30, 0x30, 0x30, 0xff}
+
+// Masker redacts the areas its rules select from frames. Window, App and
+// Locked rules are followed by reading the window list and lock state
+// before each frame is masked, and polling them in between. While they
+// can't be read, everything is masked. It is safe for concurrent use.
+type Masker struct {
+	rules []Rule
+	style Style
+	// fixed are the areas of Rect rules.
+	fixed []image.Rectangle
+	// watchWindows and watchLock are set if there are rules that need the
+	// window list or lock state.
+	watchWindows bool
+	watchLock    bool
+
+	mu      sync.Mutex
+	windows []image.Rectangle
+	locked  bool
+	// stale is set while the window list or lock state can't be read.
+	stale bool
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMasker creates a masker for rules. If they need the window list or
+// lock state, it reads them once, failing if they can't be read, and then
+// polls them until Close.
+func NewMasker(rules []Rule, style Style) (*Masker, error) {
+	m := &Masker{rules: rules, style: style, done: make(chan struct{})}
+	for _, r := range rules {
+		switch r.Kind {
+		case Rect:
+			m.fixed = append(m.fixed, r.Rect)
+		case Window, App:
+			m.watchWindows = true
+		case Locked:
+			m.watchLock = true
+		}
+	}
+	if m.watchWindows || m.watchLock {
+		if err := m.update(); err != nil {
+			return nil, err
+		}
+		go m.poll()
+	}
+	return m, nil
+}
+
+// Close stops polling.
+func (m *Masker) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+}
+
+// poll keeps the masked windows and lock state up to date.
+func (m *Masker) poll() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		m.refresh()
+	}
+}
+
+// refresh reads the window list and lock state again if any rule needs
+// them, marking them stale if they can't be read.
+func (m *Masker) refresh() {
+	if !m.watchWindows && !m.watchLock {
+		return
+	}
+	err := m.update()
+	m.mu.Lock()
+	wasStale := m.stale
+	m.stale = err != nil
+	m.mu.Unlock()
+	if err != nil && !wasStale {
+		log.Printf("privacy mask: %v; masking everything until it can be read", err)
+	}
+}
+
+// update reads the window list and lock state.
+func (m *Masker) update() error {
+	var windows []image.Rectangle
+	if m.watchWindows {
+		list, err := capture.ListWindows()
+		if err != nil {
+			return fmt.Errorf("list windows: %w", err)
+		}
+		for _, w := range list {
+			for _, r := range m.rules {
+				if r.matches(w) {
+					windows = append(windows, w.Bounds)
+					break
+				}
+			}
+		}
+	}
+	locked := false
+	if m.watchLock {
+		var err error
+		if locked, err = capture.ScreenLocked(); err != nil {
+			return fmt.Errorf("lock state: %w", err)
+		}
+	}
+	m.mu.Lock()
+	m.windows, m.locked = windows, locked
+	m.mu.Unlock()
+	return nil
+}
+
+// areas returns the masked areas, or all if everything is.
+func (m *Masker) areas() (areas []image.Rectangle, all bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append(m.fixed[:len(m.fixed):len(m.fixed)], m.windows...), m.locked || m.stale
+}
+
+// Covers reports whether the point x, y, in the coordinates of
+// capture.DisplayInfo.Bounds, is masked.
+func (m *Masker) Covers(x, y float64) bool {
+	areas, all := m.areas()
+	if all {
+		return true
+	}
+	for _, r := range areas {
+		if x >= float64(r.Min.X) && x < float64(r.Max.X) && y >= float64(r.Min.Y) && y < float64(r.Max.Y) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply redacts the masked areas of img, a frame of display. A masked
+// window is covered whole, even where other windows overlap it.
+func (m *Masker) Apply(img *image.RGBA, display capture.DisplayInfo) {
+	b := img.Bounds()
+	areas, all := m.areas()
+	if all {
+		fill(img, b)
+		return
+	}
+	scale := display.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	for _, r := range areas {
+		// Round outwards, so no partly masked pixel is left.
+		px := image.Rect(
+			b.Min.X+int(math.Floor(float64(r.Min.X-display.Bounds.Min.X)*scale)),
+			b.Min.Y+int(math.Floor(float64(r.Min.Y-display.Bounds.Min.Y)*scale)),
+			b.Min.X+int(math.Ceil(float64(r.Max.X-display.Bounds.Min.X)*scale)),
+			b.Min.Y+int(math.Ceil(float64(r.Max.Y-display.Bounds.Min.Y)*scale)),
+		).Intersect(b)
+		if px.Empty() {
+			continue
+		}
+		if m.style == Blur {
+			blur(img, px, int(math.Ceil(blurRadius*scale)))
+		} else {
+			fill(img, px)
+		}
+	}
+}
+
+// Wrap returns a source passing on the frames of src with the masker
+// applied.
+func (m *Masker) Wrap(src capture.Source) *Source {
+	s := &Source{src: src, m: m, frameCh: make(chan *capture.Frame, 2)}
+	s.puller, _ = capture.As[capture.Puller](src)
+	return s
+}
+
+// Source passes on the frames of a source with a Masker applied, so
+// neither the encoders nor a recorder see the masked areas.
+type Source struct {
+	src     capture.Source
+	m       *Masker
+	frameCh chan *capture.Frame
+	// puller is the Puller of src, or nil if it has none.
+	puller capture.Puller
+}
+
+func (s *Source) Start() error {
+	if err := s.src.Start(); err != nil {
+		return err
+	}
+	go s.forward()
+	return nil
+}
+
+func (s *Source) Stop() {
+	s.src.Stop()
+}
+
+func (s *Source) Frames() <-chan *capture.Frame {
+	return s.frameCh
+}
+
+func (s *Source) Display() capture.DisplayInfo {
+	return s.src.Display()
+}
+
+// Unwrap returns the masked source.
+func (s *Source) Unwrap() capture.Source {
+	return s.src
+}
+
+// forward masks frames and passes them on until the source is stopped.
+// The masked areas are read again for each frame, so a window that moved
+// is masked where it is now.
+func (s *Source) forward() {
+	defer close(s.frameCh)
+	for f := range s.src.Frames() {
+		s.m.refresh()
+		s.m.Apply(f.Image, s.src.Display())
+		select {
+		case s.frameCh <- f:
+		default:
+			f.Release()
+			// The consumer never sees this frame, so it won't let a
+			// source in pull mode capture the next one.
+			if s.puller != nil {
+				s.puller.Next()
+			}
+		}
+	}
+}
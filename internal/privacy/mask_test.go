@@ -0,0 +1,106 @@
+package privacy
+
+import (
+	"image"
+	"sync/atomic"
+	"testing"
+
+	"github.com/junsooki/AirMac/internal/capture"
+)
+
+// pullSource is a source in pull mode whose frames are sent by the test.
+type pullSource struct {
+	frames chan *capture.Frame
+	nexts  atomic.Int32
+}
+
+func (s *pullSource) Start() error                  { return nil }
+func (s *pullSource) Stop()                         {}
+func (s *pullSource) Frames() <-chan *capture.Frame { return s.frames }
+func (s *pullSource) Display() capture.DisplayInfo {
+	return capture.DisplayInfo{Width: 8, Height: 8, Scale: 1}
+}
+func (s *pullSource) SetPull(bool) {}
+func (s *pullSource) Next()        { s.nexts.Add(1) }
+
+func TestSourceMasksFrames(t *testing.T) {
+	m, err := NewMasker([]Rule{{Kind: Rect, Rect: image.Rect(2, 2, 4, 4)}}, Fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	src := &pullSource{frames: make(chan *capture.Frame)}
+	s := m.Wrap(src)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	src.frames <- &capture.Frame{Image: img}
+	got := (<-s.Frames()).Image
+	for y := range 8 {
+		for x := range 8 {
+			masked := x >= 2 && x < 4 && y >= 2 && y < 4
+			if (got.RGBAAt(x, y) == fillColor) != masked {
+				t.Errorf("pixel %d,%d: %v, masked = %v", x, y, got.RGBAAt(x, y), masked)
+			}
+		}
+	}
+	close(src.frames)
+}
+
+// TestSourceDropLetsPullContinue checks that a frame the masking source
+// drops still lets the source capture the next one in pull mode.
+func TestSourceDropLetsPullContinue(t *testing.T) {
+	m, err := NewMasker(nil, Fill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	src := &pullSource{frames: make(chan *capture.Frame)}
+	s := m.Wrap(src)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing reads s.Frames, so the frames after the first two are
+	// dropped.
+	for range 5 {
+		src.frames <- &capture.Frame{Image: image.NewRGBA(image.Rect(0, 0, 8, 8))}
+	}
+	close(src.frames)
+	n := 0
+	for range s.Frames() {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("passed on %d frames, want 2", n)
+	}
+	if got := src.nexts.Load(); got != 3 {
+		t.Fatalf("Next called %d times for 3 dropped frames", got)
+	}
+}
+
+// TestMaskerStale checks that everything is masked while the masked
+// windows can't be read.
+func TestMaskerStale(t *testing.T) {
+	m, err := NewMasker(nil, Blur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.stale = true
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	m.Apply(img, capture.DisplayInfo{Width: 8, Height: 8, Scale: 1})
+	for y := range 8 {
+		for x := range 8 {
+			if img.RGBAAt(x, y) != fillColor {
+				t.Fatalf("pixel %d,%d not masked", x, y)
+			}
+		}
+	}
+	if !m.Covers(7, 7) {
+		t.Error("Covers is false while stale")
+	}
+}
@@ -0,0 +1,126 @@
+// Package privacy redacts parts of captured frames before they are
+// encoded: fixed areas of the screen, the windows of chosen applications,
+// and the whole screen while it is locked.
+package privacy
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/junsooki/AirMac/internal/capture"
+)
+
+// Kind is the kind of a Rule.
+type Kind int
+
+const (
+	// Rect masks a fixed area of the screen.
+	Rect Kind = iota
+	// Window masks the windows whose title contains Rule.Match.
+	Window
+	// App masks the windows of an application, matched by name, bundle ID
+	// or PID.
+	App
+	// Locked masks everything while the screen is locked.
+	Locked
+)
+
+// Rule is one redaction rule.
+type Rule struct {
+	Kind Kind
+	// Rect is the area a Rect rule masks, in the coordinates of
+	// capture.DisplayInfo.Bounds: points on macOS, pixels on X11.
+	Rect image.Rectangle
+	// Match is what a Window or App rule looks for.
+	Match string
+}
+
+// ParseRule parses "rect:X,Y,WxH", "window:TITLE", "app:NAME|BUNDLE|PID" or
+// "locked".
+func ParseRule(spec string) (Rule, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "rect":
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(arg, "%d,%d,%dx%d", &x, &y, &w, &h); err != nil || w <= 0 || h <= 0 {
+			return Rule{}, fmt.Errorf("invalid rect %q: want X,Y,WxH", arg)
+		}
+		return Rule{Kind: Rect, Rect: image.Rect(x, y, x+w, y+h)}, nil
+	case "window", "app":
+		if arg == "" {
+			return Rule{}, fmt.Errorf("%s rule needs a name (%s:NAME)", kind, kind)
+		}
+		if kind == "window" {
+			return Rule{Kind: Window, Match: arg}, nil
+		}
+		return Rule{Kind: App, Match: arg}, nil
+	case "locked":
+		if arg != "" {
+			return Rule{}, fmt.Errorf("locked rule takes no argument")
+		}
+		return Rule{Kind: Locked}, nil
+	}
+	return Rule{}, fmt.Errorf("unknown rule %q: want rect, window, app or locked", kind)
+}
+
+func (r Rule) String() string {
+	switch r.Kind {
+	case Rect:
+		return fmt.Sprintf("rect:%d,%d,%dx%d", r.Rect.Min.X, r.Rect.Min.Y, r.Rect.Dx(), r.Rect.Dy())
+	case Window:
+		return "window:" + r.Match
+	case App:
+		return "app:" + r.Match
+	case Locked:
+		return "locked"
+	}
+	return fmt.Sprintf("rule(%d)", int(r.Kind))
+}
+
+// matches reports whether a Window or App rule masks w.
+func (r Rule) matches(w capture.WindowInfo) bool {
+	switch r.Kind {
+	case Window:
+		return w.Title != "" && strings.Contains(strings.ToLower(w.Title), strings.ToLower(r.Match))
+	case App:
+		if pid, err := strconv.Atoi(r.Match); err == nil {
+			return w.PID == pid
+		}
+		return strings.EqualFold(w.App, r.Match) || w.Bundle != "" && strings.EqualFold(w.Bundle, r.Match)
+	}
+	return false
+}
+
+// Style selects how masked areas are drawn.
+type Style int
+
+const (
+	// Fill paints masked areas a solid color.
+	Fill Style = iota
+	// Blur blurs masked areas heavily, so their layout stays visible but
+	// text can't be read.
+	Blur
+)
+
+func (s Style) String() string {
+	switch s {
+	case Fill:
+		return "fill"
+	case Blur:
+		return "blur"
+	}
+	return fmt.Sprintf("style(%d)", int(s))
+}
+
+// ParseStyle returns the style with the given name.
+func ParseStyle(name string) (Style, error) {
+	switch name {
+	case "fill":
+		return Fill, nil
+	case "blur":
+		return Blur, nil
+	}
+	return 0, fmt.Errorf("unknown style %q (want fill or blur)", name)
+}
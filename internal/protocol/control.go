@@ -0,0 +1,76 @@
+package protocol
+
+// ControlType identifies a message on the control channel.
+type ControlType string
+
+const (
+	// ControlHello negotiates session options. The controller repeats it
+	// until the host answers with a hello carrying the options it picked.
+	ControlHello ControlType = "hello"
+	// ControlPing starts a clock-sync exchange; the controller sets Origin.
+	ControlPing ControlType = "ping"
+	// ControlPong answers a ping, echoing Origin and adding the host's
+	// Receive and Transmit times.
+	ControlPong ControlType = "pong"
+	// ControlRefresh asks the host to send the next frame of Stream in
+	// full, e.g. after the controller missed a delta frame.
+	ControlRefresh ControlType = "refresh"
+	// ControlCodec switches the image codec mid-session. The controller
+	// sends it to ask for Codec; the host sends it with the codec it uses
+	// from then on.
+	ControlCodec ControlType = "codec"
+	// ControlDisplay switches the display a stream captures mid-session.
+	// The controller sends it with the Stream and the Display it wants; the
+	// host answers with the Display that stream captures from then on, the
+	// current Displays and Streams.
+	ControlDisplay ControlType = "display"
+)
+
+// DisplayInfo describes one of the host's displays.
+type DisplayInfo struct {
+	ID   uint32 `json:"id"`
+	Name string `json:"name"`
+	// Width and Height are in pixels; Scale is pixels per point.
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Scale   float64 `json:"scale,omitempty"`
+	Primary bool    `json:"primary,omitempty"`
+}
+
+// ControlMessage is the JSON envelope for messages on the control channel.
+// Fields use omitempty; only those relevant to Type are present.
+type ControlMessage struct {
+	Type ControlType `json:"type"`
+
+	// InputFormats lists input wire formats in order of preference
+	// (controller), or the single chosen format (host).
+	InputFormats []string `json:"inputFormats,omitempty"`
+
+	// Codec is the image codec the controller wants (hello, codec; empty
+	// lets the host choose) or the one the host uses. Codecs lists those
+	// the controller can decode (hello).
+	Codec  string   `json:"codec,omitempty"`
+	Codecs []string `json:"codecs,omitempty"`
+
+	// Cursor is set by a controller that draws the pointer itself from
+	// the cursor channel (hello), and by a host that will send it there.
+	Cursor bool `json:"cursor,omitempty"`
+
+	// Display is the ID of the display the controller wants (display) or
+	// the host captures on Stream (hello, display). Displays lists those
+	// the host can switch between (hello, display); hosts that can't
+	// switch leave both out.
+	Display  uint32        `json:"display,omitempty"`
+	Displays []DisplayInfo `json:"displays,omitempty"`
+
+	// Stream is the frame stream a refresh or display message is about.
+	// Streams lists the display each stream captures, indexed by stream
+	// (hello, display); a host capturing one display may leave it out.
+	Stream  uint8    `json:"stream,omitempty"`
+	Streams []uint32 `json:"streams,omitempty"`
+
+	// Clock-sync timestamps in Unix nanoseconds (ping, pong).
+	Origin   int64 `json:"origin,omitempty"`
+	Receive  int64 `json:"receive,omitempty"`
+	Transmit int64 `json:"transmit,omitempty"`
+}
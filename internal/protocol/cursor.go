@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// CursorKind identifies a message on the cursor channel.
+type CursorKind uint8
+
+const (
+	// CursorKindPosition moves the pointer.
+	CursorKindPosition CursorKind = 1
+	// CursorKindShape changes the pointer image.
+	CursorKindShape CursorKind = 2
+)
+
+// CursorPositionSize is the encoded size of a position message.
+//
+// Cursor messages start with their kind. A position is, big-endian:
+//
+//	0      kind
+//	1-4    sequence number
+//	5-6    x
+//	7-8    y
+//	9-10   screen width
+//	11-12  screen height
+//	13     flags (bit 0: visible)
+//	14     stream
+//
+// x and y are in pixels of the captured screen, whose size is included so
+// the controller can place the pointer on a frame of any scale. stream is
+// the frame stream showing that screen; a host capturing several displays
+// sends the pointer on the one it is over.
+const CursorPositionSize = 15
+
+// CursorShapeHeaderSize is the encoded size of a shape message before its
+// image.
+//
+// A shape is, big-endian:
+//
+//	0      kind
+//	1-4    serial
+//	5-6    hotspot x
+//	7-8    hotspot y
+//	9      PNG image, in pixels of the captured screen
+//
+// The cursor channel may deliver messages out of order; receivers keep the
+// position with the newest sequence number and the shape with the newest
+// serial.
+const CursorShapeHeaderSize = 9
+
+// cursorVisible is the visible bit of a position's flags.
+const cursorVisible = 0x01
+
+// CursorMessage is a message on the cursor channel. Only the fields
+// relevant to Kind are used.
+type CursorMessage struct {
+	Kind CursorKind
+
+	// Position.
+	Seq                       uint32
+	X, Y                      uint16
+	ScreenWidth, ScreenHeight uint16
+	// Visible is false while the pointer is hidden or off the captured
+	// screen.
+	Visible bool
+	Stream  uint8
+
+	// Shape.
+	Serial             uint32
+	HotspotX, HotspotY uint16
+	Image              []byte
+}
+
+// AppendCursor appends an encoded cursor message to dst.
+func AppendCursor(dst []byte, m CursorMessage) []byte {
+	dst = append(dst, byte(m.Kind))
+	switch m.Kind {
+	case CursorKindPosition:
+		dst = binary.BigEndian.AppendUint32(dst, m.Seq)
+		dst = binary.BigEndian.AppendUint16(dst, m.X)
+		dst = binary.BigEndian.AppendUint16(dst, m.Y)
+		dst = binary.BigEndian.AppendUint16(dst, m.ScreenWidth)
+		dst = binary.BigEndian.AppendUint16(dst, m.ScreenHeight)
+		var flags byte
+		if m.Visible {
+			flags |= cursorVisible
+		}
+		dst = append(dst, flags, m.Stream)
+	case CursorKindShape:
+		dst = binary.BigEndian.AppendUint32(dst, m.Serial)
+		dst = binary.BigEndian.AppendUint16(dst, m.HotspotX)
+		dst = binary.BigEndian.AppendUint16(dst, m.HotspotY)
+		dst = append(dst, m.Image...)
+	}
+	return dst
+}
+
+// ParseCursor parses a cursor message. The image of a shape aliases data.
+func ParseCursor(data []byte) (CursorMessage, error) {
+	if len(data) == 0 {
+		return CursorMessage{}, errors.New("cursor: empty message")
+	}
+	m := CursorMessage{Kind: CursorKind(data[0])}
+	switch m.Kind {
+	case CursorKindPosition:
+		if len(data) != CursorPositionSize {
+			return CursorMessage{}, fmt.Errorf("cursor: position has %d bytes", len(data))
+		}
+		m.Seq = binary.BigEndian.Uint32(data[1:])
+		m.X = binary.BigEndian.Uint16(data[5:])
+		m.Y = binary.BigEndian.Uint16(data[7:])
+		m.ScreenWidth = binary.BigEndian.Uint16(data[9:])
+		m.ScreenHeight = binary.BigEndian.Uint16(data[11:])
+		m.Visible = data[13]&cursorVisible != 0
+		m.Stream = data[14]
+		if m.ScreenWidth == 0 || m.ScreenHeight == 0 {
+			return CursorMessage{}, errors.New("cursor: position on an empty screen")
+		}
+	case CursorKindShape:
+		if len(data) <= CursorShapeHeaderSize {
+			return CursorMessage{}, errors.New("cursor: shape truncated")
+		}
+		m.Serial = binary.BigEndian.Uint32(data[1:])
+		m.HotspotX = binary.BigEndian.Uint16(data[5:])
+		m.HotspotY = binary.BigEndian.Uint16(data[7:])
+		m.Image = data[CursorShapeHeaderSize:]
+	default:
+		return CursorMessage{}, fmt.Errorf("cursor: unknown kind %d", m.Kind)
+	}
+	return m, nil
+}
@@ -0,0 +1,178 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// FrameVersion is the current frame envelope version.
+const FrameVersion = 3
+
+// FrameHeaderSize is the encoded size of a FrameHeader.
+const FrameHeaderSize = 28
+
+// Codec identifies how a frame payload is encoded.
+type Codec uint8
+
+const (
+	CodecJPEG Codec = 1
+	// CodecTiles carries only the changed rectangles of the frame; see
+	// ParseTiles.
+	CodecTiles Codec = 2
+	// Lossless image codecs, for text-heavy screens.
+	CodecPNG  Codec = 3
+	CodecQOI  Codec = 4
+	CodecWebP Codec = 5 // WebP lossless
+	// CodecScreen mixes solid, palette and JPEG tiles; see ScreenHeaderSize.
+	CodecScreen Codec = 6
+)
+
+var codecNames = map[Codec]string{
+	CodecJPEG:   "jpeg",
+	CodecTiles:  "tiles",
+	CodecPNG:    "png",
+	CodecQOI:    "qoi",
+	CodecWebP:   "webp",
+	CodecScreen: "screen",
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// ParseCodec returns the codec with the given name, as printed by String.
+func ParseCodec(name string) (Codec, error) {
+	for c, n := range codecNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// FrameFlags is a bitfield describing a frame.
+type FrameFlags uint8
+
+const (
+	// FlagKeyframe marks a frame that decodes without any previous frame.
+	FlagKeyframe FrameFlags = 1 << 0
+	// FlagCursor marks a frame with the pointer drawn into the image.
+	FlagCursor FrameFlags = 1 << 1
+	// FlagIdle marks a heartbeat sent while the screen is unchanged: a
+	// tiles frame without tiles, which only advances the sequence number
+	// so the receiver can tell if anything before it was lost.
+	FlagIdle FrameFlags = 1 << 2
+)
+
+// FrameHeader is the envelope that precedes every payload on the frames
+// channel.
+//
+// Wire layout (big-endian):
+//
+//	0      version
+//	1      codec
+//	2      flags
+//	3      stream
+//	4-7    sequence number
+//	8-15   capture timestamp, Unix nanoseconds
+//	16-17  width
+//	18-19  height
+//	20-23  capture duration, microseconds
+//	24-27  encode duration, microseconds
+//
+// A host capturing several displays sends each as its own stream, with its
+// own sequence numbers; stream numbers index ControlMessage.Streams.
+//
+// The durations are measured on the host. Encode runs from Timestamp until
+// the frame is handed to the transport, so Timestamp+Encode is the send
+// time in the host's clock.
+type FrameHeader struct {
+	Version   uint8
+	Codec     Codec
+	Flags     FrameFlags
+	Stream    uint8
+	Seq       uint32
+	Timestamp time.Time
+	Width     uint16
+	Height    uint16
+	Capture   time.Duration
+	Encode    time.Duration
+}
+
+// AppendFrame appends the header for h followed by payload to dst.
+func AppendFrame(dst []byte, h FrameHeader, payload []byte) []byte {
+	var hdr [FrameHeaderSize]byte
+	hdr[0] = h.Version
+	hdr[1] = byte(h.Codec)
+	hdr[2] = byte(h.Flags)
+	hdr[3] = h.Stream
+	binary.BigEndian.PutUint32(hdr[4:], h.Seq)
+	binary.BigEndian.PutUint64(hdr[8:], uint64(h.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint16(hdr[16:], h.Width)
+	binary.BigEndian.PutUint16(hdr[18:], h.Height)
+	binary.BigEndian.PutUint32(hdr[20:], micros(h.Capture))
+	binary.BigEndian.PutUint32(hdr[24:], micros(h.Encode))
+	dst = append(dst, hdr[:]...)
+	return append(dst, payload...)
+}
+
+// ParseFrame splits data into its header and payload. The payload aliases data.
+func ParseFrame(data []byte) (FrameHeader, []byte, error) {
+	if len(data) < FrameHeaderSize {
+		return FrameHeader{}, nil, fmt.Errorf("frame too short: %d bytes", len(data))
+	}
+	h := FrameHeader{
+		Version:   data[0],
+		Codec:     Codec(data[1]),
+		Flags:     FrameFlags(data[2]),
+		Stream:    data[3],
+		Seq:       binary.BigEndian.Uint32(data[4:]),
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(data[8:]))),
+		Width:     binary.BigEndian.Uint16(data[16:]),
+		Height:    binary.BigEndian.Uint16(data[18:]),
+		Capture:   time.Duration(binary.BigEndian.Uint32(data[20:])) * time.Microsecond,
+		Encode:    time.Duration(binary.BigEndian.Uint32(data[24:])) * time.Microsecond,
+	}
+	if h.Version != FrameVersion {
+		return FrameHeader{}, nil, fmt.Errorf("unsupported frame version %d", h.Version)
+	}
+	return h, data[FrameHeaderSize:], nil
+}
+
+// FrameStream returns the stream of an encoded frame without parsing the
+// rest of it, or 0 if data is too short to be a frame.
+func FrameStream(data []byte) uint8 {
+	if len(data) < FrameHeaderSize {
+		return 0
+	}
+	return data[3]
+}
+
+// FrameKeyframe reports whether an encoded frame is a keyframe without
+// parsing the rest of it. It is false if data is too short to be a frame.
+func FrameKeyframe(data []byte) bool {
+	return len(data) >= FrameHeaderSize && FrameFlags(data[2])&FlagKeyframe != 0
+}
+
+// micros converts d to whole microseconds, clamped to the uint32 range.
+func micros(d time.Duration) uint32 {
+	us := d.Microseconds()
+	if us < 0 {
+		return 0
+	}
+	if us > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(us)
+}
+
+// SeqNewer reports whether sequence number a comes after b, allowing for
+// wrap-around.
+func SeqNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
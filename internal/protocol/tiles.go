@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// TileKind identifies how a tile's pixels are encoded.
+type TileKind uint8
+
+// Image tiles hold a rectangle encoded with an image codec, and use that
+// codec's ID as their kind.
+const (
+	TileJPEG   = TileKind(CodecJPEG)
+	TilePNG    = TileKind(CodecPNG)
+	TileQOI    = TileKind(CodecQOI)
+	TileWebP   = TileKind(CodecWebP)
+	TileScreen = TileKind(CodecScreen)
+)
+
+// Tiles of flat content, used inside CodecScreen images.
+const (
+	// TileSolid is a single color: 4 bytes, RGBA.
+	TileSolid TileKind = 0x80
+	// TilePalette is a palette of up to MaxPaletteColors RGBA colors and
+	// run-length coded indices:
+	//
+	//	0      palette size n
+	//	1      n × RGBA
+	//	1+4n   runs, row-major, until the tile is covered
+	//
+	// A run is a palette index byte followed by a uvarint holding the run
+	// length minus 1.
+	TilePalette TileKind = 0x81
+)
+
+// MaxPaletteColors is the largest palette a TilePalette can hold.
+const MaxPaletteColors = 255
+
+// ScreenHeaderSize is the encoded size of a CodecScreen image header.
+//
+// A CodecScreen image is, big-endian:
+//
+//	0-1    width
+//	2-3    height
+//	4-7    length n of the flat section
+//	8      flat section: a CodecTiles payload of TileSolid and
+//	       TilePalette tiles, deflate (RFC 1951) compressed
+//	8+n    a CodecTiles payload of TileJPEG tiles
+//
+// Tile positions are within the image. Compressing the flat tiles as one
+// stream lets glyphs repeated across tiles share matches.
+const ScreenHeaderSize = 8
+
+// ImageTile returns the kind of tiles encoded with c.
+func ImageTile(c Codec) TileKind {
+	return TileKind(c)
+}
+
+// Codec returns the image codec of an image tile, or false for other kinds.
+func (k TileKind) Codec() (Codec, bool) {
+	switch k {
+	case TileJPEG, TilePNG, TileQOI, TileWebP, TileScreen:
+		return Codec(k), true
+	}
+	return 0, false
+}
+
+func (k TileKind) String() string {
+	if c, ok := k.Codec(); ok {
+		return c.String()
+	}
+	switch k {
+	case TileSolid:
+		return "solid"
+	case TilePalette:
+		return "palette"
+	}
+	return fmt.Sprintf("tile(%d)", uint8(k))
+}
+
+// Tile is one updated rectangle of a CodecTiles frame.
+type Tile struct {
+	X, Y, W, H uint16
+	Kind       TileKind
+	Data       []byte
+}
+
+// TileHeaderSize is the encoded size of a tile header.
+//
+// A CodecTiles payload is a big-endian u16 tile count followed by that many
+// tiles, each a header and its data:
+//
+//	0-1    x
+//	2-3    y
+//	4-5    width
+//	6-7    height
+//	8      kind
+//	9-12   data length
+//
+// Tiles are drawn in order onto the previous frame; a keyframe's tiles
+// cover the whole frame.
+const TileHeaderSize = 13
+
+// AppendTiles appends a CodecTiles payload to dst.
+func AppendTiles(dst []byte, tiles []Tile) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(tiles)))
+	for _, t := range tiles {
+		var hdr [TileHeaderSize]byte
+		binary.BigEndian.PutUint16(hdr[0:], t.X)
+		binary.BigEndian.PutUint16(hdr[2:], t.Y)
+		binary.BigEndian.PutUint16(hdr[4:], t.W)
+		binary.BigEndian.PutUint16(hdr[6:], t.H)
+		hdr[8] = byte(t.Kind)
+		binary.BigEndian.PutUint32(hdr[9:], uint32(len(t.Data)))
+		dst = append(dst, hdr[:]...)
+		dst = append(dst, t.Data...)
+	}
+	return dst
+}
+
+// ParseTiles parses a CodecTiles payload for a frame of the given size.
+// Tile data aliases data.
+func ParseTiles(data []byte, width, height int) ([]Tile, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("tiles: payload too short")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+
+	tiles := make([]Tile, 0, n)
+	for i := range n {
+		if len(data) < TileHeaderSize {
+			return nil, fmt.Errorf("tiles: tile %d truncated", i)
+		}
+		t := Tile{
+			X:    binary.BigEndian.Uint16(data[0:]),
+			Y:    binary.BigEndian.Uint16(data[2:]),
+			W:    binary.BigEndian.Uint16(data[4:]),
+			H:    binary.BigEndian.Uint16(data[6:]),
+			Kind: TileKind(data[8]),
+		}
+		size := binary.BigEndian.Uint32(data[9:])
+		data = data[TileHeaderSize:]
+		if uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("tiles: tile %d data truncated", i)
+		}
+		if t.W == 0 || t.H == 0 || int(t.X)+int(t.W) > width || int(t.Y)+int(t.H) > height {
+			return nil, fmt.Errorf("tiles: tile %d (%d,%d %dx%d) outside %dx%d frame", i, t.X, t.Y, t.W, t.H, width, height)
+		}
+		t.Data = data[:size]
+		data = data[size:]
+		tiles = append(tiles, t)
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("tiles: %d trailing bytes", len(data))
+	}
+	return tiles, nil
+}
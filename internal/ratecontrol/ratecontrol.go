@@ -0,0 +1,185 @@
+// Package ratecontrol adapts encoder settings to the network. Each update
+// it compares the bitrate actually sent and the path's RTT, loss and send
+// queue against a target bitrate and latency budget, and steps quality,
+// frame rate and resolution down when over them or back up when there is
+// headroom.
+package ratecontrol
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	qualityStep = 10
+	scaleStep   = 0.25
+
+	// maxLoss is the loss above which the controller backs off.
+	maxLoss = 0.05
+	// headroom is the fraction of the target bitrate and latency budget
+	// that must be unused before stepping up.
+	headroom = 0.7
+	// upAfter is the number of consecutive updates with headroom needed
+	// before stepping up, so a short lull doesn't cause flapping.
+	upAfter = 3
+)
+
+// Settings are the encoder parameters the controller adjusts.
+type Settings struct {
+	Quality int
+	FPS     int
+	// Scale is the factor frames are downscaled by before encoding
+	// (1 = full size).
+	Scale float64
+}
+
+func (s Settings) String() string {
+	return fmt.Sprintf("quality %d, %d fps, scale %.0f%%", s.Quality, s.FPS, 100*s.Scale)
+}
+
+// Config bounds the controller. Max holds the best settings, which the
+// controller starts at; the Min fields are the lowest it goes.
+type Config struct {
+	// TargetKbps is the bitrate to stay under, in kbit/s (0 = none).
+	TargetKbps int
+	// LatencyBudget bounds half the RTT plus the time to drain the send
+	// queue (0 = none).
+	LatencyBudget time.Duration
+
+	Max        Settings
+	MinQuality int
+	MinFPS     int
+	MinScale   float64
+}
+
+// Network is a snapshot of the path frames are sent on. Zero fields are
+// unknown.
+type Network struct {
+	RTT      time.Duration
+	Loss     float64
+	Buffered uint64
+}
+
+// Controller chooses encoder settings. It is safe for concurrent use.
+type Controller struct {
+	cfg Config
+
+	mu    sync.Mutex
+	cur   Settings
+	bytes int
+	last  time.Time
+	clear int
+}
+
+// New returns a Controller starting at cfg.Max.
+func New(cfg Config) *Controller {
+	cfg.MinQuality = min(max(cfg.MinQuality, 1), cfg.Max.Quality)
+	cfg.MinFPS = min(max(cfg.MinFPS, 1), cfg.Max.FPS)
+	if cfg.Max.Scale <= 0 || cfg.Max.Scale > 1 {
+		cfg.Max.Scale = 1
+	}
+	cfg.MinScale = min(max(cfg.MinScale, scaleStep), cfg.Max.Scale)
+	return &Controller{cfg: cfg, cur: cfg.Max, last: time.Now()}
+}
+
+// Settings returns the current settings.
+func (c *Controller) Settings() Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cur
+}
+
+// AddFrame records an encoded frame of n bytes.
+func (c *Controller) AddFrame(n int) {
+	c.mu.Lock()
+	c.bytes += n
+	c.mu.Unlock()
+}
+
+// Update measures the bitrate sent since the previous update and adjusts
+// the settings to it and net. It returns the settings and whether they
+// changed; changes are logged with the measurements behind them.
+func (c *Controller) Update(now time.Time, net Network) (Settings, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elapsed := now.Sub(c.last).Seconds()
+	if elapsed <= 0 {
+		return c.cur, false
+	}
+	kbps := float64(c.bytes) * 8 / elapsed / 1000
+	c.bytes, c.last = 0, now
+
+	// Queued bytes drain at the target rate if there is one, otherwise at
+	// the rate we just measured.
+	drainKbps := float64(c.cfg.TargetKbps)
+	if drainKbps == 0 {
+		drainKbps = kbps
+	}
+	latency := net.RTT / 2
+	if net.Buffered > 0 && drainKbps > 0 {
+		latency += time.Duration(float64(net.Buffered) * 8 / drainKbps * float64(time.Millisecond))
+	}
+
+	target := float64(c.cfg.TargetKbps)
+	budget := c.cfg.LatencyBudget
+	var reason string
+	switch {
+	case net.Loss > maxLoss:
+		reason = fmt.Sprintf("loss %.1f%% > %.0f%%", 100*net.Loss, 100*maxLoss)
+	case budget > 0 && latency > budget:
+		reason = fmt.Sprintf("latency %v > budget %v", latency.Round(time.Millisecond), budget)
+	case target > 0 && kbps > target:
+		reason = fmt.Sprintf("%.0f kbit/s > target %.0f", kbps, target)
+	}
+
+	prev := c.cur
+	if reason != "" {
+		c.clear = 0
+		c.stepDown()
+	} else if (target == 0 || kbps < headroom*target) &&
+		(budget == 0 || latency < time.Duration(headroom*float64(budget))) {
+		c.clear++
+		if c.clear >= upAfter {
+			c.clear = 0
+			c.stepUp()
+			reason = "headroom"
+		}
+	} else {
+		c.clear = 0
+	}
+
+	if c.cur == prev {
+		return c.cur, false
+	}
+	log.Printf("ratecontrol: %s (was %s): %s; %.0f kbit/s, rtt %v, loss %.1f%%, queued %d B",
+		c.cur, prev, reason, kbps, net.RTT.Round(time.Millisecond), 100*net.Loss, net.Buffered)
+	return c.cur, true
+}
+
+// stepDown lowers quality first, as that costs the least, then frame rate,
+// then resolution.
+func (c *Controller) stepDown() {
+	switch {
+	case c.cur.Quality > c.cfg.MinQuality:
+		c.cur.Quality = max(c.cur.Quality-qualityStep, c.cfg.MinQuality)
+	case c.cur.FPS > c.cfg.MinFPS:
+		c.cur.FPS = max(c.cur.FPS*2/3, c.cfg.MinFPS)
+	case c.cur.Scale > c.cfg.MinScale:
+		c.cur.Scale = max(c.cur.Scale-scaleStep, c.cfg.MinScale)
+	}
+}
+
+// stepUp undoes stepDown in reverse order.
+func (c *Controller) stepUp() {
+	switch {
+	case c.cur.Scale < c.cfg.Max.Scale:
+		c.cur.Scale = min(c.cur.Scale+scaleStep, c.cfg.Max.Scale)
+	case c.cur.FPS < c.cfg.Max.FPS:
+		c.cur.FPS = min(max(c.cur.FPS*3/2, c.cur.FPS+1), c.cfg.Max.FPS)
+	case c.cur.Quality < c.cfg.Max.Quality:
+		c.cur.Quality = min(c.cur.Quality+qualityStep, c.cfg.Max.Quality)
+	}
+}
@@ -0,0 +1,55 @@
+package scale
+
+import "image"
+
+// box resizes img to the size of dst, averaging the source pixels that
+// fall in each output pixel, and returns dst.
+func box(dst, img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, bl, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := img.Pix[img.PixOffset(b.Min.X+x0, b.Min.Y+sy):]
+				for i := 0; i < 4*(x1-x0); i += 4 {
+					r += int(row[i])
+					g += int(row[i+1])
+					bl += int(row[i+2])
+					a += int(row[i+3])
+					n++
+				}
+			}
+			o := dst.PixOffset(x, y)
+			dst.Pix[o] = uint8(r / n)
+			dst.Pix[o+1] = uint8(g / n)
+			dst.Pix[o+2] = uint8(bl / n)
+			dst.Pix[o+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// half halves img into dst, which must be half its size, averaging each
+// 2x2 block with rounding, and returns dst. An odd last row or column is
+// dropped.
+func half(dst, img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	w, h := dst.Rect.Dx(), dst.Rect.Dy()
+	for y := 0; y < h; y++ {
+		r0 := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+2*y):][:8*w]
+		r1 := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+2*y+1):][:8*w]
+		out := dst.Pix[y*dst.Stride:][:4*w]
+		for x, s := 0, 0; x < len(out); x, s = x+4, s+8 {
+			out[x] = uint8((uint(r0[s]) + uint(r0[s+4]) + uint(r1[s]) + uint(r1[s+4]) + 2) >> 2)
+			out[x+1] = uint8((uint(r0[s+1]) + uint(r0[s+5]) + uint(r1[s+1]) + uint(r1[s+5]) + 2) >> 2)
+			out[x+2] = uint8((uint(r0[s+2]) + uint(r0[s+6]) + uint(r1[s+2]) + uint(r1[s+6]) + 2) >> 2)
+			out[x+3] = uint8((uint(r0[s+3]) + uint(r0[s+7]) + uint(r1[s+3]) + uint(r1[s+7]) + 2) >> 2)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,127 @@
+package scale
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// lanczosLobes is the kernel radius in output pixels.
+	lanczosLobes = 3
+	// weightBits is the fixed-point precision of filter weights.
+	weightBits = 14
+)
+
+// taps are the source pixels and fixed-point weights for one output pixel
+// along one axis.
+type taps struct {
+	start   int
+	weights []int32
+}
+
+// lanczosWeights holds the taps for both axes of one resize.
+type lanczosWeights struct {
+	sw, sh, dw, dh int
+	cols, rows     []taps
+}
+
+func newLanczosWeights(sw, sh, dw, dh int) *lanczosWeights {
+	return &lanczosWeights{
+		sw: sw, sh: sh, dw: dw, dh: dh,
+		cols: lanczosTaps(sw, dw),
+		rows: lanczosTaps(sh, dh),
+	}
+}
+
+func (l *lanczosWeights) matches(sw, sh, dw, dh int) bool {
+	return l.sw == sw && l.sh == sh && l.dw == dw && l.dh == dh
+}
+
+// lanczosTaps computes the taps mapping src pixels onto dst pixels. When
+// downscaling the kernel is stretched by the scale so every source pixel
+// contributes.
+func lanczosTaps(src, dst int) []taps {
+	scale := float64(src) / float64(dst)
+	stretch := max(scale, 1)
+	support := lanczosLobes * stretch
+	out := make([]taps, dst)
+	for i := range out {
+		center := (float64(i) + 0.5) * scale
+		start := max(int(math.Floor(center-support)), 0)
+		end := min(int(math.Ceil(center+support)), src)
+
+		ws := make([]float64, end-start)
+		var sum float64
+		for j := range ws {
+			ws[j] = lanczos3((float64(start+j) + 0.5 - center) / stretch)
+			sum += ws[j]
+		}
+		fixed := make([]int32, len(ws))
+		var total int32
+		peak := 0
+		for j, w := range ws {
+			fixed[j] = int32(math.Round(w / sum * (1 << weightBits)))
+			total += fixed[j]
+			if fixed[j] > fixed[peak] {
+				peak = j
+			}
+		}
+		// Make the weights sum to exactly one so flat areas stay flat.
+		fixed[peak] += 1<<weightBits - total
+		out[i] = taps{start: start, weights: fixed}
+	}
+	return out
+}
+
+func lanczos3(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	if x <= -lanczosLobes || x >= lanczosLobes {
+		return 0
+	}
+	px := math.Pi * x
+	return lanczosLobes * math.Sin(px) * math.Sin(px/lanczosLobes) / (px * px)
+}
+
+// lanczos resizes img into dst with the given weights: a horizontal pass
+// into tmp, which holds at least sh×dw pixels, then a vertical pass. It
+// returns dst.
+func lanczos(dst, img *image.RGBA, l *lanczosWeights, tmp []uint8) *image.RGBA {
+	b := img.Bounds()
+	for y := 0; y < l.sh; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		out := tmp[y*l.dw*4:]
+		for x, t := range l.cols {
+			var r, g, bl, a int32
+			for k, w := range t.weights {
+				p := row[4*(t.start+k):]
+				r += int32(p[0]) * w
+				g += int32(p[1]) * w
+				bl += int32(p[2]) * w
+				a += int32(p[3]) * w
+			}
+			o := 4 * x
+			out[o], out[o+1], out[o+2], out[o+3] = clamp(r), clamp(g), clamp(bl), clamp(a)
+		}
+	}
+
+	stride := l.dw * 4
+	for y, t := range l.rows {
+		out := dst.Pix[y*dst.Stride:]
+		for i := 0; i < stride; i++ {
+			var v int32
+			for k, w := range t.weights {
+				v += int32(tmp[(t.start+k)*stride+i]) * w
+			}
+			out[i] = clamp(v)
+		}
+	}
+	return dst
+}
+
+// clamp rounds a fixed-point value to 0-255.
+func clamp(v int32) uint8 {
+	v = (v + 1<<(weightBits-1)) >> weightBits
+	return uint8(min(max(v, 0), 255))
+}
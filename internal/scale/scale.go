@@ -0,0 +1,157 @@
+// Package scale resizes captured frames before encoding.
+package scale
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+)
+
+// Filter selects the resampling filter.
+type Filter int
+
+const (
+	// Box averages the source pixels covered by each output pixel. It is
+	// fast and sharp enough for integer factors.
+	Box Filter = iota
+	// Lanczos uses a 3-lobe Lanczos kernel, which keeps text crisper at
+	// fractional factors but costs several times more.
+	Lanczos
+)
+
+func (f Filter) String() string {
+	switch f {
+	case Box:
+		return "box"
+	case Lanczos:
+		return "lanczos"
+	}
+	return fmt.Sprintf("filter(%d)", int(f))
+}
+
+// ParseFilter returns the filter with the given name.
+func ParseFilter(name string) (Filter, error) {
+	switch name {
+	case "box":
+		return Box, nil
+	case "lanczos":
+		return Lanczos, nil
+	}
+	return 0, fmt.Errorf("unknown filter %q (want box or lanczos)", name)
+}
+
+// Scaler downscales frames by a factor, capped to a maximum width. Both
+// can be changed while it is in use. It never upscales.
+type Scaler struct {
+	filter Filter
+
+	mu       sync.Mutex
+	factor   float64
+	maxWidth int
+	// Lanczos weights for the last source and output sizes.
+	weights *lanczosWeights
+
+	// bufs holds the output of each pass of the last Scale call, and tmp
+	// the Lanczos intermediate, for reuse by the next one.
+	bufs []*image.RGBA
+	tmp  []uint8
+}
+
+// NewScaler creates a scaler. A factor of 1 and maxWidth of 0 leave frames
+// at their captured size.
+func NewScaler(filter Filter, factor float64, maxWidth int) *Scaler {
+	s := &Scaler{filter: filter}
+	s.SetFactor(factor)
+	s.SetMaxWidth(maxWidth)
+	return s
+}
+
+// SetFactor sets the scale factor (clamped to 0-1; 0 is treated as 1).
+func (s *Scaler) SetFactor(factor float64) {
+	if factor <= 0 || factor > 1 {
+		factor = 1
+	}
+	s.mu.Lock()
+	s.factor = factor
+	s.mu.Unlock()
+}
+
+// SetMaxWidth caps the output width (0 = no cap).
+func (s *Scaler) SetMaxWidth(width int) {
+	s.mu.Lock()
+	s.maxWidth = max(width, 0)
+	s.mu.Unlock()
+}
+
+// Size returns the output size for a w×h frame, further scaled by extra
+// (e.g. from rate control; 1 = none). The aspect ratio is kept.
+func (s *Scaler) Size(w, h int, extra float64) (int, int) {
+	s.mu.Lock()
+	factor, maxWidth := s.factor, s.maxWidth
+	s.mu.Unlock()
+
+	f := factor
+	if maxWidth > 0 && float64(w)*f > float64(maxWidth) {
+		f = float64(maxWidth) / float64(w)
+	}
+	if extra > 0 && extra < 1 {
+		f *= extra
+	}
+	if f >= 1 {
+		return w, h
+	}
+	return max(int(math.Round(float64(w)*f)), 1), max(int(math.Round(float64(h)*f)), 1)
+}
+
+// Scale returns img resized as given by Size, or img itself if the size is
+// unchanged. The result is only valid until the next call, which reuses
+// its buffer, so Scale must not be called concurrently.
+func (s *Scaler) Scale(img *image.RGBA, extra float64) *image.RGBA {
+	b := img.Bounds()
+	w, h := s.Size(b.Dx(), b.Dy(), extra)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+	// Halve while at least 2x too large: Retina to 1x is exactly one
+	// 2x2 average, whatever the filter, and larger reductions leave the
+	// filter at most a 2x step.
+	pass := 0
+	for b.Dx() >= 2*w && b.Dy() >= 2*h {
+		img = half(s.buf(pass, b.Dx()/2, b.Dy()/2), img)
+		b = img.Bounds()
+		pass++
+	}
+	if b.Dx() == w && b.Dy() == h {
+		return img
+	}
+	dst := s.buf(pass, w, h)
+	if s.filter == Lanczos {
+		s.mu.Lock()
+		if s.weights == nil || !s.weights.matches(b.Dx(), b.Dy(), w, h) {
+			s.weights = newLanczosWeights(b.Dx(), b.Dy(), w, h)
+		}
+		weights := s.weights
+		s.mu.Unlock()
+		if n := b.Dy() * w * 4; cap(s.tmp) < n {
+			s.tmp = make([]uint8, n)
+		}
+		return lanczos(dst, img, weights, s.tmp)
+	}
+	return box(dst, img)
+}
+
+// buf returns the reusable output image of the given pass, resized to w×h.
+// Its contents are undefined.
+func (s *Scaler) buf(pass, w, h int) *image.RGBA {
+	for len(s.bufs) <= pass {
+		s.bufs = append(s.bufs, nil)
+	}
+	r := image.Rect(0, 0, w, h)
+	if b := s.bufs[pass]; b != nil && cap(b.Pix) >= w*h*4 {
+		b.Pix, b.Stride, b.Rect = b.Pix[:w*h*4], w*4, r
+		return b
+	}
+	s.bufs[pass] = image.NewRGBA(r)
+	return s.bufs[pass]
+}
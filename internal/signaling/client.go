@@ -12,13 +12,15 @@ import (
 
 // Handler callbacks for incoming signaling messages.
 type Handler struct {
-	OnRegistered      func()
-	OnOffer           func(from string, payload json.RawMessage)
-	OnAnswer          func(from string, payload json.RawMessage)
-	OnICECandidate    func(from string, payload json.RawMessage)
-	OnHostsUpdated    func(hosts []HostInfo)
+	OnRegistered       func()
+	OnOffer            func(from string, payload json.RawMessage)
+	OnAnswer           func(from string, payload json.RawMessage)
+	OnICECandidate     func(from string, payload json.RawMessage)
+	OnHostsUpdated     func(hosts []HostInfo)
 	OnHostDisconnected func(hostID string)
-	OnError           func(msg string)
+	OnRelayOffer       func(from string, payload json.RawMessage)
+	OnRelayAnswer      func(from string, payload json.RawMessage)
+	OnError            func(msg string)
 }
 
 // Client is a WebSocket signaling client.
@@ -98,6 +100,16 @@ func (c *Client) SendICECandidate(target string, payload json.RawMessage) error
 	return c.send(Message{Type: TypeICECandidate, Target: target, Payload: payload})
 }
 
+// SendRelayOffer asks target to join a WebSocket relay session.
+func (c *Client) SendRelayOffer(target string, payload json.RawMessage) error {
+	return c.send(Message{Type: TypeRelayOffer, Target: target, Payload: payload})
+}
+
+// SendRelayAnswer accepts a relay session offered by target.
+func (c *Client) SendRelayAnswer(target string, payload json.RawMessage) error {
+	return c.send(Message{Type: TypeRelayAnswer, Target: target, Payload: payload})
+}
+
 // RequestHostList asks the server for available hosts.
 func (c *Client) RequestHostList() error {
 	return c.send(Message{Type: TypeListHosts})
@@ -148,6 +160,14 @@ func (c *Client) dispatch(msg Message) {
 		if c.handler.OnICECandidate != nil {
 			c.handler.OnICECandidate(msg.From, msg.Payload)
 		}
+	case TypeRelayOffer:
+		if c.handler.OnRelayOffer != nil {
+			c.handler.OnRelayOffer(msg.From, msg.Payload)
+		}
+	case TypeRelayAnswer:
+		if c.handler.OnRelayAnswer != nil {
+			c.handler.OnRelayAnswer(msg.From, msg.Payload)
+		}
 	case TypeHosts, TypeHostsUpdated:
 		if c.handler.OnHostsUpdated != nil {
 			c.handler.OnHostsUpdated(msg.List)
@@ -4,18 +4,20 @@ import "encoding/json"
 
 // Message types for signaling protocol.
 const (
-	TypeRegister     = "register"
-	TypeRegistered   = "registered"
-	TypeListHosts    = "list-hosts"
-	TypeHosts        = "hosts"
-	TypeHostsUpdated = "hosts-updated"
-	TypeOffer        = "offer"
-	TypeAnswer       = "answer"
-	TypeICECandidate = "ice-candidate"
-	TypePing         = "ping"
-	TypePong         = "pong"
-	TypeError        = "error"
+	TypeRegister         = "register"
+	TypeRegistered       = "registered"
+	TypeListHosts        = "list-hosts"
+	TypeHosts            = "hosts"
+	TypeHostsUpdated     = "hosts-updated"
+	TypeOffer            = "offer"
+	TypeAnswer           = "answer"
+	TypeICECandidate     = "ice-candidate"
+	TypePing             = "ping"
+	TypePong             = "pong"
+	TypeError            = "error"
 	TypeHostDisconnected = "host-disconnected"
+	TypeRelayOffer       = "relay-offer"
+	TypeRelayAnswer      = "relay-answer"
 )
 
 // ClientType distinguishes host from controller.
@@ -2,17 +2,37 @@ package transport
 
 import (
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/pion/webrtc/v4"
+
+	"github.com/junsooki/AirMac/internal/fec"
 )
 
 // DataChannelTransport implements frame and input transport over WebRTC DataChannels.
 type DataChannelTransport struct {
-	framesDC *webrtc.DataChannel
-	inputDC  *webrtc.DataChannel
+	framesDC  *webrtc.DataChannel
+	inputDC   *webrtc.DataChannel
+	movesDC   *webrtc.DataChannel
+	controlDC *webrtc.DataChannel
+	cursorDC  *webrtc.DataChannel
+
+	onFrame   func(data []byte)
+	onInput   func(data []byte)
+	onControl func(data []byte)
+	onCursor  func(data []byte)
+
+	// fecEnc chunks outgoing frames with parity when set; fecDec reassembles
+	// incoming chunked frames and reports loss back on the frames channel.
+	fecEnc *fec.Encoder
+	fecDec *fec.Decoder
 
-	onFrame func(data []byte)
-	onInput func(data []byte)
+	// video is the optional VP8 track negotiated with the channels.
+	video *VideoTrack
+
+	// pc is queried for the round-trip time in NetworkStats.
+	pc *webrtc.PeerConnection
 }
 
 // NewDataChannelTransport wraps two DataChannels (frames + input).
@@ -20,14 +40,11 @@ func NewDataChannelTransport(framesDC, inputDC *webrtc.DataChannel) *DataChannel
 	t := &DataChannelTransport{
 		framesDC: framesDC,
 		inputDC:  inputDC,
+		fecDec:   fec.NewDecoder(),
 	}
 
 	if framesDC != nil {
-		framesDC.OnMessage(func(msg webrtc.DataChannelMessage) {
-			if t.onFrame != nil {
-				t.onFrame(msg.Data)
-			}
-		})
+		framesDC.OnMessage(t.handleFramesMessage)
 	}
 
 	if inputDC != nil {
@@ -45,7 +62,15 @@ func (t *DataChannelTransport) SendFrame(data []byte) error {
 	if t.framesDC == nil {
 		return fmt.Errorf("frames data channel not set")
 	}
-	return t.framesDC.Send(data)
+	if t.fecEnc == nil {
+		return t.framesDC.Send(data)
+	}
+	for _, chunk := range t.fecEnc.Encode(data) {
+		if err := t.framesDC.Send(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (t *DataChannelTransport) SendInput(data []byte) error {
@@ -55,6 +80,27 @@ func (t *DataChannelTransport) SendInput(data []byte) error {
 	return t.inputDC.Send(data)
 }
 
+func (t *DataChannelTransport) SendMove(data []byte) error {
+	if t.movesDC == nil {
+		return fmt.Errorf("moves data channel not set")
+	}
+	return t.movesDC.Send(data)
+}
+
+func (t *DataChannelTransport) SendControl(data []byte) error {
+	if t.controlDC == nil {
+		return fmt.Errorf("control data channel not set")
+	}
+	return t.controlDC.Send(data)
+}
+
+func (t *DataChannelTransport) SendCursor(data []byte) error {
+	if t.cursorDC == nil {
+		return fmt.Errorf("cursor data channel not set")
+	}
+	return t.cursorDC.Send(data)
+}
+
 func (t *DataChannelTransport) OnFrame(cb func(data []byte)) {
 	t.onFrame = cb
 }
@@ -63,14 +109,119 @@ func (t *DataChannelTransport) OnInput(cb func(data []byte)) {
 	t.onInput = cb
 }
 
+func (t *DataChannelTransport) OnControl(cb func(data []byte)) {
+	t.onControl = cb
+}
+
+func (t *DataChannelTransport) OnCursor(cb func(data []byte)) {
+	t.onCursor = cb
+}
+
 // SetFramesChannel sets or replaces the frames DataChannel (used when receiving negotiated channels).
 func (t *DataChannelTransport) SetFramesChannel(dc *webrtc.DataChannel) {
 	t.framesDC = dc
-	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if t.onFrame != nil {
-			t.onFrame(msg.Data)
+	dc.OnMessage(t.handleFramesMessage)
+}
+
+// SetFEC makes SendFrame split frames into chunks with parity (see package
+// fec), so the receiver can rebuild frames despite some chunk loss on the
+// unreliable frames channel. Must be called before frames are sent.
+func (t *DataChannelTransport) SetFEC(enc *fec.Encoder) {
+	t.fecEnc = enc
+}
+
+// SetVideo attaches a video track negotiated on the same PeerConnection.
+func (t *DataChannelTransport) SetVideo(v *VideoTrack) {
+	t.video = v
+}
+
+// SetPeerConnection sets the PeerConnection the channels belong to, which
+// NetworkStats reads the round-trip time from.
+func (t *DataChannelTransport) SetPeerConnection(pc *webrtc.PeerConnection) {
+	t.pc = pc
+}
+
+// NetworkStats reports the RTT of the selected ICE candidate pair, the
+// frame loss seen by FEC, and the bytes queued on the frames channel.
+func (t *DataChannelTransport) NetworkStats() NetworkStats {
+	var st NetworkStats
+	if t.framesDC != nil {
+		st.Buffered = t.framesDC.BufferedAmount()
+	}
+	if t.fecEnc != nil {
+		st.Loss = t.fecEnc.Loss()
+	}
+	if t.pc != nil {
+		for _, s := range t.pc.GetStats() {
+			pair, ok := s.(webrtc.ICECandidatePairStats)
+			if ok && pair.Nominated && pair.State == webrtc.StatsICECandidatePairStateSucceeded {
+				st.RTT = time.Duration(pair.CurrentRoundTripTime * float64(time.Second))
+				break
+			}
 		}
-	})
+	}
+	return st
+}
+
+func (t *DataChannelTransport) VideoActive() bool {
+	return t.video != nil && t.video.VideoActive()
+}
+
+func (t *DataChannelTransport) WriteVideo(frame []byte, duration time.Duration) error {
+	if t.video == nil {
+		return errNoVideo
+	}
+	return t.video.WriteVideo(frame, duration)
+}
+
+func (t *DataChannelTransport) OnKeyframeRequest(cb func()) {
+	if t.video != nil {
+		t.video.OnKeyframeRequest(cb)
+	}
+}
+
+func (t *DataChannelTransport) OnVideo(cb func(frame []byte)) {
+	if t.video != nil {
+		t.video.OnVideo(cb)
+	}
+}
+
+func (t *DataChannelTransport) RequestKeyframe() error {
+	if t.video == nil {
+		return errNoVideo
+	}
+	return t.video.RequestKeyframe()
+}
+
+// handleFramesMessage handles both directions of the frames channel: whole
+// or chunked frames from the host, and loss reports from the controller.
+func (t *DataChannelTransport) handleFramesMessage(msg webrtc.DataChannelMessage) {
+	data := msg.Data
+	switch {
+	case fec.IsReport(data):
+		if t.fecEnc != nil {
+			if err := t.fecEnc.HandleReport(data); err != nil {
+				log.Printf("fec report: %v", err)
+			}
+		}
+		return
+	case fec.IsChunk(data):
+		frame, err := t.fecDec.Add(data)
+		if err != nil {
+			log.Printf("fec chunk: %v", err)
+			return
+		}
+		if report := t.fecDec.Report(time.Now()); report != nil {
+			t.framesDC.Send(report)
+		}
+		if frame == nil {
+			return
+		}
+		data = frame
+	}
+	if t.onFrame != nil {
+		t.onFrame(data)
+	}
 }
 
 // SetInputChannel sets or replaces the input DataChannel.
@@ -82,3 +233,44 @@ func (t *DataChannelTransport) SetInputChannel(dc *webrtc.DataChannel) {
 		}
 	})
 }
+
+// SetMovesChannel sets or replaces the unreliable input DataChannel. Its
+// messages are delivered to the input callback.
+func (t *DataChannelTransport) SetMovesChannel(dc *webrtc.DataChannel) {
+	t.movesDC = dc
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if t.onInput != nil {
+			t.onInput(msg.Data)
+		}
+	})
+}
+
+// SetControlChannel sets or replaces the control DataChannel.
+func (t *DataChannelTransport) SetControlChannel(dc *webrtc.DataChannel) {
+	t.controlDC = dc
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if t.onControl != nil {
+			t.onControl(msg.Data)
+		}
+	})
+}
+
+// SetCursorChannel sets or replaces the cursor DataChannel.
+func (t *DataChannelTransport) SetCursorChannel(dc *webrtc.DataChannel) {
+	t.cursorDC = dc
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if t.onCursor != nil {
+			t.onCursor(msg.Data)
+		}
+	})
+}
+
+// Close closes all DataChannels.
+func (t *DataChannelTransport) Close() error {
+	for _, dc := range []*webrtc.DataChannel{t.framesDC, t.inputDC, t.movesDC, t.controlDC, t.cursorDC} {
+		if dc != nil {
+			dc.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+const (
+	quicALPN = "airmac/1"
+
+	// maxQUICMessage bounds a single message read from a stream.
+	maxQUICMessage = 64 << 20
+
+	// Each stream starts with a kind byte. A single stream carries one
+	// channel byte and a payload up to EOF; a message stream carries a
+	// sequence of [channel][uint32 length][payload] records. Keyframes go
+	// on bidirectional single streams, which the receiver closes once it
+	// has read them.
+	quicStreamSingle   byte = 1
+	quicStreamMessages byte = 2
+
+	quicErrStale quic.StreamErrorCode = 1
+)
+
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:        15 * time.Second,
+	KeepAlivePeriod:       5 * time.Second,
+	MaxIncomingStreams:    100,
+	MaxIncomingUniStreams: 1000,
+	EnableDatagrams:       true,
+}
+
+// QUICTransport carries a session directly over QUIC, without WebRTC.
+// Each frame is sent on its own stream, and a newer frame cancels the
+// previous one of the same frame stream if it is still in flight, so stale
+// frames are dropped instead of retransmitted. Only a newer keyframe
+// cancels a keyframe: the frames after one wait until the receiver has
+// read it, so they neither cancel nor overtake it. Input, control and
+// cursor messages go over a single reliable stream in each direction, and
+// mouse moves as datagrams.
+type QUICTransport struct {
+	conn *quic.Conn
+
+	writeMu  sync.Mutex
+	msgs     *quic.SendStream       // lazily opened reliable message stream
+	frameOut map[uint8]quicFrameOut // previous frame of each stream
+
+	// Counters at the previous NetworkStats call, to measure recent loss.
+	statsMu  sync.Mutex
+	lastSent uint64
+	lastLost uint64
+
+	handlers
+}
+
+// quicFrameOut is a frame sent on a single stream.
+type quicFrameOut struct {
+	s interface{ CancelWrite(quic.StreamErrorCode) }
+	// acked is closed once the receiver has read a keyframe. It is nil
+	// for other frames.
+	acked chan struct{}
+}
+
+// QUICListener accepts direct sessions on the host.
+type QUICListener struct {
+	ln *quic.Listener
+}
+
+// ListenQUIC listens for direct sessions on addr using cert, whose
+// fingerprint controllers pin with DialQUIC. Only controllers presenting a
+// certificate whose fingerprint is in allowed can connect.
+func ListenQUIC(addr string, cert tls.Certificate, allowed []string) (*QUICListener, error) {
+	if len(allowed) == 0 {
+		return nil, errors.New("quic listen: no controller fingerprints allowed")
+	}
+	var allow [][]byte
+	for _, fp := range allowed {
+		b, err := parseFingerprint(fp)
+		if err != nil {
+			return nil, err
+		}
+		allow = append(allow, b)
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+		// Controller certificates are self-signed too; the allowlist takes
+		// the place of a CA.
+		ClientAuth: tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("controller sent no certificate")
+			}
+			got := sha256.Sum256(rawCerts[0])
+			for _, want := range allow {
+				if bytes.Equal(got[:], want) {
+					return nil
+				}
+			}
+			log.Printf("Rejected direct controller %x (not in -allow)", got)
+			return fmt.Errorf("controller certificate fingerprint %x is not allowed", got)
+		},
+	}
+	ln, err := quic.ListenAddr(addr, tlsConf, quicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("quic listen: %w", err)
+	}
+	return &QUICListener{ln: ln}, nil
+}
+
+// Accept waits for the next controller to connect.
+func (l *QUICListener) Accept(ctx context.Context) (*QUICTransport, error) {
+	conn, err := l.ln.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newQUICTransport(conn), nil
+}
+
+// Close stops listening.
+func (l *QUICListener) Close() error {
+	return l.ln.Close()
+}
+
+// DialQUIC connects to a host listening in direct mode, presenting cert
+// so the host can check it against its allowlist. pin is the hex SHA-256
+// fingerprint of the host certificate (colons are ignored).
+func DialQUIC(ctx context.Context, addr, pin string, cert tls.Certificate) (*QUICTransport, error) {
+	want, err := parseFingerprint(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+		// The certificate is self-signed; trust comes from the pin instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("host sent no certificate")
+			}
+			got := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(got[:], want) {
+				return fmt.Errorf("host certificate fingerprint %x does not match pin", got)
+			}
+			return nil
+		},
+	}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, quicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("quic dial: %w", err)
+	}
+	return newQUICTransport(conn), nil
+}
+
+func newQUICTransport(conn *quic.Conn) *QUICTransport {
+	t := &QUICTransport{conn: conn, frameOut: map[uint8]quicFrameOut{}}
+	go t.acceptLoop()
+	go t.acceptBidiLoop()
+	go t.datagramLoop()
+	return t
+}
+
+// RemoteAddr returns the address of the other end.
+func (t *QUICTransport) RemoteAddr() string {
+	return t.conn.RemoteAddr().String()
+}
+
+// Done is closed when the connection ends.
+func (t *QUICTransport) Done() <-chan struct{} {
+	return t.conn.Context().Done()
+}
+
+func (t *QUICTransport) SendFrame(data []byte) error {
+	return t.sendSingle(ChannelFrames, protocol.FrameStream(data), data, protocol.FrameKeyframe(data))
+}
+
+func (t *QUICTransport) SendInput(data []byte) error {
+	return t.sendMessage(ChannelInput, data)
+}
+
+func (t *QUICTransport) SendMove(data []byte) error {
+	return t.conn.SendDatagram(append([]byte{byte(ChannelMoves)}, data...))
+}
+
+func (t *QUICTransport) SendControl(data []byte) error {
+	return t.sendMessage(ChannelControl, data)
+}
+
+func (t *QUICTransport) SendCursor(data []byte) error {
+	return t.sendMessage(ChannelCursor, data)
+}
+
+// NetworkStats reports the smoothed RTT and the fraction of bytes lost since
+// the previous call. Frames are never queued behind each other, so nothing
+// counts as buffered.
+func (t *QUICTransport) NetworkStats() NetworkStats {
+	cs := t.conn.ConnectionStats()
+	t.statsMu.Lock()
+	sent, lost := cs.BytesSent-t.lastSent, cs.BytesLost-t.lastLost
+	t.lastSent, t.lastLost = cs.BytesSent, cs.BytesLost
+	t.statsMu.Unlock()
+
+	st := NetworkStats{RTT: cs.SmoothedRTT}
+	if sent > 0 {
+		st.Loss = min(float64(lost)/float64(sent), 1)
+	}
+	return st
+}
+
+func (t *QUICTransport) Close() error {
+	return t.conn.CloseWithError(0, "closed")
+}
+
+// sendSingle sends data on a fresh stream, cancelling the previous one
+// sent with the same key unless that is a keyframe and data isn't. Data
+// sent after a keyframe waits until the receiver has read it.
+func (t *QUICTransport) sendSingle(ch Channel, key uint8, data []byte, keyframe bool) error {
+	if !keyframe {
+		t.writeMu.Lock()
+		acked := t.frameOut[key].acked
+		t.writeMu.Unlock()
+		if acked != nil {
+			select {
+			case <-acked:
+			case <-t.conn.Context().Done():
+				return context.Cause(t.conn.Context())
+			}
+		}
+	}
+
+	var (
+		s     io.WriteCloser
+		out   quicFrameOut
+		acked chan struct{}
+	)
+	if keyframe {
+		bs, err := t.conn.OpenStream()
+		if err != nil {
+			return err
+		}
+		acked = make(chan struct{})
+		go func() {
+			// The receiver closes its side once it has read the frame.
+			io.Copy(io.Discard, bs)
+			close(acked)
+		}()
+		s, out = bs, quicFrameOut{s: bs, acked: acked}
+	} else {
+		us, err := t.conn.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		s, out = us, quicFrameOut{s: us}
+	}
+
+	t.writeMu.Lock()
+	prev := t.frameOut[key]
+	t.frameOut[key] = out
+	t.writeMu.Unlock()
+	if prev.s != nil {
+		prev.s.CancelWrite(quicErrStale)
+	}
+
+	if _, err := s.Write([]byte{quicStreamSingle, byte(ch)}); err != nil {
+		return err
+	}
+	if _, err := s.Write(data); err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// sendMessage sends data as a record on the reliable message stream.
+func (t *QUICTransport) sendMessage(ch Channel, data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	if t.msgs == nil {
+		s, err := t.conn.OpenUniStream()
+		if err != nil {
+			return err
+		}
+		if _, err := s.Write([]byte{quicStreamMessages}); err != nil {
+			return err
+		}
+		t.msgs = s
+	}
+
+	hdr := make([]byte, 5)
+	hdr[0] = byte(ch)
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(data)))
+	if _, err := t.msgs.Write(hdr); err != nil {
+		return err
+	}
+	_, err := t.msgs.Write(data)
+	return err
+}
+
+func (t *QUICTransport) acceptLoop() {
+	ctx := t.conn.Context()
+	for {
+		s, err := t.conn.AcceptUniStream(ctx)
+		if err != nil {
+			return
+		}
+		go t.readStream(s)
+	}
+}
+
+// acceptBidiLoop reads keyframes, closing each stream once it is read so
+// the sender knows the frames after it can follow.
+func (t *QUICTransport) acceptBidiLoop() {
+	ctx := t.conn.Context()
+	for {
+		s, err := t.conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			t.readStream(s)
+			s.Close()
+		}()
+	}
+}
+
+func (t *QUICTransport) datagramLoop() {
+	ctx := t.conn.Context()
+	for {
+		d, err := t.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if len(d) > 0 {
+			t.dispatch(Channel(d[0]), d[1:])
+		}
+	}
+}
+
+func (t *QUICTransport) readStream(s quicReceiver) {
+	r := bufio.NewReader(s)
+	kind, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch kind {
+	case quicStreamSingle:
+		ch, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r, maxQUICMessage))
+		if err != nil {
+			return // cancelled as stale
+		}
+		t.dispatch(Channel(ch), data)
+
+	case quicStreamMessages:
+		hdr := make([]byte, 5)
+		for {
+			if _, err := io.ReadFull(r, hdr); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(hdr[1:])
+			if n > maxQUICMessage {
+				s.CancelRead(0)
+				return
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			t.dispatch(Channel(hdr[0]), data)
+		}
+
+	default:
+		s.CancelRead(0)
+	}
+}
+
+// quicReceiver is the receive side of a uni or bidirectional stream.
+type quicReceiver interface {
+	io.Reader
+	CancelRead(quic.StreamErrorCode)
+}
+
+// LoadOrCreateCertificate loads the PEM certificate and key at path, or
+// creates a self-signed one there. Hosts and controllers both use one.
+// Keeping it on disk keeps the pinned fingerprint stable across restarts.
+func LoadOrCreateCertificate(path string) (tls.Certificate, error) {
+	if data, err := os.ReadFile(path); err == nil {
+		return tls.X509KeyPair(data, data)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "AirMac"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(data, data)
+}
+
+// CertificateFingerprint returns the hex SHA-256 fingerprint of cert's leaf,
+// in the form expected by DialQUIC and ListenQUIC.
+func CertificateFingerprint(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// parseFingerprint decodes a hex SHA-256 certificate fingerprint, ignoring
+// colons.
+func parseFingerprint(fp string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(fp, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid certificate fingerprint %q", fp)
+	}
+	return b, nil
+}
@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/junsooki/AirMac/internal/protocol"
+)
+
+// testCertificate creates a self-signed certificate for the test.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := LoadOrCreateCertificate(filepath.Join(t.TempDir(), "direct.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// TestQUICControllerPinned checks that the host only accepts controllers
+// whose certificate is in its allowlist.
+func TestQUICControllerPinned(t *testing.T) {
+	cert, allowed := testCertificate(t), testCertificate(t)
+	ln, err := ListenQUIC("127.0.0.1:0", cert, []string{CertificateFingerprint(allowed)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr, pin := ln.ln.Addr().String(), CertificateFingerprint(cert)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan *QUICTransport, 3)
+	go func() {
+		for {
+			host, err := ln.Accept(ctx)
+			if err != nil {
+				return
+			}
+			accepted <- host
+		}
+	}()
+
+	tests := []struct {
+		name string
+		cert tls.Certificate
+		ok   bool
+	}{
+		{"allowed", allowed, true},
+		{"unknown", testCertificate(t), false},
+		{"none", tls.Certificate{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl, err := DialQUIC(ctx, addr, pin, tt.cert)
+			if err == nil {
+				// The client finishes its handshake before the host checks
+				// its certificate, so a rejection may only show up later.
+				select {
+				case <-ctrl.conn.Context().Done():
+					err = context.Cause(ctrl.conn.Context())
+				case <-time.After(time.Second):
+				}
+				ctrl.Close()
+			}
+			if tt.ok != (err == nil) {
+				t.Fatalf("dial error %v, want ok=%v", err, tt.ok)
+			}
+			if tt.ok {
+				(<-accepted).Close()
+			}
+		})
+	}
+	select {
+	case <-accepted:
+		t.Fatal("host accepted a controller that isn't allowed")
+	default:
+	}
+
+	if _, err := ListenQUIC("127.0.0.1:0", cert, nil); err == nil {
+		t.Fatal("listened without any allowed controller")
+	}
+	if _, err := ListenQUIC("127.0.0.1:0", cert, []string{"nope"}); err == nil {
+		t.Fatal("listened with an invalid fingerprint")
+	}
+}
+
+// TestQUICKeyframeNotCancelled checks that the deltas sent right after a
+// large keyframe neither cancel nor overtake it.
+func TestQUICKeyframeNotCancelled(t *testing.T) {
+	cert, ctrlCert := testCertificate(t), testCertificate(t)
+	ln, err := ListenQUIC("127.0.0.1:0", cert, []string{CertificateFingerprint(ctrlCert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan *QUICTransport, 1)
+	go func() {
+		host, err := ln.Accept(ctx)
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- host
+	}()
+	ctrl, err := DialQUIC(ctx, ln.ln.Addr().String(), CertificateFingerprint(cert), ctrlCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	host := <-accepted
+	if host == nil {
+		t.FailNow()
+	}
+	defer host.Close()
+
+	frames := make(chan *protocol.FrameHeader, 10)
+	ctrl.OnFrame(func(data []byte) {
+		hdr, _, err := protocol.ParseFrame(data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		frames <- &hdr
+	})
+
+	frame := func(seq uint32, flags protocol.FrameFlags, size int) []byte {
+		return protocol.AppendFrame(nil, protocol.FrameHeader{
+			Version: protocol.FrameVersion,
+			Codec:   protocol.CodecTiles,
+			Flags:   flags,
+			Seq:     seq,
+		}, make([]byte, size))
+	}
+	go func() {
+		if err := host.SendFrame(frame(1, protocol.FlagKeyframe, 8<<20)); err != nil {
+			t.Error(err)
+		}
+		for seq := uint32(2); seq <= 4; seq++ {
+			if err := host.SendFrame(frame(seq, 0, 100)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	select {
+	case hdr := <-frames:
+		if hdr.Seq != 1 || hdr.Flags&protocol.FlagKeyframe == 0 {
+			t.Fatalf("first frame is seq %d flags %b, want the keyframe", hdr.Seq, hdr.Flags)
+		}
+	case <-ctx.Done():
+		t.Fatal("keyframe never arrived")
+	}
+	// The deltas may cancel each other, but not go back before the keyframe.
+	select {
+	case hdr := <-frames:
+		if hdr.Seq < 2 {
+			t.Fatalf("got seq %d after the keyframe", hdr.Seq)
+		}
+	case <-ctx.Done():
+		t.Fatal("no delta arrived after the keyframe")
+	}
+}
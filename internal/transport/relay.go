@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RelayRole identifies which end of the session a relay connection belongs to.
+type RelayRole string
+
+const (
+	RelayRoleHost       RelayRole = "host"
+	RelayRoleController RelayRole = "controller"
+)
+
+const (
+	relayWriteTimeout = 10 * time.Second
+	// relaySeqSize is the length of the sequence number each message
+	// starts with.
+	relaySeqSize = 8
+)
+
+// NewRelayKey generates an ephemeral X25519 key for the relay key exchange.
+// Public keys are exchanged over signaling, the same way DTLS fingerprints
+// are exchanged in the SDP, so the relay server only ever sees ciphertext.
+func NewRelayKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// RelayTransport tunnels frames and input through the signaling server's
+// WebSocket relay endpoint. Every message is sealed with AES-256-GCM using
+// per-direction keys derived from the X25519 exchange. Each message starts
+// with its sequence number, which is the nonce. The relay server drops
+// messages sent before the peer joins, so the receiver accepts gaps, but
+// never a number it has already seen or an older one.
+type RelayTransport struct {
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+	sendKey cipher.AEAD
+	sendSeq uint64
+
+	recvKey cipher.AEAD
+	// recvNext is the lowest sequence number accepted next.
+	recvNext uint64
+
+	handlers
+
+	closeOnce sync.Once
+}
+
+// DialRelay connects to the relay endpoint and joins session as role.
+// priv is the local key and peerPublic the key received over signaling.
+func DialRelay(relayURL, session string, role RelayRole, priv *ecdh.PrivateKey, peerPublic []byte) (*RelayTransport, error) {
+	sendKey, recvKey, err := relayKeys(session, role, priv, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return nil, fmt.Errorf("relay url: %w", err)
+	}
+	q := u.Query()
+	q.Set("session", session)
+	q.Set("role", string(role))
+	u.RawQuery = q.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("relay dial: %w", err)
+	}
+
+	t := &RelayTransport{
+		conn:    conn,
+		sendKey: sendKey,
+		recvKey: recvKey,
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+func (t *RelayTransport) SendFrame(data []byte) error {
+	return t.send(ChannelFrames, data)
+}
+
+func (t *RelayTransport) SendInput(data []byte) error {
+	return t.send(ChannelInput, data)
+}
+
+// SendMove sends on the relay's single ordered stream; the relay is TCP,
+// so there is no unreliable lane.
+func (t *RelayTransport) SendMove(data []byte) error {
+	return t.send(ChannelMoves, data)
+}
+
+func (t *RelayTransport) SendControl(data []byte) error {
+	return t.send(ChannelControl, data)
+}
+
+func (t *RelayTransport) SendCursor(data []byte) error {
+	return t.send(ChannelCursor, data)
+}
+
+func (t *RelayTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		err = t.conn.Close()
+	})
+	return err
+}
+
+func (t *RelayTransport) send(ch Channel, data []byte) error {
+	plain := make([]byte, 1+len(data))
+	plain[0] = byte(ch)
+	copy(plain[1:], data)
+
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	sealed := binary.BigEndian.AppendUint64(nil, t.sendSeq)
+	sealed = t.sendKey.Seal(sealed, relayNonce(t.sendSeq), plain, nil)
+	t.sendSeq++
+	t.conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+	return t.conn.WriteMessage(websocket.BinaryMessage, sealed)
+}
+
+func (t *RelayTransport) readLoop() {
+	defer t.Close()
+	for {
+		msgType, msg, err := t.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		plain, err := t.open(msg)
+		if err != nil {
+			// A message failed authentication or was replayed, so the
+			// stream is no longer trustworthy.
+			log.Printf("relay: drop connection: %v", err)
+			return
+		}
+		if len(plain) == 0 {
+			continue
+		}
+		t.dispatch(Channel(plain[0]), plain[1:])
+	}
+}
+
+// open authenticates and decrypts msg, a sequence number followed by the
+// sealed message.
+func (t *RelayTransport) open(msg []byte) ([]byte, error) {
+	if len(msg) < relaySeqSize {
+		return nil, fmt.Errorf("short message (%d bytes)", len(msg))
+	}
+	seq := binary.BigEndian.Uint64(msg)
+	if seq < t.recvNext {
+		return nil, fmt.Errorf("sequence number %d replayed (expected at least %d)", seq, t.recvNext)
+	}
+	plain, err := t.recvKey.Open(nil, relayNonce(seq), msg[relaySeqSize:], nil)
+	if err != nil {
+		return nil, err
+	}
+	t.recvNext = seq + 1
+	return plain, nil
+}
+
+// relayKeys derives the send and receive keys for role.
+func relayKeys(session string, role RelayRole, priv *ecdh.PrivateKey, peerPublic []byte) (send, recv cipher.AEAD, err error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, nil, fmt.Errorf("relay peer key: %w", err)
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("relay key exchange: %w", err)
+	}
+
+	hostToCtrl, err := relayAEAD(secret, session, "airmac relay host->controller")
+	if err != nil {
+		return nil, nil, err
+	}
+	ctrlToHost, err := relayAEAD(secret, session, "airmac relay controller->host")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if role == RelayRoleHost {
+		return hostToCtrl, ctrlToHost, nil
+	}
+	return ctrlToHost, hostToCtrl, nil
+}
+
+func relayAEAD(secret []byte, session, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, []byte(session), info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func relayNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeRelay pairs a host and a controller like the signaling server's
+// /relay endpoint: binary messages are forwarded to the other side if it
+// has joined, and dropped otherwise.
+type fakeRelay struct {
+	mu      sync.Mutex
+	conns   map[string]*websocket.Conn
+	dropped int
+}
+
+func (r *fakeRelay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	role := req.URL.Query().Get("role")
+	peerRole := string(RelayRoleHost)
+	if role == string(RelayRoleHost) {
+		peerRole = string(RelayRoleController)
+	}
+	r.mu.Lock()
+	r.conns[role] = conn
+	r.mu.Unlock()
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		if peer := r.conns[peerRole]; peer != nil && msgType == websocket.BinaryMessage {
+			peer.WriteMessage(websocket.BinaryMessage, data)
+		} else {
+			r.dropped++
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *fakeRelay) joined(role RelayRole) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[string(role)] != nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestRelayDroppedBeforeJoin checks that the messages the server drops
+// while the host waits for the controller to join don't break the session.
+func TestRelayDroppedBeforeJoin(t *testing.T) {
+	relay := &fakeRelay{conns: map[string]*websocket.Conn{}}
+	srv := httptest.NewServer(relay)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	hostKey, err := NewRelayKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrlKey, err := NewRelayKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, err := DialRelay(url, "s1", RelayRoleHost, hostKey, ctrlKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	waitFor(t, "host to join", func() bool { return relay.joined(RelayRoleHost) })
+	for i := range 5 {
+		if err := host.SendFrame(fmt.Appendf(nil, "dropped %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "the server to drop the early frames", func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		return relay.dropped == 5
+	})
+
+	ctrl, err := DialRelay(url, "s1", RelayRoleController, ctrlKey, hostKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	frames := make(chan string, 10)
+	ctrl.OnFrame(func(data []byte) { frames <- string(data) })
+	inputs := make(chan string, 10)
+	host.OnInput(func(data []byte) { inputs <- string(data) })
+	waitFor(t, "controller to join", func() bool { return relay.joined(RelayRoleController) })
+
+	for i := range 3 {
+		want := fmt.Sprintf("frame %d", i)
+		if err := host.SendFrame([]byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-frames:
+			if got != want {
+				t.Fatalf("controller got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("controller didn't get %q", want)
+		}
+	}
+	if err := ctrl.SendInput([]byte("click")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-inputs:
+		if got != "click" {
+			t.Fatalf("host got %q, want click", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("host didn't get the controller's input")
+	}
+}
+
+func TestRelayRejectsReplay(t *testing.T) {
+	hostKey, _ := NewRelayKey()
+	ctrlKey, _ := NewRelayKey()
+	send, _, err := relayKeys("s1", RelayRoleHost, hostKey, ctrlKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, recv, err := relayKeys("s1", RelayRoleController, ctrlKey, hostKey.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(seq uint64, plain string) []byte {
+		msg := binary.BigEndian.AppendUint64(nil, seq)
+		return send.Seal(msg, relayNonce(seq), []byte(plain), nil)
+	}
+	rt := &RelayTransport{recvKey: recv}
+
+	for _, tc := range []struct {
+		seq  uint64
+		ok   bool
+		desc string
+	}{
+		{7, true, "first message after a gap"},
+		{7, false, "replayed"},
+		{3, false, "older"},
+		{8, true, "next"},
+		{20, true, "after another gap"},
+	} {
+		_, err := rt.open(seal(tc.seq, "x"))
+		if (err == nil) != tc.ok {
+			t.Errorf("seq %d (%s): err = %v, want ok = %v", tc.seq, tc.desc, err, tc.ok)
+		}
+	}
+
+	tampered := seal(21, "x")
+	tampered[len(tampered)-1] ^= 1
+	if _, err := rt.open(tampered); err == nil {
+		t.Error("tampered message accepted")
+	}
+	// A sequence number moved onto another message fails authentication.
+	moved := seal(22, "x")
+	binary.BigEndian.PutUint64(moved, 23)
+	if _, err := rt.open(moved); err == nil {
+		t.Error("message with a changed sequence number accepted")
+	}
+	if _, err := rt.open([]byte{1, 2, 3}); err == nil {
+		t.Error("short message accepted")
+	}
+}
@@ -0,0 +1,348 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Transport carries encoded frames from host to controller and input events
+// from controller to host. Input has two lanes: SendInput is reliable and
+// ordered, SendMove is unordered and never retransmitted (for mouse moves,
+// which a newer move supersedes); both arrive at OnInput. The control
+// channel is reliable, ordered and used in both directions for session
+// messages. The cursor channel carries pointer updates from host to
+// controller; it is reliable, but may reorder messages so that one lost
+// update doesn't hold back the next.
+type Transport interface {
+	SendFrame(data []byte) error
+	SendInput(data []byte) error
+	SendMove(data []byte) error
+	SendControl(data []byte) error
+	SendCursor(data []byte) error
+	OnFrame(cb func(data []byte))
+	OnInput(cb func(data []byte))
+	OnControl(cb func(data []byte))
+	OnCursor(cb func(data []byte))
+	Close() error
+}
+
+// NetworkStats describes the path frames are sent on, for rate control.
+// Zero values mean the transport can't measure that quantity.
+type NetworkStats struct {
+	// RTT is the current round-trip time.
+	RTT time.Duration
+	// Loss is the recent fraction of frame data lost, 0 to 1.
+	Loss float64
+	// Buffered is the number of frame bytes queued but not yet sent.
+	Buffered uint64
+}
+
+// StatsReporter is implemented by transports that can report NetworkStats.
+type StatsReporter interface {
+	NetworkStats() NetworkStats
+}
+
+// Channel tags a message when several logical channels are multiplexed over
+// one connection (relay, QUIC). Values are stable on the wire.
+type Channel byte
+
+const (
+	ChannelFrames  Channel = 1
+	ChannelInput   Channel = 2
+	ChannelControl Channel = 3
+	ChannelMoves   Channel = 4
+	ChannelCursor  Channel = 5
+)
+
+// handlers holds the callbacks of a multiplexed transport and dispatches
+// incoming messages to them by channel.
+type handlers struct {
+	mu        sync.Mutex
+	onFrame   func(data []byte)
+	onInput   func(data []byte)
+	onControl func(data []byte)
+	onCursor  func(data []byte)
+}
+
+func (h *handlers) OnFrame(cb func(data []byte)) {
+	h.mu.Lock()
+	h.onFrame = cb
+	h.mu.Unlock()
+}
+
+func (h *handlers) OnInput(cb func(data []byte)) {
+	h.mu.Lock()
+	h.onInput = cb
+	h.mu.Unlock()
+}
+
+func (h *handlers) OnControl(cb func(data []byte)) {
+	h.mu.Lock()
+	h.onControl = cb
+	h.mu.Unlock()
+}
+
+func (h *handlers) OnCursor(cb func(data []byte)) {
+	h.mu.Lock()
+	h.onCursor = cb
+	h.mu.Unlock()
+}
+
+func (h *handlers) dispatch(ch Channel, data []byte) {
+	h.mu.Lock()
+	var cb func(data []byte)
+	switch ch {
+	case ChannelFrames:
+		cb = h.onFrame
+	case ChannelInput, ChannelMoves:
+		cb = h.onInput
+	case ChannelControl:
+		cb = h.onControl
+	case ChannelCursor:
+		cb = h.onCursor
+	}
+	h.mu.Unlock()
+	if cb != nil {
+		cb(data)
+	}
+}
+
+// SwitchableTransport forwards to an underlying Transport that can be replaced
+// mid-session (e.g. when falling back from WebRTC to the WebSocket relay).
+// Callbacks registered on it are carried over to every new transport. It
+// implements Video, which is active only while the current transport has
+// an active video track.
+type SwitchableTransport struct {
+	mu                sync.RWMutex
+	current           Transport
+	onFrame           func(data []byte)
+	onInput           func(data []byte)
+	onControl         func(data []byte)
+	onCursor          func(data []byte)
+	onVideo           func(frame []byte)
+	onKeyframeRequest func()
+}
+
+// NewSwitchableTransport wraps t, which may be nil until a transport is ready.
+func NewSwitchableTransport(t Transport) *SwitchableTransport {
+	s := &SwitchableTransport{}
+	s.Switch(t)
+	return s
+}
+
+// Switch replaces the underlying transport and closes the previous one.
+func (s *SwitchableTransport) Switch(t Transport) {
+	if t != nil {
+		t.OnFrame(s.handleFrame)
+		t.OnInput(s.handleInput)
+		t.OnControl(s.handleControl)
+		t.OnCursor(s.handleCursor)
+		if v, ok := t.(Video); ok {
+			v.OnVideo(s.handleVideo)
+			v.OnKeyframeRequest(s.handleKeyframeRequest)
+		}
+	}
+
+	s.mu.Lock()
+	prev := s.current
+	s.current = t
+	s.mu.Unlock()
+
+	if prev != nil && prev != t {
+		prev.Close()
+	}
+}
+
+func (s *SwitchableTransport) SendFrame(data []byte) error {
+	s.mu.RLock()
+	t := s.current
+	s.mu.RUnlock()
+	if t == nil {
+		return fmt.Errorf("transport not ready")
+	}
+	return t.SendFrame(data)
+}
+
+func (s *SwitchableTransport) SendInput(data []byte) error {
+	s.mu.RLock()
+	t := s.current
+	s.mu.RUnlock()
+	if t == nil {
+		return fmt.Errorf("transport not ready")
+	}
+	return t.SendInput(data)
+}
+
+func (s *SwitchableTransport) SendMove(data []byte) error {
+	s.mu.RLock()
+	t := s.current
+	s.mu.RUnlock()
+	if t == nil {
+		return fmt.Errorf("transport not ready")
+	}
+	return t.SendMove(data)
+}
+
+func (s *SwitchableTransport) SendControl(data []byte) error {
+	s.mu.RLock()
+	t := s.current
+	s.mu.RUnlock()
+	if t == nil {
+		return fmt.Errorf("transport not ready")
+	}
+	return t.SendControl(data)
+}
+
+func (s *SwitchableTransport) SendCursor(data []byte) error {
+	s.mu.RLock()
+	t := s.current
+	s.mu.RUnlock()
+	if t == nil {
+		return fmt.Errorf("transport not ready")
+	}
+	return t.SendCursor(data)
+}
+
+// video returns the current transport's video, or nil.
+func (s *SwitchableTransport) video() Video {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, _ := s.current.(Video)
+	return v
+}
+
+func (s *SwitchableTransport) VideoActive() bool {
+	v := s.video()
+	return v != nil && v.VideoActive()
+}
+
+func (s *SwitchableTransport) WriteVideo(frame []byte, duration time.Duration) error {
+	v := s.video()
+	if v == nil {
+		return errNoVideo
+	}
+	return v.WriteVideo(frame, duration)
+}
+
+func (s *SwitchableTransport) RequestKeyframe() error {
+	v := s.video()
+	if v == nil {
+		return errNoVideo
+	}
+	return v.RequestKeyframe()
+}
+
+// NetworkStats returns the current transport's stats, or zero stats if it
+// doesn't report any.
+func (s *SwitchableTransport) NetworkStats() NetworkStats {
+	s.mu.RLock()
+	r, ok := s.current.(StatsReporter)
+	s.mu.RUnlock()
+	if !ok {
+		return NetworkStats{}
+	}
+	return r.NetworkStats()
+}
+
+func (s *SwitchableTransport) OnVideo(cb func(frame []byte)) {
+	s.mu.Lock()
+	s.onVideo = cb
+	s.mu.Unlock()
+}
+
+func (s *SwitchableTransport) OnKeyframeRequest(cb func()) {
+	s.mu.Lock()
+	s.onKeyframeRequest = cb
+	s.mu.Unlock()
+}
+
+func (s *SwitchableTransport) OnFrame(cb func(data []byte)) {
+	s.mu.Lock()
+	s.onFrame = cb
+	s.mu.Unlock()
+}
+
+func (s *SwitchableTransport) OnInput(cb func(data []byte)) {
+	s.mu.Lock()
+	s.onInput = cb
+	s.mu.Unlock()
+}
+
+func (s *SwitchableTransport) OnControl(cb func(data []byte)) {
+	s.mu.Lock()
+	s.onControl = cb
+	s.mu.Unlock()
+}
+
+func (s *SwitchableTransport) OnCursor(cb func(data []byte)) {
+	s.mu.Lock()
+	s.onCursor = cb
+	s.mu.Unlock()
+}
+
+// Close closes the current underlying transport.
+func (s *SwitchableTransport) Close() error {
+	s.mu.Lock()
+	t := s.current
+	s.current = nil
+	s.mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.Close()
+}
+
+func (s *SwitchableTransport) handleFrame(data []byte) {
+	s.mu.RLock()
+	cb := s.onFrame
+	s.mu.RUnlock()
+	if cb != nil {
+		cb(data)
+	}
+}
+
+func (s *SwitchableTransport) handleInput(data []byte) {
+	s.mu.RLock()
+	cb := s.onInput
+	s.mu.RUnlock()
+	if cb != nil {
+		cb(data)
+	}
+}
+
+func (s *SwitchableTransport) handleControl(data []byte) {
+	s.mu.RLock()
+	cb := s.onControl
+	s.mu.RUnlock()
+	if cb != nil {
+		cb(data)
+	}
+}
+
+func (s *SwitchableTransport) handleCursor(data []byte) {
+	s.mu.RLock()
+	cb := s.onCursor
+	s.mu.RUnlock()
+	if cb != nil {
+		cb(data)
+	}
+}
+
+func (s *SwitchableTransport) handleVideo(frame []byte) {
+	s.mu.RLock()
+	cb := s.onVideo
+	s.mu.RUnlock()
+	if cb != nil {
+		cb(frame)
+	}
+}
+
+func (s *SwitchableTransport) handleKeyframeRequest() {
+	s.mu.RLock()
+	cb := s.onKeyframeRequest
+	s.mu.RUnlock()
+	if cb != nil {
+		cb()
+	}
+}
@@ -0,0 +1,172 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// Video is implemented by transports that can carry a VP8 video track next
+// to the frames channel (WebRTC). The host writes encoded frames and answers
+// keyframe requests; the controller receives frames and asks for keyframes.
+type Video interface {
+	// VideoActive reports whether a video track is negotiated and usable.
+	VideoActive() bool
+	WriteVideo(frame []byte, duration time.Duration) error
+	OnKeyframeRequest(cb func())
+	OnVideo(cb func(frame []byte))
+	RequestKeyframe() error
+}
+
+// videoMaxLate is how many RTP packets the sample builder waits for a
+// missing packet before giving up on the frame.
+const videoMaxLate = 256
+
+var errNoVideo = errors.New("no video track")
+
+// VideoTrack is one end of a VP8 track on a PeerConnection. pion handles
+// RTP packetization, NACK retransmission and RTCP reports; VideoTrack adds
+// frame reassembly on the receiving end and PLI/FIR keyframe requests.
+type VideoTrack struct {
+	pc *webrtc.PeerConnection
+
+	mu                sync.Mutex
+	local             *webrtc.TrackLocalStaticSample
+	remoteSSRC        uint32
+	remote            bool
+	onVideo           func(frame []byte)
+	onKeyframeRequest func()
+}
+
+// NewLocalVideoTrack adds a VP8 track to pc for sending. On the answering
+// side it takes over the transceiver the offer created.
+func NewLocalVideoTrack(pc *webrtc.PeerConnection) (*VideoTrack, error) {
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "airmac")
+	if err != nil {
+		return nil, err
+	}
+	sender, err := pc.AddTrack(track)
+	if err != nil {
+		return nil, fmt.Errorf("add video track: %w", err)
+	}
+
+	v := &VideoTrack{pc: pc, local: track}
+	go v.readRTCP(sender)
+	return v, nil
+}
+
+// NewRemoteVideoTrack offers to receive a VP8 track on pc. Call it before
+// creating the offer.
+func NewRemoteVideoTrack(pc *webrtc.PeerConnection) (*VideoTrack, error) {
+	_, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("add video transceiver: %w", err)
+	}
+
+	v := &VideoTrack{pc: pc}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		log.Printf("video track received: %s", track.Codec().MimeType)
+		v.mu.Lock()
+		v.remote = true
+		v.remoteSSRC = uint32(track.SSRC())
+		v.mu.Unlock()
+		go v.readTrack(track)
+	})
+	return v, nil
+}
+
+// VideoActive reports whether the track can send (host) or has started
+// receiving (controller).
+func (v *VideoTrack) VideoActive() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.local != nil || v.remote
+}
+
+// WriteVideo sends one encoded frame.
+func (v *VideoTrack) WriteVideo(frame []byte, duration time.Duration) error {
+	if v.local == nil {
+		return errNoVideo
+	}
+	return v.local.WriteSample(media.Sample{Data: frame, Duration: duration})
+}
+
+func (v *VideoTrack) OnKeyframeRequest(cb func()) {
+	v.mu.Lock()
+	v.onKeyframeRequest = cb
+	v.mu.Unlock()
+}
+
+func (v *VideoTrack) OnVideo(cb func(frame []byte)) {
+	v.mu.Lock()
+	v.onVideo = cb
+	v.mu.Unlock()
+}
+
+// RequestKeyframe sends a PLI for the received track.
+func (v *VideoTrack) RequestKeyframe() error {
+	v.mu.Lock()
+	ssrc, ok := v.remoteSSRC, v.remote
+	v.mu.Unlock()
+	if !ok {
+		return errNoVideo
+	}
+	return v.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+}
+
+// readRTCP watches the sender's RTCP for keyframe requests. Reading also
+// keeps pion's interceptors (NACK responder, reports) running.
+func (v *VideoTrack) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range pkts {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				v.mu.Lock()
+				cb := v.onKeyframeRequest
+				v.mu.Unlock()
+				if cb != nil {
+					cb()
+				}
+			}
+		}
+	}
+}
+
+// readTrack reassembles RTP packets into frames, reordering them and
+// waiting for NACK retransmissions, and delivers them in order.
+func (v *VideoTrack) readTrack(track *webrtc.TrackRemote) {
+	sb := samplebuilder.New(videoMaxLate, &codecs.VP8Packet{}, track.Codec().ClockRate)
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		sb.Push(pkt)
+		for s := sb.Pop(); s != nil; s = sb.Pop() {
+			v.mu.Lock()
+			cb := v.onVideo
+			v.mu.Unlock()
+			if cb != nil {
+				cb(s.Data)
+			}
+		}
+	}
+}
@@ -21,6 +21,11 @@ const server = http.createServer((req, res) => {
 const wss = new WebSocket.Server({ server });
 const clients = new Map();
 
+// Relay sessions for peers whose WebRTC connection failed: session ID ->
+// { host, controller }. Payloads are end-to-end encrypted by the peers, so
+// the server only forwards opaque binary messages between the two sockets.
+const relaySessions = new Map();
+
 wss.on('connection', (ws, req) => {
     const clientIp = req.socket.remoteAddress;
     let clientId = null;
@@ -31,6 +36,11 @@ wss.on('connection', (ws, req) => {
     ws.isAlive = true;
     ws.on('pong', () => { ws.isAlive = true; });
 
+    if (req.url.startsWith('/relay')) {
+        handleRelay(ws, req);
+        return;
+    }
+
     ws.on('message', (data) => {
         try {
             const message = JSON.parse(data.toString());
@@ -66,6 +76,8 @@ wss.on('connection', (ws, req) => {
             case 'offer':
             case 'answer':
             case 'ice-candidate':
+            case 'relay-offer':
+            case 'relay-answer':
                 handleSignaling(ws, message);
                 break;
             case 'ping':
@@ -125,6 +137,50 @@ wss.on('connection', (ws, req) => {
     }
 });
 
+function handleRelay(ws, req) {
+    const params = new URL(req.url, 'http://localhost').searchParams;
+    const session = params.get('session');
+    const role = params.get('role');
+    if (!session || (role !== 'host' && role !== 'controller')) {
+        ws.close(1008, 'session and role required');
+        return;
+    }
+
+    let pair = relaySessions.get(session);
+    if (!pair) {
+        pair = {};
+        relaySessions.set(session, pair);
+    }
+    if (pair[role]) {
+        ws.close(1008, `${role} already joined`);
+        return;
+    }
+    pair[role] = ws;
+    const peerRole = role === 'host' ? 'controller' : 'host';
+    console.log(`[${new Date().toISOString()}] Relay ${session}: ${role} joined`);
+
+    ws.on('message', (data, isBinary) => {
+        const peer = pair[peerRole];
+        if (isBinary && peer && peer.readyState === WebSocket.OPEN) {
+            peer.send(data, { binary: true });
+        }
+    });
+
+    ws.on('close', () => {
+        delete pair[role];
+        const peer = pair[peerRole];
+        if (peer) {
+            peer.close(1000, `${role} left`);
+        }
+        relaySessions.delete(session);
+        console.log(`[${new Date().toISOString()}] Relay ${session}: ${role} left`);
+    });
+
+    ws.on('error', (error) => {
+        console.error(`Relay ${session} error for ${role}:`, error);
+    });
+}
+
 const heartbeat = setInterval(() => {
     wss.clients.forEach((ws) => {
         if (!ws.isAlive) return ws.terminate();